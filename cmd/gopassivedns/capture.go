@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	log "github.com/sirupsen/logrus"
+)
+
+// anyDevice captures from every interface
+const anyDevice string = "any"
+
+// captureSource is somewhere packets are captured from, e.g. a pcap handle or
+// a group of AF_PACKET sockets.
+type captureSource interface {
+	// PacketSources returns a packet source for each socket or handle to read,
+	// each one is read by its own goroutine
+	PacketSources() []ifaceSource
+	// SetBPFFilter replaces the filter on every socket or handle
+	SetBPFFilter(expr string) error
+	// CaptureStats returns the running totals of packets captured and dropped
+	CaptureStats() (captureStats, error)
+	Close()
+}
+
+// captureStats are running totals, as reported by pcap_stats(3)
+type captureStats struct {
+	received  int64
+	dropped   int64
+	ifDropped int64
+}
+
+// captureStatsDelta returns how much each total has grown since last.  A total
+// that went down, because a 32-bit counter wrapped or the source was replaced,
+// counts as nothing and the next report counts on from cur.
+func captureStatsDelta(cur captureStats, last captureStats) captureStats {
+	delta := func(cur int64, last int64) int64 {
+		if cur < last {
+			return 0
+		}
+		return cur - last
+	}
+	return captureStats{
+		received:  delta(cur.received, last.received),
+		dropped:   delta(cur.dropped, last.dropped),
+		ifDropped: delta(cur.ifDropped, last.ifDropped),
+	}
+}
+
+// pfringClusterType is how a PF_RING cluster balances packets between its
+// members. It is kept separate from the pfring package so the setting can be
+// checked in builds without PF_RING.
+type pfringClusterType uint8
+
+const (
+	pfringClusterPerFlow pfringClusterType = iota
+	pfringClusterRoundRobin
+	pfringClusterPerFlow2Tuple
+	pfringClusterPerFlow4Tuple
+	pfringClusterPerFlow5Tuple
+	pfringClusterPerFlowTCP5Tuple
+)
+
+// parsePFRingClusterType converts a pfring_cluster_type setting
+func parsePFRingClusterType(clusterType string) (pfringClusterType, error) {
+	switch strings.ToLower(clusterType) {
+	case "", "flow":
+		return pfringClusterPerFlow, nil
+	case "round_robin":
+		return pfringClusterRoundRobin, nil
+	case "2_tuple":
+		return pfringClusterPerFlow2Tuple, nil
+	case "4_tuple":
+		return pfringClusterPerFlow4Tuple, nil
+	case "5_tuple":
+		return pfringClusterPerFlow5Tuple, nil
+	case "tcp_5_tuple":
+		return pfringClusterPerFlowTCP5Tuple, nil
+	default:
+		return pfringClusterPerFlow, fmt.Errorf("invalid PF_RING cluster type: %s", clusterType)
+	}
+}
+
+// ifaceSource is a packet source and the name of the interface it captures
+// from, which is empty for a pcap file
+type ifaceSource struct {
+	packets  *gopacket.PacketSource
+	linkType layers.LinkType
+	iface    string
+	// byIndex is set when the source captures from every interface, so the
+	// interface is looked up from each packet's capture info
+	byIndex bool
+}
+
+// multiSource captures from several sources at once, e.g. one per interface
+type multiSource []captureSource
+
+func (m multiSource) PacketSources() []ifaceSource {
+	var packetSources []ifaceSource
+	for _, source := range m {
+		packetSources = append(packetSources, source.PacketSources()...)
+	}
+	return packetSources
+}
+
+func (m multiSource) SetBPFFilter(expr string) error {
+	for _, source := range m {
+		if err := source.SetBPFFilter(expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiSource) CaptureStats() (captureStats, error) {
+	var total captureStats
+	for _, source := range m {
+		sourceStats, err := source.CaptureStats()
+		if err != nil {
+			return captureStats{}, err
+		}
+		total.received += sourceStats.received
+		total.dropped += sourceStats.dropped
+		total.ifDropped += sourceStats.ifDropped
+	}
+	return total, nil
+}
+
+func (m multiSource) Close() {
+	for _, source := range m {
+		source.Close()
+	}
+}
+
+// parseDevices splits a comma separated -dev setting into device names
+func parseDevices(devices string) []string {
+	var parsed []string
+	for _, device := range strings.Split(devices, ",") {
+		if device = strings.TrimSpace(device); device != "" {
+			parsed = append(parsed, device)
+		}
+	}
+	return parsed
+}
+
+// newIfaceSource returns a packet source for iface, set up the way doCapture
+// reads them
+func newIfaceSource(source gopacket.PacketDataSource, linkType layers.LinkType, iface string) ifaceSource {
+	packetSource := gopacket.NewPacketSource(source, linkType)
+	//only decode packet in response to function calls, this moves the
+	//packet processing to the processing threads
+	packetSource.DecodeOptions.Lazy = true
+	//We don't mutate bytes of the packets, so no need to make a copy
+	//this does mean we need to pass the packet via the channel, not a pointer to the packet
+	//as the underlying buffer will get re-allocated
+	packetSource.DecodeOptions.NoCopy = true
+
+	return ifaceSource{packets: packetSource, linkType: linkType, iface: iface}
+}
+
+// pcapSource captures with libpcap, from a device or a pcap file. iface is
+// empty for a pcap file.
+type pcapSource struct {
+	handle *pcap.Handle
+	iface  string
+}
+
+func (p *pcapSource) PacketSources() []ifaceSource {
+	return []ifaceSource{newIfaceSource(p.handle, p.handle.LinkType(), p.iface)}
+}
+
+func (p *pcapSource) SetBPFFilter(expr string) error {
+	return p.handle.SetBPFFilter(expr)
+}
+
+func (p *pcapSource) CaptureStats() (captureStats, error) {
+	handleStats, err := p.handle.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{
+		received:  int64(handleStats.PacketsReceived),
+		dropped:   int64(handleStats.PacketsDropped),
+		ifDropped: int64(handleStats.PacketsIfDropped),
+	}, nil
+}
+
+func (p *pcapSource) Close() {
+	p.handle.Close()
+}
+
+// dispatchOptions controls what the capture readers do with packets before
+// they reach the packet processing threads
+type dispatchOptions struct {
+	decapsulate bool // have the packet processing threads decode the packets inside tunnels
+	defrag      defragLimits
+}
+
+// readPackets starts a goroutine reading each of the packet sources and sending
+// the packets to the packet processing threads.  The returned channel is
+// closed once every source has run out of packets, or stop is closed.
+func readPackets(packetSources []ifaceSource, channels []chan *packetData, opts dispatchOptions, stats metrics, stop chan struct{}) chan struct{} {
+	var readers sync.WaitGroup
+	for _, packetSource := range packetSources {
+		readers.Add(1)
+		go func(packetSource ifaceSource) {
+			defer readers.Done()
+			dispatchPackets(packetSource, channels, opts, stats, stop)
+		}(packetSource)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(done)
+	}()
+	return done
+}
+
+// dispatchPackets sends each packet from packetSource to the packet processing
+// thread for its flow, until it runs out of packets or stop is closed.
+// Fragmented datagrams are reassembled first, as only the first fragment
+// carries the ports.
+func dispatchPackets(packetSource ifaceSource, channels []chan *packetData, opts dispatchOptions, stats metrics, stop chan struct{}) {
+	var link linkLayers
+	var IPv4Layer layers.IPv4
+	var IPv6Layer layers.IPv6
+	var UDPLayer layers.UDP
+	var TCPLayer layers.TCP
+
+	firstLayer, err := firstLayerType(packetSource.linkType)
+	if err != nil {
+		log.Warnf("gopassivedns: %s capturing from %s, decoding it as Ethernet", err, packetSource.iface)
+	}
+
+	parser := gopacket.NewDecodingLayerParser(
+		firstLayer,
+		append(link.decodingLayers(),
+			&IPv4Layer,
+			&IPv6Layer,
+			&UDPLayer,
+			&TCPLayer,
+		)...,
+	)
+
+	foundLayerTypes := []gopacket.LayerType{}
+	packets := packetSource.packets.Packets()
+	ifaces := ifaceNames{}
+
+	var defrag *defragmenter
+	if opts.defrag.maxBytes > 0 {
+		defrag = newDefragmenter(opts.defrag, stats)
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case packet := <-packets:
+			if packet == nil {
+				//if we get here, we're likely reading a pcap and we've finished
+				//or, potentially, the physical device we've been reading from has been
+				//downed.  Or something else crazy has gone wrong...so we stop
+				//reading this source entirely.
+				log.Debug("packetSource returned nil")
+				return
+			}
+
+			link.reset()
+			parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+
+			if defrag != nil {
+				reassembled := defrag.defragPacket(packet, firstLayer, foundLayerTypes, &IPv4Layer, &IPv6Layer)
+				if reassembled == nil {
+					continue
+				}
+				if reassembled != packet {
+					packet = reassembled
+					link.reset()
+					parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+				}
+			}
+
+			//a tunnel is one flow, but the lookups in it are spread over the threads like any others
+			if opts.decapsulate {
+				decapsulateFlow(&foundLayerTypes, &IPv4Layer, &IPv6Layer, &UDPLayer, &TCPLayer)
+			}
+
+			iface := packetSource.iface
+			switch {
+			case packetSource.byIndex:
+				iface = ifaces.name(packet.Metadata().InterfaceIndex)
+			case iface == anyDevice && foundLayerType(layerTypeLinuxSLL2, foundLayerTypes):
+				//libpcap doesn't fill in the capture info, but its SLL2 header has the interface
+				iface = ifaces.name(link.sll2.ifindex)
+			}
+			//the ports are part of the hash so lookups between the same two hosts are spread out
+			var transport gopacket.Flow
+			if foundLayerType(layers.LayerTypeUDP, foundLayerTypes) {
+				transport = UDPLayer.TransportFlow()
+			} else if foundLayerType(layers.LayerTypeTCP, foundLayerTypes) {
+				transport = TCPLayer.TransportFlow()
+			}
+			if foundLayerType(layers.LayerTypeIPv4, foundLayerTypes) {
+				pd := newPacketData(packet, firstLayer, iface)
+				pd.decapsulate = opts.decapsulate
+				channels[workerFor(flowHash(IPv4Layer.NetworkFlow(), transport), len(channels))] <- pd
+				if stats != nil {
+					stats.Incr("packets", 1)
+				}
+			}
+			if foundLayerType(layers.LayerTypeIPv6, foundLayerTypes) {
+				pd := newPacketData(packet, firstLayer, iface)
+				pd.decapsulate = opts.decapsulate
+				channels[workerFor(flowHash(IPv6Layer.NetworkFlow(), transport), len(channels))] <- pd
+				if stats != nil {
+					stats.Incr("packets_v6", 1)
+				}
+			}
+		}
+	}
+}
+
+// ifaceNames caches the names of interfaces by index, for sources capturing
+// from every interface
+type ifaceNames map[int]string
+
+// name returns the name of the interface with index, or the index if the
+// interface has gone
+func (i ifaceNames) name(index int) string {
+	if name, found := i[index]; found {
+		return name
+	}
+
+	name := strconv.Itoa(index)
+	if iface, err := net.InterfaceByIndex(index); err == nil {
+		name = iface.Name
+	}
+	i[index] = name
+	return name
+}
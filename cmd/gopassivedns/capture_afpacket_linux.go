@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"golang.org/x/net/bpf"
+)
+
+// afpacketSource captures from one or more AF_PACKET sockets with TPACKET_V3
+// rings.  With more than one socket they join a fanout group, so the kernel
+// spreads flows over the sockets and each is read by its own goroutine.
+type afpacketSource struct {
+	sockets []*afpacket.TPacket
+	iface   string
+	snapLen int
+}
+
+// newAFPacketSource opens the AF_PACKET sockets described by config on
+// device, which may be anyDevice.  Each device needs its own fanout group, so
+// index, the device's place in the -dev list, is added to the group ID.
+func newAFPacketSource(config *pdnsConfig, device string, index int) (captureSource, error) {
+	source := &afpacketSource{iface: device, snapLen: int(config.snapLen)}
+
+	fanoutID := uint16(config.afpacketFanoutID)
+	if fanoutID == 0 {
+		//another gopassivedns on the same host must not join our group
+		fanoutID = uint16(os.Getpid())
+	}
+	fanoutID += uint16(index)
+
+	opts := []interface{}{
+		afpacket.OptTPacketVersion(afpacket.TPacketVersion3),
+		afpacket.OptBlockSize(config.afpacketBlockSize),
+		afpacket.OptNumBlocks(config.afpacketBlocks),
+	}
+	if device != anyDevice {
+		opts = append(opts, afpacket.OptInterface(device))
+	}
+
+	for i := 0; i < config.afpacketSockets; i++ {
+		socket, err := afpacket.NewTPacket(opts...)
+		if err != nil {
+			source.Close()
+			return nil, fmt.Errorf("unable to open AF_PACKET socket on %s: %s", device, err)
+		}
+		source.sockets = append(source.sockets, socket)
+
+		if config.afpacketSockets > 1 {
+			//hashing keeps both directions of a flow on one socket, and defrag
+			//keeps the fragments of a packet together
+			if err := socket.SetFanout(afpacket.FanoutHashWithDefrag, fanoutID); err != nil {
+				source.Close()
+				return nil, fmt.Errorf("unable to join AF_PACKET fanout group %d: %s", fanoutID, err)
+			}
+		}
+	}
+
+	return source, nil
+}
+
+func (a *afpacketSource) PacketSources() []ifaceSource {
+	var packetSources []ifaceSource
+	for _, socket := range a.sockets {
+		packetSource := newIfaceSource(socket, layers.LinkTypeEthernet, a.iface)
+		//the kernel reports the interface of each packet
+		packetSource.byIndex = a.iface == anyDevice
+		packetSources = append(packetSources, packetSource)
+	}
+	return packetSources
+}
+
+// SetBPFFilter compiles expr with libpcap and attaches it to every socket
+func (a *afpacketSource) SetBPFFilter(expr string) error {
+	filter, err := compileBPFFilter(expr, a.snapLen)
+	if err != nil {
+		return err
+	}
+	for _, socket := range a.sockets {
+		if err := socket.SetBPF(filter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CaptureStats sums the ring stats of the sockets, a packet is dropped when
+// the ring it is hashed to is full
+func (a *afpacketSource) CaptureStats() (captureStats, error) {
+	var total captureStats
+	for _, socket := range a.sockets {
+		_, socketStats, err := socket.SocketStats()
+		if err != nil {
+			return captureStats{}, err
+		}
+		total.received += int64(socketStats.Packets())
+		total.dropped += int64(socketStats.Drops())
+	}
+	return total, nil
+}
+
+func (a *afpacketSource) Close() {
+	for _, socket := range a.sockets {
+		socket.Close()
+	}
+}
+
+// ancillaryVLAN returns the VLAN ID the kernel stripped from a packet an
+// AF_PACKET socket captured, which gopacket passes in its capture info
+func ancillaryVLAN(ci gopacket.CaptureInfo) (uint16, bool) {
+	for _, data := range ci.AncillaryData {
+		if vlan, ok := data.(afpacket.AncillaryVLAN); ok {
+			return uint16(vlan.VLAN), true
+		}
+	}
+	return 0, false
+}
+
+// compileBPFFilter compiles a tcpdump style filter expression into the
+// instructions the kernel attaches to a socket
+func compileBPFFilter(expr string, snapLen int) ([]bpf.RawInstruction, error) {
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snapLen, expr)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := make([]bpf.RawInstruction, len(instructions))
+	for i, instruction := range instructions {
+		filter[i] = bpf.RawInstruction{
+			Op: instruction.Code,
+			Jt: instruction.Jt,
+			Jf: instruction.Jf,
+			K:  instruction.K,
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+)
+
+func TestCompileBPFFilter(t *testing.T) {
+	filter, err := compileBPFFilter("udp port 53", 65536)
+	if err != nil {
+		t.Fatalf("compileBPFFilter failed on a valid filter: %s", err)
+	}
+	if len(filter) == 0 {
+		t.Fatal("compileBPFFilter returned no instructions")
+	}
+	//every filter ends by returning how much of the packet to keep
+	if last := filter[len(filter)-1]; last.Op&0x07 != 0x06 {
+		t.Fatalf("Bad last instruction %+v, expecting a return", last)
+	}
+
+	if _, err := compileBPFFilter("asdf", 65536); err == nil {
+		t.Fatal("compileBPFFilter did not fail with an invalid BPF filter")
+	}
+}
+
+func TestAncillaryVLAN(t *testing.T) {
+	if _, found := ancillaryVLAN(gopacket.CaptureInfo{}); found {
+		t.Fatal("Found a VLAN without ancillary data")
+	}
+
+	ci := gopacket.CaptureInfo{AncillaryData: []interface{}{afpacket.AncillaryVLAN{VLAN: 100}}}
+	if vlan, found := ancillaryVLAN(ci); !found || vlan != 100 {
+		t.Fatalf("Bad VLAN %d (%t), expecting 100", vlan, found)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+
+	"github.com/google/gopacket"
+)
+
+// newAFPacketSource fails, AF_PACKET sockets only exist on Linux
+func newAFPacketSource(config *pdnsConfig, device string, index int) (captureSource, error) {
+	return nil, errors.New("afpacket capture is only supported on Linux")
+}
+
+// ancillaryVLAN finds no VLAN ID, only AF_PACKET sockets strip the tags
+func ancillaryVLAN(ci gopacket.CaptureInfo) (uint16, bool) {
+	return 0, false
+}
@@ -0,0 +1,82 @@
+//go:build pfring
+// +build pfring
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pfring"
+)
+
+// pfringClusterTypes are the pfring balancing types for each pfringClusterType
+var pfringClusterTypes = map[pfringClusterType]pfring.ClusterType{
+	pfringClusterPerFlow:          pfring.ClusterPerFlow,
+	pfringClusterRoundRobin:       pfring.ClusterRoundRobin,
+	pfringClusterPerFlow2Tuple:    pfring.ClusterPerFlow2Tuple,
+	pfringClusterPerFlow4Tuple:    pfring.ClusterPerFlow4Tuple,
+	pfringClusterPerFlow5Tuple:    pfring.ClusterPerFlow5Tuple,
+	pfringClusterPerFlowTCP5Tuple: pfring.ClusterPerFlowTCP5Tuple,
+}
+
+// pfringSource captures from a PF_RING ring, optionally as part of a cluster
+// shared with other processes
+type pfringSource struct {
+	ring  *pfring.Ring
+	iface string
+}
+
+// newPFRingSource opens and enables a ring on device, set up as config describes
+func newPFRingSource(config *pdnsConfig, device string) (captureSource, error) {
+	clusterType, err := parsePFRingClusterType(config.pfringClusterType)
+	if err != nil {
+		return nil, err
+	}
+
+	ring, err := pfring.NewRing(device, uint32(config.snapLen), pfring.FlagPromisc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open PF_RING on %s: %s", device, err)
+	}
+	source := &pfringSource{ring: ring, iface: device}
+
+	if config.pfringClusterID != 0 {
+		if err := ring.SetCluster(config.pfringClusterID, pfringClusterTypes[clusterType]); err != nil {
+			source.Close()
+			return nil, fmt.Errorf("unable to join PF_RING cluster %d: %s", config.pfringClusterID, err)
+		}
+	}
+	if err := ring.SetSocketMode(pfring.ReadOnly); err != nil {
+		source.Close()
+		return nil, err
+	}
+	if err := ring.Enable(); err != nil {
+		source.Close()
+		return nil, err
+	}
+
+	return source, nil
+}
+
+func (p *pfringSource) PacketSources() []ifaceSource {
+	return []ifaceSource{newIfaceSource(p.ring, layers.LinkTypeEthernet, p.iface)}
+}
+
+func (p *pfringSource) SetBPFFilter(expr string) error {
+	return p.ring.SetBPFFilter(expr)
+}
+
+func (p *pfringSource) CaptureStats() (captureStats, error) {
+	ringStats, err := p.ring.Stats()
+	if err != nil {
+		return captureStats{}, err
+	}
+	return captureStats{
+		received: int64(ringStats.Received),
+		dropped:  int64(ringStats.Dropped),
+	}, nil
+}
+
+func (p *pfringSource) Close() {
+	p.ring.Close()
+}
@@ -0,0 +1,12 @@
+//go:build !pfring
+// +build !pfring
+
+package main
+
+import "errors"
+
+// newPFRingSource fails, PF_RING needs its C library so it is left out of
+// default builds
+func newPFRingSource(config *pdnsConfig, device string) (captureSource, error) {
+	return nil, errors.New("this gopassivedns was built without PF_RING support, rebuild it with -tags pfring")
+}
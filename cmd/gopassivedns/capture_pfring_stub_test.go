@@ -0,0 +1,17 @@
+//go:build !pfring
+// +build !pfring
+
+package main
+
+import (
+	"testing"
+)
+
+func TestInitHandlePFRingUnavailable(t *testing.T) {
+	//without PF_RING built in, asking for it must fail rather than fall back to another capture
+	handle := initHandle(&pdnsConfig{device: "eth0", pcapFile: "data/a.pcap", bpf: "port 53", pfring: true})
+	if handle != nil {
+		handle.Close()
+		t.Fatal("initHandle did not fail asking for PF_RING in a build without it")
+	}
+}
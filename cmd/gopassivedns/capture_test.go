@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseDevices(t *testing.T) {
+	for value, want := range map[string][]string{
+		"":                nil,
+		"eth0":            {"eth0"},
+		"eth0,eth1":       {"eth0", "eth1"},
+		" eth0 , eth1 ,,": {"eth0", "eth1"},
+		"any":             {"any"},
+	} {
+		if got := parseDevices(value); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Bad devices %v for %q, expecting %v", got, value, want)
+		}
+	}
+}
+
+// statsSource is a capture source that reports each of its stats in turn
+type statsSource struct {
+	reports []captureStats
+}
+
+func (s *statsSource) PacketSources() []ifaceSource   { return nil }
+func (s *statsSource) SetBPFFilter(expr string) error { return nil }
+func (s *statsSource) Close()                         {}
+
+func (s *statsSource) CaptureStats() (captureStats, error) {
+	report := s.reports[0]
+	s.reports = s.reports[1:]
+	return report, nil
+}
+
+func TestCaptureStatsDelta(t *testing.T) {
+	source := &statsSource{reports: []captureStats{
+		{received: 4294967000, dropped: 10, ifDropped: 2},
+		//the 32-bit received counter wraps
+		{received: 100, dropped: 15, ifDropped: 2},
+		{received: 300, dropped: 20, ifDropped: 3},
+		//the source is replaced and starts counting again
+		{received: 50, dropped: 1, ifDropped: 0},
+		{received: 80, dropped: 4, ifDropped: 1},
+	}}
+
+	//the prometheus counters panic if they are given a negative count
+	prom := newPromMetrics()
+	var total, last captureStats
+	for len(source.reports) > 0 {
+		cur, _ := source.CaptureStats()
+		delta := captureStatsDelta(cur, last)
+		prom.Incr("packets_received", delta.received)
+		prom.Incr("packets_dropped", delta.dropped)
+		prom.Incr("packets_ifdropped", delta.ifDropped)
+
+		total.received += delta.received
+		total.dropped += delta.dropped
+		total.ifDropped += delta.ifDropped
+		last = cur
+	}
+
+	want := captureStats{received: 4294967000 + 200 + 30, dropped: 10 + 5 + 5 + 3, ifDropped: 2 + 1 + 1}
+	if total != want {
+		t.Fatalf("Bad capture stats %+v, expecting %+v", total, want)
+	}
+}
+
+func TestIfaceNames(t *testing.T) {
+	ifaces := ifaceNames{}
+
+	interfaces, err := net.Interfaces()
+	if err != nil || len(interfaces) == 0 {
+		t.Skip("No interfaces to look up")
+	}
+	if name := ifaces.name(interfaces[0].Index); name != interfaces[0].Name {
+		t.Fatalf("Bad name %s for interface %d, expecting %s", name, interfaces[0].Index, interfaces[0].Name)
+	}
+
+	//an interface that has gone is logged by its index
+	missing := 1 << 30
+	if name := ifaces.name(missing); name != strconv.Itoa(missing) {
+		t.Fatalf("Bad name %s for a missing interface, expecting %d", name, missing)
+	}
+}
+
+func TestDispatchSLL2Interface(t *testing.T) {
+	//the cname lookup captured by libpcap from the any device on interface 2
+	source := getHandle("cname_sll2").PacketSources()[0]
+	source.iface = anyDevice
+
+	packetChan := make(chan *packetData, 10)
+	dispatchPackets(source, []chan *packetData{packetChan}, dispatchOptions{}, stats, make(chan struct{}))
+	close(packetChan)
+	if len(packetChan) != 2 {
+		t.Fatalf("Expecting the query and response, got %d packets", len(packetChan))
+	}
+
+	want := ifaceNames{}.name(2)
+	for pd := range packetChan {
+		if pd.ingress.iface != want {
+			t.Fatalf("Bad interface %s, expecting %s", pd.ingress.iface, want)
+		}
+	}
+}
+
+func TestDispatchTunnelled(t *testing.T) {
+	//the cname lookup in a VXLAN tunnel, both legs go to the thread of the inner flow
+	channels := make([]chan *packetData, 64)
+	for i := range channels {
+		channels[i] = make(chan *packetData, 10)
+	}
+	dispatchPackets(getHandle("cname_vxlan").PacketSources()[0], channels, dispatchOptions{decapsulate: true}, stats, make(chan struct{}))
+
+	for i, channel := range channels {
+		close(channel)
+		for pd := range channel {
+			if err := pd.Parse(); err != nil {
+				t.Fatal(err)
+			}
+			if want := workerFor(flowHash(pd.IPv6Layer.NetworkFlow(), pd.udpLayer.TransportFlow()), len(channels)); i != want {
+				t.Fatalf("Tunnelled packet dispatched to thread %d, expecting %d", i, want)
+			}
+			if pd.ingress.tunnel == nil {
+				t.Fatal("Tunnelled packet was not decapsulated")
+			}
+		}
+	}
+}
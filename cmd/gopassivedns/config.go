@@ -2,72 +2,165 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
+// defaultBPF is the -bpf filter if none is given.  libpcap only matches ports
+// in the first fragment of a datagram, so it drops the rest of the fragments.
+const defaultBPF string = "port 53"
+
 // codebeat:disable[TOO_MANY_IVARS]
 type pdnsConfig struct {
 	device   string
 	pcapFile string
+	dnstap   string
 	bpf      string
 
-	sensorName string
-	debug      bool
-	cpuprofile string
-	quiet      bool
-	gcAge      string
-	gcInterval string
-	numprocs   int
-	pfring     bool
-
-	kafkaBrokers   string
-	kafkaTopic     string
-	logFile        string
-	logMaxAge      int
-	logMaxSize     int
-	logMaxBackups  int
-	statsdHost     string
-	statsdInterval int
-	statsdPrefix   string
-	syslogFacility string
-	syslogPriority string
-	fluentdSocket  string
-	snapLen        int32
+	sensorName            string
+	debug                 bool
+	cpuprofile            string
+	quiet                 bool
+	gcAge                 string
+	gcInterval            string
+	logUnanswered         bool
+	logSections           string
+	logRData              bool
+	timestampFormat       string
+	logMismatches         bool
+	conntableMaxEntries   int
+	conntableMaxMemory    int
+	conntableMaxPerClient int
+	numprocs              int
+	pfring                bool
+	pfringClusterID       int
+	pfringClusterType     string
+	afpacket              bool
+	afpacketBlockSize     int
+	afpacketBlocks        int
+	afpacketSockets       int
+	afpacketFanoutID      int
+	decapsulate           bool
+	defragTimeout         int
+	defragMaxMemory       int
+
+	kafkaBrokers      string
+	kafkaTopic        string
+	kafkaAcks         string
+	kafkaCompression  string
+	kafkaPartitionKey string
+	kafkaRetries      int
+	kafkaBatchSize    int
+	logFile           string
+	logMaxAge         int
+	logMaxSize        int
+	logMaxBackups     int
+	statsdHost        string
+	statsdInterval    int
+	statsdPrefix      string
+	prometheusListen  string
+	syslogFacility    string
+	syslogPriority    string
+	fluentdSocket     string
+	snapLen           int32
 }
 
 func initConfig() *pdnsConfig {
-	config := pdnsConfig{}
-
-	var dev = flag.String("dev", getEnvStr("PDNS_DEV", ""), "Capture Device")
-	var kafkaBrokers = flag.String("kafka_brokers", getEnvStr("PDNS_KAFKA_PEERS", ""), "The Kafka brokers to connect to, as a comma separated list")
-	var kafkaTopic = flag.String("kafka_topic", getEnvStr("PDNS_KAFKA_TOPIC", ""), "Kafka topic for output")
-	var bpf = flag.String("bpf", getEnvStr("PDNS_BPF", "port 53"), "BPF Filter") //default port 53
-	var pcapFile = flag.String("pcap", getEnvStr("PDNS_PCAP_FILE", ""), "pcap file")
-	var logFile = flag.String("logfile", getEnvStr("PDNS_LOG_FILE", ""), "log file (recommended for debug only")
-	var logMaxAge = flag.Int("logMaxAge", getEnvInt("PDNS_LOG_AGE", 28), "max age of a log file before rotation, in days")    //8
-	var logMaxBackups = flag.Int("logMaxBackups", getEnvInt("PDNS_LOG_BACKUP", 3), "max number of files kept after rotation") //8
-	var logMaxSize = flag.Int("logMaxSize", getEnvInt("PDNS_LOG_SIZE", 100), "max size of log file before rotation, in MB")   //8
-	var quiet = flag.Bool("quiet", getEnvBool("PDNS_QUIET", false), "do not log to stdout")
-	var gcAge = flag.String("gc_age", getEnvStr("PDNS_GC_AGE", "-1m"), "How old a connection table entry should be before it is garbage collected.") //-1m
-	var gcInterval = flag.String("gc_interval", getEnvStr("PDNS_GC_INTERVAL", "3m"), "How often to run garbage collection.")                         //3m
-	var debug = flag.Bool("debug", getEnvBool("PDNS_DEBUG", false), "Enable debug logging")
-	var cpuprofile = flag.String("cpuprofile", getEnvStr("PDNS_PROFILE_FILE", ""), "write cpu profile to file") //""
-	var numprocs = flag.Int("numprocs", getEnvInt("PDNS_THREADS", 8), "number of packet processing threads")    //8
-	var pfring = flag.Bool("pfring", getEnvBool("PDNS_PFRING", false), "Capture using PF_RING")
-	var sensorName = flag.String("name", getEnvStr("PDNS_NAME", ""), "sensor name used in logging and stats reporting")
-	var statsdHost = flag.String("statsd_host", getEnvStr("PDNS_STATSD_HOST", ""), "Statsd server hostname or IP")
-	var statsdInterval = flag.Int("statsd_interval", getEnvInt("PDNS_STATSD_INTERVAL", 5), "Seconds between metric flush")   //3
-	var statsdPrefix = flag.String("statsd_prefix", getEnvStr("PDNS_STATSD_PREFIX", "gopassivedns"), "statsd metric prefix") //gopassivedns
-	var syslogFacility = flag.String("syslog_facility", getEnvStr("PDNS_SYSLOG_FACILITY", ""), "syslog facility")            //gopassivedns
-	var syslogPriority = flag.String("syslog_priority", getEnvStr("PDNS_SYSLOG_PRIORITY", ""), "syslog priority")            //gopassivedns
-	var configFile = flag.String("config", getEnvStr("PDNS_CONFIG", ""), "config file")
-	var fluentdSocket = flag.String("fluentd_socket", getEnvStr("PDNS_FLUENTD_SOCKET", ""), "Path to Fluentd unix socket")
-	var snapLen = flag.Int("snaplen", getEnvInt("PDNS_SNAPLEN", 4096), "The snaplen used in the pcap handle")
-
-	flag.Parse()
+	config, err := parseConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	for _, warning := range configWarnings(config) {
+		log.Warnf("gopassivedns: %s", warning)
+	}
+
+	return config
+}
+
+// configWarnings returns the problems with a valid configuration which
+// probably isn't what was meant
+func configWarnings(config *pdnsConfig) []string {
+	var warnings []string
+	if config.defragMaxMemory > 0 && config.bpf == defaultBPF && (config.device != "" || config.pcapFile != "") {
+		warnings = append(warnings, fmt.Sprintf("the BPF filter %q only lets through the first fragment of a datagram, so fragments can't be reassembled. "+
+			"Use e.g. -bpf \"port 53 or ip[6:2] & 0x1fff != 0 or ip6[6] == 44\" to capture the rest, or -defrag_max_memory 0 to not reassemble them.", defaultBPF))
+	}
+	return warnings
+}
+
+// parseConfig defines the flags on fs, parses args against them and then applies
+// the config file, if any. It is also used to re-read the configuration on SIGHUP.
+func parseConfig(fs *flag.FlagSet, args []string) (*pdnsConfig, error) {
+	var dev = fs.String("dev", getEnvStr("PDNS_DEV", ""), "Capture Device")
+	var kafkaBrokers = fs.String("kafka_brokers", getEnvStr("PDNS_KAFKA_PEERS", ""), "The Kafka brokers to connect to, as a comma separated list")
+	var kafkaTopic = fs.String("kafka_topic", getEnvStr("PDNS_KAFKA_TOPIC", ""), "Kafka topic for output")
+	var kafkaAcks = fs.String("kafka_acks", getEnvStr("PDNS_KAFKA_ACKS", "local"), "Kafka acknowledgements required per batch: none, local or all")
+	var kafkaCompression = fs.String("kafka_compression", getEnvStr("PDNS_KAFKA_COMPRESSION", "none"), "Kafka compression codec: none, gzip, snappy, lz4 or zstd")
+	var kafkaPartitionKey = fs.String("kafka_partition_key", getEnvStr("PDNS_KAFKA_PARTITION_KEY", ""), "Kafka partition key: client, sensor or empty for random partitioning")
+	var kafkaRetries = fs.Int("kafka_retries", getEnvInt("PDNS_KAFKA_RETRIES", 5), "number of times to retry a failed Kafka delivery")
+	var kafkaBatchSize = fs.Int("kafka_batch_size", getEnvInt("PDNS_KAFKA_BATCH_SIZE", 100), "number of log entries to batch per Kafka request")
+	var bpf = fs.String("bpf", getEnvStr("PDNS_BPF", defaultBPF), "BPF Filter")
+	var pcapFile = fs.String("pcap", getEnvStr("PDNS_PCAP_FILE", ""), "pcap file")
+	var dnstapAddress = fs.String("dnstap", getEnvStr("PDNS_DNSTAP", ""), "accept dnstap from DNS servers on unix:/path or tcp:host:port")
+	var logFile = fs.String("logfile", getEnvStr("PDNS_LOG_FILE", ""), "log file (recommended for debug only")
+	var logMaxAge = fs.Int("logMaxAge", getEnvInt("PDNS_LOG_AGE", 28), "max age of a log file before rotation, in days")    //8
+	var logMaxBackups = fs.Int("logMaxBackups", getEnvInt("PDNS_LOG_BACKUP", 3), "max number of files kept after rotation") //8
+	var logMaxSize = fs.Int("logMaxSize", getEnvInt("PDNS_LOG_SIZE", 100), "max size of log file before rotation, in MB")   //8
+	var quiet = fs.Bool("quiet", getEnvBool("PDNS_QUIET", false), "do not log to stdout")
+	var gcAge = fs.String("gc_age", getEnvStr("PDNS_GC_AGE", "-1m"), "How old a connection table entry should be before it is garbage collected.") //-1m
+	var gcInterval = fs.String("gc_interval", getEnvStr("PDNS_GC_INTERVAL", "3m"), "How often to run garbage collection.")                         //3m
+	var logUnanswered = fs.Bool("log_unanswered", getEnvBool("PDNS_LOG_UNANSWERED", false), "log queries removed by garbage collection or evicted without an answer as NOANSWER")
+	var logSections = fs.String("log_sections", getEnvStr("PDNS_LOG_SECTIONS", "answer"), "comma separated response sections to log: answer, authority, additional")
+	var logRData = fs.Bool("log_rdata", getEnvBool("PDNS_LOG_RDATA", false), "add a structured rdata object to each log entry")
+	var logMismatches = fs.Bool("log_mismatches", getEnvBool("PDNS_LOG_MISMATCHES", false), "log queries whose response has a different question as MISMATCH")
+	var conntableMaxEntries = fs.Int("conntable_max_entries", getEnvInt("PDNS_CONNTABLE_MAX_ENTRIES", defaultConntableSize), "most lookups waiting for their other leg before the oldest are evicted, 0 for the default")
+	var conntableMaxMemory = fs.Int("conntable_max_memory", getEnvInt("PDNS_CONNTABLE_MAX_MEMORY", 0), "estimated memory, in MB, the waiting lookups may use before the oldest are evicted, 0 for no limit")
+	var conntableMaxPerClient = fs.Int("conntable_max_per_client", getEnvInt("PDNS_CONNTABLE_MAX_PER_CLIENT", 0), "most lookups one client may have waiting, further queries are dropped, 0 for no limit")
+	var timestampFormat = fs.String("timestamp_format", getEnvStr("PDNS_TIMESTAMP_FORMAT", "rfc3339"), "format of the capture time in tstamp: rfc3339 or epoch")
+	var debug = fs.Bool("debug", getEnvBool("PDNS_DEBUG", false), "Enable debug logging")
+	var cpuprofile = fs.String("cpuprofile", getEnvStr("PDNS_PROFILE_FILE", ""), "write cpu profile to file") //""
+	var numprocs = numprocsValue(getEnvNumprocs("PDNS_THREADS", 8))
+	fs.Var(&numprocs, "numprocs", "number of packet processing threads, or auto for one per CPU") //8
+	var pfring = fs.Bool("pfring", getEnvBool("PDNS_PFRING", false), "Capture using PF_RING, needs a build with -tags pfring")
+	var pfringClusterID = fs.Int("pfring_cluster_id", getEnvInt("PDNS_PFRING_CLUSTER_ID", 0), "PF_RING cluster to join, 0 for none")
+	var pfringClusterType = fs.String("pfring_cluster_type", getEnvStr("PDNS_PFRING_CLUSTER_TYPE", "flow"), "how the PF_RING cluster balances packets: flow, round_robin, 2_tuple, 4_tuple, 5_tuple or tcp_5_tuple")
+	var afpacket = fs.Bool("afpacket", getEnvBool("PDNS_AFPACKET", false), "Capture using AF_PACKET TPACKET_V3 rings, Linux only")
+	var afpacketBlockSize = fs.Int("afpacket_block_size", getEnvInt("PDNS_AFPACKET_BLOCK_SIZE", 1<<20), "size in bytes of each AF_PACKET ring block, a multiple of the page size")
+	var afpacketBlocks = fs.Int("afpacket_blocks", getEnvInt("PDNS_AFPACKET_BLOCKS", 64), "number of blocks in each AF_PACKET ring")
+	var afpacketSockets = fs.Int("afpacket_sockets", getEnvInt("PDNS_AFPACKET_SOCKETS", 1), "number of AF_PACKET sockets, more than one are joined in a fanout group")
+	var afpacketFanoutID = fs.Int("afpacket_fanout_id", getEnvInt("PDNS_AFPACKET_FANOUT_ID", 0), "AF_PACKET fanout group ID, 0 for one based on the process ID")
+	var defragTimeout = fs.Int("defrag_timeout", getEnvInt("PDNS_DEFRAG_TIMEOUT", 30), "seconds to wait for the rest of a fragmented datagram")
+	var defragMaxMemory = fs.Int("defrag_max_memory", getEnvInt("PDNS_DEFRAG_MAX_MEMORY", 16), "MB of fragments each capture reader may hold before the oldest datagrams are abandoned, 0 to not reassemble fragments")
+	var decapsulate = fs.Bool("decapsulate", getEnvBool("PDNS_DECAPSULATE", false), "log the DNS inside GRE, ERSPAN, VXLAN and GENEVE tunnels")
+	var sensorName = fs.String("name", getEnvStr("PDNS_NAME", ""), "sensor name used in logging and stats reporting")
+	var statsdHost = fs.String("statsd_host", getEnvStr("PDNS_STATSD_HOST", ""), "Statsd server hostname or IP")
+	var statsdInterval = fs.Int("statsd_interval", getEnvInt("PDNS_STATSD_INTERVAL", 5), "Seconds between metric flush")   //3
+	var statsdPrefix = fs.String("statsd_prefix", getEnvStr("PDNS_STATSD_PREFIX", "gopassivedns"), "statsd metric prefix") //gopassivedns
+	var prometheusListen = fs.String("prometheus_listen", getEnvStr("PDNS_PROMETHEUS_LISTEN", ""), "address to serve Prometheus metrics on, e.g. :9153")
+	var syslogFacility = fs.String("syslog_facility", getEnvStr("PDNS_SYSLOG_FACILITY", ""), "syslog facility") //gopassivedns
+	var syslogPriority = fs.String("syslog_priority", getEnvStr("PDNS_SYSLOG_PRIORITY", ""), "syslog priority") //gopassivedns
+	var configFile = fs.String("config", getEnvStr("PDNS_CONFIG", ""), "config file")
+	var fluentdSocket = fs.String("fluentd_socket", getEnvStr("PDNS_FLUENTD_SOCKET", ""), "Path to Fluentd unix socket")
+	var snapLen = fs.Int("snaplen", getEnvInt("PDNS_SNAPLEN", 4096), "The snaplen used in the pcap handle")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	//values from a config file only apply to flags not given on the command line
+	if *configFile != "" {
+		if err := loadConfigFile(fs, *configFile); err != nil {
+			return nil, fmt.Errorf("unable to load config file %s: %s", *configFile, err)
+		}
+	}
 
 	if *sensorName == "" {
 		hostname, err := os.Hostname()
@@ -79,43 +172,207 @@ func initConfig() *pdnsConfig {
 	}
 
 	//pack it all into that struct
+	config := pdnsConfig{
+		device:   *dev,
+		pcapFile: *pcapFile,
+		dnstap:   *dnstapAddress,
+		bpf:      *bpf,
 
-	//if we get a config file, ignore everything else and load it
-	if *configFile != "" {
-		//load file
-	} else {
-		//pack the vars into the config struct
-		config = pdnsConfig{
-			device:   *dev,
-			pcapFile: *pcapFile,
-			bpf:      *bpf,
-
-			sensorName: *sensorName,
-			debug:      *debug,
-			cpuprofile: *cpuprofile,
-			quiet:      *quiet,
-			gcAge:      *gcAge,
-			gcInterval: *gcInterval,
-			numprocs:   *numprocs,
-			pfring:     *pfring,
-
-			kafkaBrokers:   *kafkaBrokers,
-			kafkaTopic:     *kafkaTopic,
-			logFile:        *logFile,
-			logMaxAge:      *logMaxAge,
-			logMaxSize:     *logMaxSize,
-			logMaxBackups:  *logMaxBackups,
-			statsdHost:     *statsdHost,
-			statsdInterval: *statsdInterval,
-			statsdPrefix:   *statsdPrefix,
-			syslogFacility: *syslogFacility,
-			syslogPriority: *syslogPriority,
-			fluentdSocket:  *fluentdSocket,
-			snapLen:        int32(*snapLen),
-		}
-	}
-
-	return &config
+		sensorName:            *sensorName,
+		debug:                 *debug,
+		cpuprofile:            *cpuprofile,
+		quiet:                 *quiet,
+		gcAge:                 *gcAge,
+		gcInterval:            *gcInterval,
+		logUnanswered:         *logUnanswered,
+		logSections:           *logSections,
+		logRData:              *logRData,
+		timestampFormat:       *timestampFormat,
+		logMismatches:         *logMismatches,
+		conntableMaxEntries:   *conntableMaxEntries,
+		conntableMaxMemory:    *conntableMaxMemory,
+		conntableMaxPerClient: *conntableMaxPerClient,
+		numprocs:              int(numprocs),
+		pfring:                *pfring,
+		pfringClusterID:       *pfringClusterID,
+		pfringClusterType:     *pfringClusterType,
+		afpacket:              *afpacket,
+		afpacketBlockSize:     *afpacketBlockSize,
+		afpacketBlocks:        *afpacketBlocks,
+		afpacketSockets:       *afpacketSockets,
+		afpacketFanoutID:      *afpacketFanoutID,
+		decapsulate:           *decapsulate,
+		defragTimeout:         *defragTimeout,
+		defragMaxMemory:       *defragMaxMemory,
+
+		kafkaBrokers:      *kafkaBrokers,
+		kafkaTopic:        *kafkaTopic,
+		kafkaAcks:         *kafkaAcks,
+		kafkaCompression:  *kafkaCompression,
+		kafkaPartitionKey: *kafkaPartitionKey,
+		kafkaRetries:      *kafkaRetries,
+		kafkaBatchSize:    *kafkaBatchSize,
+		logFile:           *logFile,
+		logMaxAge:         *logMaxAge,
+		logMaxSize:        *logMaxSize,
+		logMaxBackups:     *logMaxBackups,
+		statsdHost:        *statsdHost,
+		statsdInterval:    *statsdInterval,
+		statsdPrefix:      *statsdPrefix,
+		prometheusListen:  *prometheusListen,
+		syslogFacility:    *syslogFacility,
+		syslogPriority:    *syslogPriority,
+		fluentdSocket:     *fluentdSocket,
+		snapLen:           int32(*snapLen),
+	}
+
+	if err := validateConfig(&config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// loadConfigFile reads a YAML config file whose keys are the command line flag
+// names, e.g. "gc_age: -1m" or "kafka_brokers: [broker1:9092, broker2:9092]".
+// Flags given on the command line take precedence over the file, and the file
+// takes precedence over the environment and the built-in defaults.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return err
+	}
+
+	cmdline := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		cmdline[f.Name] = true
+	})
+
+	for key, value := range values {
+		if key == "config" || fs.Lookup(key) == nil {
+			return fmt.Errorf("unknown key: %s", key)
+		}
+		if cmdline[key] {
+			log.Debugf("config file value for %s overridden on the command line", key)
+			continue
+		}
+
+		str, err := configValueString(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %s", key, err)
+		}
+		if err := fs.Set(key, str); err != nil {
+			return fmt.Errorf("invalid value %q for %s: %s", str, key, err)
+		}
+	}
+
+	return nil
+}
+
+// configValueString flattens a YAML scalar, or a list of scalars, into the
+// string form the flag parsers expect.
+func configValueString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string, bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			str, err := configValueString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, str)
+		}
+		return strings.Join(items, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported type %T", value)
+	}
+}
+
+// validateConfig catches bad values at startup rather than once capture is running.
+func validateConfig(config *pdnsConfig) error {
+	if _, err := time.ParseDuration(config.gcAge); err != nil {
+		return fmt.Errorf("gc_age %q is not a duration, use a string like '-1m'", config.gcAge)
+	}
+	if _, err := time.ParseDuration(config.gcInterval); err != nil {
+		return fmt.Errorf("gc_interval %q is not a duration, use a string like '3m'", config.gcInterval)
+	}
+	if _, err := parseLogSections(config.logSections); err != nil {
+		return fmt.Errorf("log_sections %q is not valid: %s", config.logSections, err)
+	}
+	if _, err := parseTimestampFormat(config.timestampFormat); err != nil {
+		return fmt.Errorf("timestamp_format %q is not valid: %s", config.timestampFormat, err)
+	}
+	if config.conntableMaxEntries < 0 || config.conntableMaxMemory < 0 || config.conntableMaxPerClient < 0 {
+		return fmt.Errorf("conntable_max_entries, conntable_max_memory and conntable_max_per_client can't be negative")
+	}
+	if config.defragMaxMemory < 0 {
+		return fmt.Errorf("defrag_max_memory can't be negative")
+	}
+	if config.defragMaxMemory > 0 && config.defragTimeout < 1 {
+		return fmt.Errorf("defrag_timeout must be at least 1 second, got %d", config.defragTimeout)
+	}
+	//a bad sink setting would only be found when the sink starts, and kill the daemon
+	if config.kafkaBrokers != "" && config.kafkaTopic != "" {
+		if _, err := kafkaAcksToType(config.kafkaAcks); err != nil {
+			return fmt.Errorf("kafka_acks %q is not valid, use none, local or all", config.kafkaAcks)
+		}
+		if _, err := kafkaCompressionToType(config.kafkaCompression); err != nil {
+			return fmt.Errorf("kafka_compression %q is not valid, use none, gzip, snappy, lz4 or zstd", config.kafkaCompression)
+		}
+		if _, err := kafkaPartitionKeyToType(config.kafkaPartitionKey); err != nil {
+			return fmt.Errorf("kafka_partition_key %q is not valid, use client, sensor or leave it empty", config.kafkaPartitionKey)
+		}
+	}
+	if config.syslogFacility != "" && config.syslogPriority != "" {
+		if _, err := facilityToType(config.syslogFacility); err != nil {
+			return fmt.Errorf("syslog_facility %q is not a syslog facility", config.syslogFacility)
+		}
+		if _, err := levelToType(config.syslogPriority); err != nil {
+			return fmt.Errorf("syslog_priority %q is not a syslog priority", config.syslogPriority)
+		}
+	}
+	if config.dnstap != "" {
+		if _, _, err := parseDnstapAddress(config.dnstap); err != nil {
+			return fmt.Errorf("dnstap %q is not valid: %s", config.dnstap, err)
+		}
+	}
+	if config.numprocs < 1 {
+		return fmt.Errorf("numprocs must be at least 1, got %d", config.numprocs)
+	}
+	if devices := parseDevices(config.device); len(devices) > 1 {
+		for _, device := range devices {
+			if device == anyDevice {
+				return fmt.Errorf("dev %q captures from any interface, it can't be combined with other devices", config.device)
+			}
+		}
+	}
+	if _, err := parsePFRingClusterType(config.pfringClusterType); err != nil {
+		return fmt.Errorf("pfring_cluster_type %q is not valid: %s", config.pfringClusterType, err)
+	}
+	if config.pfringClusterID < 0 {
+		return fmt.Errorf("pfring_cluster_id can't be negative")
+	}
+	if config.afpacket {
+		if config.afpacketBlockSize < 1 || config.afpacketBlockSize%os.Getpagesize() != 0 {
+			return fmt.Errorf("afpacket_block_size must be a multiple of the page size, %d, got %d", os.Getpagesize(), config.afpacketBlockSize)
+		}
+		if config.afpacketBlocks < 1 || config.afpacketSockets < 1 {
+			return fmt.Errorf("afpacket_blocks and afpacket_sockets must be at least 1")
+		}
+		if config.afpacketFanoutID < 0 || config.afpacketFanoutID > 0xffff {
+			return fmt.Errorf("afpacket_fanout_id must be between 0 and 65535, got %d", config.afpacketFanoutID)
+		}
+	}
+	return nil
 }
 
 func getEnvStr(name string, def string) string {
@@ -139,6 +396,48 @@ func getEnvBool(name string, def bool) bool {
 	return def
 }
 
+func getEnvNumprocs(name string, def int) int {
+	content, found := os.LookupEnv(name)
+	if found {
+		parsed, err := parseNumprocs(content)
+		if err == nil {
+			return parsed
+		}
+		log.Debugf("Could not parse the content of %s, %s, as a number of threads", name, content)
+		return def
+	}
+	return def
+}
+
+// parseNumprocs converts a number of packet processing threads, or "auto" for
+// one per CPU Go will use, into a count
+func parseNumprocs(numprocs string) (int, error) {
+	if strings.ToLower(strings.TrimSpace(numprocs)) == "auto" {
+		return runtime.GOMAXPROCS(0), nil
+	}
+	parsed, err := strconv.ParseInt(numprocs, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid numprocs: %s", numprocs)
+	}
+	return int(parsed), nil
+}
+
+// numprocsValue is the numprocs flag, which takes a number or "auto"
+type numprocsValue int
+
+func (n *numprocsValue) String() string {
+	return strconv.Itoa(int(*n))
+}
+
+func (n *numprocsValue) Set(value string) error {
+	parsed, err := parseNumprocs(value)
+	if err != nil {
+		return err
+	}
+	*n = numprocsValue(parsed)
+	return nil
+}
+
 func getEnvInt(name string, def int) int {
 	content, found := os.LookupEnv(name)
 	if found {
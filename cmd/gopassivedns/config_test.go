@@ -0,0 +1,235 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func newTestFlagSet() (*flag.FlagSet, *string, *string, *int, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	bpf := fs.String("bpf", "port 53", "")
+	gcAge := fs.String("gc_age", "-1m", "")
+	numprocs := fs.Int("numprocs", 8, "")
+	quiet := fs.Bool("quiet", false, "")
+	fs.String("kafka_brokers", "", "")
+	fs.String("config", "", "")
+	return fs, bpf, gcAge, numprocs, quiet
+}
+
+func writeTestConfig(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "gopassivedns-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeTestConfig(t, `
+bpf: udp port 53
+gc_age: -30s
+numprocs: 4
+quiet: true
+kafka_brokers:
+  - broker1:9092
+  - broker2:9092
+`)
+	defer os.Remove(path)
+
+	fs, bpf, gcAge, numprocs, quiet := newTestFlagSet()
+	fs.Parse([]string{"-bpf", "port 5353"})
+
+	if err := loadConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if *bpf != "port 5353" {
+		t.Fatalf("command line bpf was overridden by the config file, got %s", *bpf)
+	}
+
+	if *gcAge != "-30s" {
+		t.Fatalf("expected gc_age -30s, got %s", *gcAge)
+	}
+
+	if *numprocs != 4 {
+		t.Fatalf("expected numprocs 4, got %d", *numprocs)
+	}
+
+	if *quiet != true {
+		t.Fatal("expected quiet to be true")
+	}
+
+	if brokers := fs.Lookup("kafka_brokers").Value.String(); brokers != "broker1:9092,broker2:9092" {
+		t.Fatalf("expected a joined broker list, got %s", brokers)
+	}
+}
+
+func TestLoadConfigFileUnknownKey(t *testing.T) {
+	path := writeTestConfig(t, "bpf: port 53\nnot_a_flag: true\n")
+	defer os.Remove(path)
+
+	fs, _, _, _, _ := newTestFlagSet()
+	fs.Parse([]string{})
+
+	if err := loadConfigFile(fs, path); err == nil {
+		t.Fatal("loadConfigFile did not fail on an unknown key")
+	}
+}
+
+func TestLoadConfigFileBadValue(t *testing.T) {
+	path := writeTestConfig(t, "numprocs: lots\n")
+	defer os.Remove(path)
+
+	fs, _, _, _, _ := newTestFlagSet()
+	fs.Parse([]string{})
+
+	if err := loadConfigFile(fs, path); err == nil {
+		t.Fatal("loadConfigFile did not fail on a non-integer numprocs")
+	}
+}
+
+func TestLoadConfigFileMissing(t *testing.T) {
+	fs, _, _, _, _ := newTestFlagSet()
+	fs.Parse([]string{})
+
+	if err := loadConfigFile(fs, "data/doesnotexist.yaml"); err == nil {
+		t.Fatal("loadConfigFile did not fail on a missing file")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8}); err != nil {
+		t.Fatalf("valid config failed validation: %s", err)
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "a minute ago", gcInterval: "3m", numprocs: 8}); err == nil {
+		t.Fatal("validateConfig did not fail on an unparseable gc_age")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3", numprocs: 8}); err == nil {
+		t.Fatal("validateConfig did not fail on an unparseable gc_interval")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, conntableMaxPerClient: -1}); err == nil {
+		t.Fatal("validateConfig did not fail on a negative conntable_max_per_client")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, device: "eth0,any"}); err == nil {
+		t.Fatal("validateConfig did not fail on any with another device")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, pfringClusterType: "3_tuple"}); err == nil {
+		t.Fatal("validateConfig did not fail on an unknown pfring_cluster_type")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, defragMaxMemory: 16}); err == nil {
+		t.Fatal("validateConfig did not fail on reassembly without a defrag_timeout")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, defragMaxMemory: -1}); err == nil {
+		t.Fatal("validateConfig did not fail on a negative defrag_max_memory")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, dnstap: "tcp:127.0.0.1:6000"}); err != nil {
+		t.Fatalf("valid dnstap config failed validation: %s", err)
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, dnstap: "udp:127.0.0.1:6000"}); err == nil {
+		t.Fatal("validateConfig did not fail on a dnstap address that isn't unix or tcp")
+	}
+
+	kafka := pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, kafkaBrokers: "broker1:9092", kafkaTopic: "dns", kafkaAcks: "local", kafkaCompression: "none"}
+	syslog := pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, syslogFacility: "local0", syslogPriority: "info"}
+	for _, test := range []struct {
+		name   string
+		config pdnsConfig
+		edit   func(config *pdnsConfig)
+		valid  bool
+	}{
+		{"kafka", kafka, func(config *pdnsConfig) {}, true},
+		{"kafka_partition_key client", kafka, func(config *pdnsConfig) { config.kafkaPartitionKey = "client" }, true},
+		{"kafka_acks some", kafka, func(config *pdnsConfig) { config.kafkaAcks = "some" }, false},
+		{"kafka_compression brotli", kafka, func(config *pdnsConfig) { config.kafkaCompression = "brotli" }, false},
+		{"kafka_partition_key server", kafka, func(config *pdnsConfig) { config.kafkaPartitionKey = "server" }, false},
+		{"kafka_acks some without a topic", kafka, func(config *pdnsConfig) { config.kafkaAcks, config.kafkaTopic = "some", "" }, true},
+		{"syslog", syslog, func(config *pdnsConfig) {}, true},
+		{"syslog_facility local9", syslog, func(config *pdnsConfig) { config.syslogFacility = "local9" }, false},
+		{"syslog_priority loud", syslog, func(config *pdnsConfig) { config.syslogPriority = "loud" }, false},
+	} {
+		test.edit(&test.config)
+		if err := validateConfig(&test.config); (err == nil) != test.valid {
+			t.Fatalf("Bad validation of %s, expecting valid %t (%v)", test.name, test.valid, err)
+		}
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, afpacket: true, afpacketBlockSize: 1 << 20, afpacketBlocks: 64, afpacketSockets: 4}); err != nil {
+		t.Fatalf("valid afpacket config failed validation: %s", err)
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, afpacket: true, afpacketBlockSize: 1000, afpacketBlocks: 64, afpacketSockets: 4}); err == nil {
+		t.Fatal("validateConfig did not fail on an afpacket_block_size that isn't a multiple of the page size")
+	}
+
+	if err := validateConfig(&pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, afpacket: true, afpacketBlockSize: 1 << 20, afpacketBlocks: 64, afpacketSockets: 0}); err == nil {
+		t.Fatal("validateConfig did not fail on no afpacket_sockets")
+	}
+}
+
+func TestConfigWarnings(t *testing.T) {
+	for _, test := range []struct {
+		config   pdnsConfig
+		warnings int
+	}{
+		{pdnsConfig{device: "eth0", bpf: defaultBPF, defragMaxMemory: 16}, 1},
+		{pdnsConfig{pcapFile: "dns.pcap", bpf: defaultBPF, defragMaxMemory: 16}, 1},
+		{pdnsConfig{device: "eth0", bpf: defaultBPF}, 0},
+		{pdnsConfig{device: "eth0", bpf: "port 53 or ip[6:2] & 0x1fff != 0 or ip6[6] == 44", defragMaxMemory: 16}, 0},
+		{pdnsConfig{dnstap: "tcp:127.0.0.1:6000", bpf: defaultBPF, defragMaxMemory: 16}, 0},
+	} {
+		if warnings := configWarnings(&test.config); len(warnings) != test.warnings {
+			t.Fatalf("Bad warnings %v for %+v, expecting %d", warnings, test.config, test.warnings)
+		}
+	}
+}
+
+func TestParsePFRingClusterType(t *testing.T) {
+	for value, want := range map[string]pfringClusterType{"": pfringClusterPerFlow, "flow": pfringClusterPerFlow, "ROUND_ROBIN": pfringClusterRoundRobin, "2_tuple": pfringClusterPerFlow2Tuple, "tcp_5_tuple": pfringClusterPerFlowTCP5Tuple} {
+		got, err := parsePFRingClusterType(value)
+		if err != nil || got != want {
+			t.Fatalf("Bad cluster type %d for %s, expecting %d (%v)", got, value, want, err)
+		}
+	}
+
+	if _, err := parsePFRingClusterType("3_tuple"); err == nil {
+		t.Fatal("parsePFRingClusterType did not fail on 3_tuple")
+	}
+}
+
+func TestParseNumprocs(t *testing.T) {
+	for value, want := range map[string]int{"1": 1, "6": 6, "auto": runtime.GOMAXPROCS(0), "AUTO": runtime.GOMAXPROCS(0)} {
+		got, err := parseNumprocs(value)
+		if err != nil || got != want {
+			t.Fatalf("Bad numprocs %d for %s, expecting %d (%v)", got, value, want, err)
+		}
+	}
+
+	if _, err := parseNumprocs("lots"); err == nil {
+		t.Fatal("parseNumprocs did not fail on lots")
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config, err := parseConfig(fs, []string{"-numprocs", "auto"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.numprocs != runtime.GOMAXPROCS(0) {
+		t.Fatalf("Bad numprocs %d for auto, expecting %d", config.numprocs, runtime.GOMAXPROCS(0))
+	}
+}
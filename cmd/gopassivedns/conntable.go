@@ -0,0 +1,387 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	// conntableShards is the number of independently locked parts of the
+	// conntable, it must be a power of two
+	conntableShards int = 64
+	// defaultConntableSize is the most entries the conntable holds before the
+	// oldest are evicted
+	defaultConntableSize int = 1 << 20
+	// conntableEntryOverhead is roughly what the map, node and entry cost
+	// before the key and message are counted
+	conntableEntryOverhead = int64(unsafe.Sizeof(conntableNode{})) + 64
+)
+
+// the reasons entries are evicted, used to label the conntable_evictions metric
+const (
+	evictMaxEntries string = "max_entries"
+	evictMaxMemory  string = "max_memory"
+)
+
+// pairResult is what connectionTable.pair did with a leg of a lookup
+type pairResult uint8
+
+const (
+	legStored     pairResult = iota // the first leg seen, kept until the other one arrives
+	legPaired                       // the other leg was waiting and has been removed
+	legRepeated                     // the same leg was already waiting, e.g. a retransmitted query
+	legMismatched                   // the waiting leg has a different question section
+	legRejected                     // the client already has too many lookups waiting, so the leg wasn't kept
+)
+
+// conntableLimits bounds the size of the conntable. A zero maxEntries is
+// defaultConntableSize, a zero maxBytes or maxPerClient means no limit.
+type conntableLimits struct {
+	maxEntries   int
+	maxBytes     int64
+	maxPerClient int
+}
+
+// conntableEvictions counts the waiting legs removed to make room for a new
+// one, and holds them if the table keeps evicted entries
+type conntableEvictions struct {
+	maxEntries int
+	maxMemory  int
+	items      []DNSMapEntry
+}
+
+// connectionTable stores the leg of each lookup we are waiting to pair with
+// the other one. Keys are spread over shards so the GC and dnstap readers only
+// hold up the packet handler for part of the table, and each shard keeps its
+// entries oldest first so it can evict them when it is full.
+type connectionTable struct {
+	shards       []conntableShard
+	clients      []clientShard
+	maxPerClient int
+	keepEvicted  int32 // accessed atomically, non-zero if pair returns the entries it evicts
+}
+
+type conntableShard struct {
+	sync.Mutex
+	entries    map[string]*conntableNode
+	oldest     *conntableNode
+	newest     *conntableNode
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+}
+
+type conntableNode struct {
+	key    string
+	client string
+	size   int64
+	item   DNSMapEntry
+	older  *conntableNode
+	newer  *conntableNode
+}
+
+// clientShard counts the entries each client has in the conntable. The
+// clients are sharded separately from the entries, as one client's lookups
+// are spread over every conntable shard.
+type clientShard struct {
+	sync.Mutex
+	entries map[string]int
+}
+
+// newConnectionTable returns a conntable split into shards, which must be a
+// power of two, with limits shared evenly between them
+func newConnectionTable(shards int, limits conntableLimits) *connectionTable {
+	if limits.maxEntries == 0 {
+		limits.maxEntries = defaultConntableSize
+	}
+	perShard := limits.maxEntries / shards
+	if perShard < 1 {
+		perShard = 1
+	}
+
+	bytesPerShard := limits.maxBytes / int64(shards)
+	if limits.maxBytes > 0 && bytesPerShard < 1 {
+		bytesPerShard = 1
+	}
+
+	ct := &connectionTable{shards: make([]conntableShard, shards), maxPerClient: limits.maxPerClient}
+	for i := range ct.shards {
+		ct.shards[i].entries = make(map[string]*conntableNode)
+		ct.shards[i].maxEntries = perShard
+		ct.shards[i].maxBytes = bytesPerShard
+	}
+	if limits.maxPerClient > 0 {
+		ct.clients = make([]clientShard, shards)
+		for i := range ct.clients {
+			ct.clients[i].entries = make(map[string]int)
+		}
+	}
+	return ct
+}
+
+// connectionTables holds a conntable for each packet processing thread.  Both
+// legs of a lookup are dispatched to the same thread, so the threads don't
+// share entries or the locks guarding them.
+type connectionTables []*connectionTable
+
+// newConnectionTables returns tables conntables with limits shared evenly
+// between them.  Only the count of each client's entries is shared by all the
+// tables, as one client's lookups are spread over every thread.
+func newConnectionTables(tables int, limits conntableLimits) connectionTables {
+	perTable := limits
+	if perTable.maxEntries == 0 {
+		perTable.maxEntries = defaultConntableSize
+	}
+	perTable.maxEntries /= tables
+	if perTable.maxEntries < 1 {
+		perTable.maxEntries = 1
+	}
+	perTable.maxBytes /= int64(tables)
+	if limits.maxBytes > 0 && perTable.maxBytes < 1 {
+		perTable.maxBytes = 1
+	}
+
+	cts := make(connectionTables, tables)
+	for i := range cts {
+		cts[i] = newConnectionTable(conntableShards, perTable)
+		if i > 0 {
+			cts[i].clients = cts[0].clients
+		}
+	}
+	return cts
+}
+
+// forFlow returns the table of the packet processing thread handling a flow
+// with the given hash
+func (cts connectionTables) forFlow(hash uint64) *connectionTable {
+	return cts[workerFor(hash, len(cts))]
+}
+
+// setKeepEvicted sets whether every table keeps the entries it evicts
+func (cts connectionTables) setKeepEvicted(keep bool) {
+	for _, ct := range cts {
+		ct.setKeepEvicted(keep)
+	}
+}
+
+// collect removes and returns the entries inserted before cutoff from every table
+func (cts connectionTables) collect(cutoff time.Time) []DNSMapEntry {
+	var collected []DNSMapEntry
+	for _, ct := range cts {
+		collected = append(collected, ct.collect(cutoff)...)
+	}
+	return collected
+}
+
+// len returns the number of entries in all the tables
+func (cts connectionTables) len() int {
+	total := 0
+	for _, ct := range cts {
+		total += ct.len()
+	}
+	return total
+}
+
+// bytes returns the estimated memory used by the entries in all the tables
+func (cts connectionTables) bytes() int64 {
+	var total int64
+	for _, ct := range cts {
+		total += ct.bytes()
+	}
+	return total
+}
+
+// fnv32 hashes s with FNV-1a, without allocating
+func fnv32(s string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		hash ^= uint32(s[i])
+		hash *= 16777619
+	}
+	return hash
+}
+
+// shard returns the shard key is stored in
+func (ct *connectionTable) shard(key string) *conntableShard {
+	return &ct.shards[fnv32(key)&uint32(len(ct.shards)-1)]
+}
+
+// pair looks for the other leg of a lookup and removes it from the table, or
+// stores leg if it is the first one seen.  This happens under one lock so two
+// answers can't both claim the same query.  It returns the waiting leg, if
+// there was one, and the entries evicted to make room for leg.
+func (ct *connectionTable) pair(key string, leg DNSMapEntry) (DNSMapEntry, pairResult, conntableEvictions) {
+	var evicted conntableEvictions
+
+	shard := ct.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+
+	if node, found := shard.entries[key]; found {
+		switch {
+		case node.item.entry.QR == leg.entry.QR:
+			return node.item, legRepeated, evicted
+		case !questionsMatch(&node.item.entry, &leg.entry):
+			return node.item, legMismatched, evicted
+		}
+		ct.remove(shard, node)
+		return node.item, legPaired, evicted
+	}
+
+	node := &conntableNode{key: key, item: leg, size: conntableEntrySize(key, &leg)}
+	if ct.maxPerClient > 0 {
+		node.client = string(leg.client().To16())
+		if !ct.addClient(node.client) {
+			return DNSMapEntry{}, legRejected, evicted
+		}
+	}
+
+	keep := atomic.LoadInt32(&ct.keepEvicted) != 0
+	for len(shard.entries) >= shard.maxEntries {
+		if keep {
+			evicted.items = append(evicted.items, shard.oldest.item)
+		}
+		ct.remove(shard, shard.oldest)
+		evicted.maxEntries++
+	}
+	for shard.maxBytes > 0 && shard.oldest != nil && shard.bytes+node.size > shard.maxBytes {
+		if keep {
+			evicted.items = append(evicted.items, shard.oldest.item)
+		}
+		ct.remove(shard, shard.oldest)
+		evicted.maxMemory++
+	}
+	shard.add(node)
+
+	return DNSMapEntry{}, legStored, evicted
+}
+
+// setKeepEvicted sets whether pair returns the entries it evicts, so they can
+// be logged, or only counts them
+func (ct *connectionTable) setKeepEvicted(keep bool) {
+	var value int32
+	if keep {
+		value = 1
+	}
+	atomic.StoreInt32(&ct.keepEvicted, value)
+}
+
+// collect removes and returns the entries inserted before cutoff
+func (ct *connectionTable) collect(cutoff time.Time) []DNSMapEntry {
+	var collected []DNSMapEntry
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.Lock()
+		//capture times aren't always in order, so check every entry
+		for node := shard.oldest; node != nil; {
+			next := node.newer
+			if node.item.inserted.Before(cutoff) {
+				ct.remove(shard, node)
+				collected = append(collected, node.item)
+			}
+			node = next
+		}
+		shard.Unlock()
+	}
+	return collected
+}
+
+// len returns the number of entries in the table
+func (ct *connectionTable) len() int {
+	total := 0
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.Lock()
+		total += len(shard.entries)
+		shard.Unlock()
+	}
+	return total
+}
+
+// bytes returns the estimated memory used by the entries in the table
+func (ct *connectionTable) bytes() int64 {
+	var total int64
+	for i := range ct.shards {
+		shard := &ct.shards[i]
+		shard.Lock()
+		total += shard.bytes
+		shard.Unlock()
+	}
+	return total
+}
+
+// remove takes node out of shard and its client's count, the shard lock must be held
+func (ct *connectionTable) remove(shard *conntableShard, node *conntableNode) {
+	shard.remove(node)
+	if ct.maxPerClient > 0 {
+		clients := &ct.clients[fnv32(node.client)&uint32(len(ct.clients)-1)]
+		clients.Lock()
+		if clients.entries[node.client] <= 1 {
+			delete(clients.entries, node.client)
+		} else {
+			clients.entries[node.client]--
+		}
+		clients.Unlock()
+	}
+}
+
+// addClient counts another entry for client, unless it is at the limit
+func (ct *connectionTable) addClient(client string) bool {
+	clients := &ct.clients[fnv32(client)&uint32(len(ct.clients)-1)]
+	clients.Lock()
+	defer clients.Unlock()
+
+	if clients.entries[client] >= ct.maxPerClient {
+		return false
+	}
+	clients.entries[client]++
+	return true
+}
+
+// add makes node the newest entry in the shard, the lock must be held
+func (s *conntableShard) add(node *conntableNode) {
+	s.entries[node.key] = node
+	s.bytes += node.size
+	node.older = s.newest
+	if s.newest != nil {
+		s.newest.newer = node
+	} else {
+		s.oldest = node
+	}
+	s.newest = node
+}
+
+// remove takes node out of the shard, the lock must be held
+func (s *conntableShard) remove(node *conntableNode) {
+	delete(s.entries, node.key)
+	s.bytes -= node.size
+	if node.older != nil {
+		node.older.newer = node.newer
+	} else {
+		s.oldest = node.newer
+	}
+	if node.newer != nil {
+		node.newer.older = node.older
+	} else {
+		s.newest = node.older
+	}
+	node.older, node.newer = nil, nil
+}
+
+// conntableEntrySize estimates the memory an entry keeps alive: the entry
+// itself, its key and the DNS message, which is held once as captured and
+// again in the names and records decoded from it.
+func conntableEntrySize(key string, item *DNSMapEntry) int64 {
+	return conntableEntryOverhead + int64(len(key)) + 2*int64(len(item.entry.Contents))
+}
+
+// client returns the address of the side that sent the query
+func (e *DNSMapEntry) client() net.IP {
+	if e.entry.QR {
+		return e.dstIP
+	}
+	return e.srcIP
+}
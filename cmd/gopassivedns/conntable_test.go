@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// conntableLeg returns one leg of a lookup for example.com and its conntable key
+func conntableLeg(id uint16, qr bool, name string, inserted time.Time) (string, DNSMapEntry) {
+	client, server := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")
+	dns := layers.DNS{ID: id, QR: qr, Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+
+	leg := DNSMapEntry{entry: dns, inserted: inserted, srcIP: client, dstIP: server, srcPort: 40000, dstPort: 53}
+	if qr {
+		leg.srcIP, leg.dstIP, leg.srcPort, leg.dstPort = server, client, 53, 40000
+	}
+	return conntableKey(&dns, packetString, leg.srcIP, leg.dstIP, leg.srcPort, leg.dstPort), leg
+}
+
+func TestConntablePair(t *testing.T) {
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	now := time.Now()
+
+	key, query := conntableLeg(1, false, "example.com", now)
+	if _, result, _ := conntable.pair(key, query); result != legStored {
+		t.Fatalf("Bad result %d for the first leg, expecting %d", result, legStored)
+	}
+	if _, result, _ := conntable.pair(key, query); result != legRepeated {
+		t.Fatalf("Bad result %d for a retransmitted query, expecting %d", result, legRepeated)
+	}
+
+	key, spoofed := conntableLeg(1, true, "EXAMPLE.com", now)
+	if _, result, _ := conntable.pair(key, spoofed); result != legMismatched {
+		t.Fatalf("Bad result %d for a response with another question, expecting %d", result, legMismatched)
+	}
+
+	key, response := conntableLeg(1, true, "example.com", now)
+	item, result, _ := conntable.pair(key, response)
+	if result != legPaired || item.entry.QR || !item.inserted.Equal(now) {
+		t.Fatalf("Bad result %d for the response, expecting %d with the query", result, legPaired)
+	}
+	if conntable.len() != 0 {
+		t.Fatalf("Paired query was left in the conntable, %d entries", conntable.len())
+	}
+}
+
+func TestConntableEvict(t *testing.T) {
+	//one shard so the eviction order is predictable
+	conntable := newConnectionTable(1, conntableLimits{maxEntries: 2})
+	now := time.Now()
+
+	for id := uint16(1); id <= 3; id++ {
+		key, query := conntableLeg(id, false, "example.com", now)
+		_, _, evicted := conntable.pair(key, query)
+		if want := map[bool]int{true: 1, false: 0}[id == 3]; evicted.maxEntries != want {
+			t.Fatalf("Evicted %d entries storing query %d, expecting %d", evicted.maxEntries, id, want)
+		}
+	}
+
+	//the oldest query made room for the newest
+	key, response := conntableLeg(1, true, "example.com", now)
+	if _, result, _ := conntable.pair(key, response); result != legStored {
+		t.Fatalf("Bad result %d for the response to an evicted query, expecting %d", result, legStored)
+	}
+	key, response = conntableLeg(3, true, "example.com", now)
+	if _, result, _ := conntable.pair(key, response); result != legPaired {
+		t.Fatalf("Bad result %d for the response to the newest query, expecting %d", result, legPaired)
+	}
+}
+
+func TestConntableEvictMemory(t *testing.T) {
+	key, query := conntableLeg(1, false, "example.com", time.Now())
+	query.entry.Contents = make([]byte, 100)
+	size := conntableEntrySize(key, &query)
+
+	//room for two queries
+	conntable := newConnectionTable(1, conntableLimits{maxEntries: defaultConntableSize, maxBytes: 2*size + 10})
+	for id := uint16(1); id <= 3; id++ {
+		key, query := conntableLeg(id, false, "example.com", time.Now())
+		query.entry.Contents = make([]byte, 100)
+		_, _, evicted := conntable.pair(key, query)
+		if want := map[bool]int{true: 1, false: 0}[id == 3]; evicted.maxMemory != want {
+			t.Fatalf("Evicted %d entries storing query %d, expecting %d", evicted.maxMemory, id, want)
+		}
+	}
+	if conntable.len() != 2 || conntable.bytes() != 2*size {
+		t.Fatalf("Bad conntable size %d entries and %d bytes, expecting 2 and %d", conntable.len(), conntable.bytes(), 2*size)
+	}
+}
+
+func TestConntableClientLimit(t *testing.T) {
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize, maxPerClient: 2})
+	now := time.Now()
+
+	for id := uint16(1); id <= 3; id++ {
+		key, query := conntableLeg(id, false, "example.com", now)
+		want := map[bool]pairResult{true: legRejected, false: legStored}[id == 3]
+		if _, result, _ := conntable.pair(key, query); result != want {
+			t.Fatalf("Bad result %d storing query %d, expecting %d", result, id, want)
+		}
+	}
+
+	//answering a query makes room for another one
+	key, response := conntableLeg(1, true, "example.com", now)
+	if _, result, _ := conntable.pair(key, response); result != legPaired {
+		t.Fatalf("Bad result %d for the response, expecting %d", result, legPaired)
+	}
+	key, query := conntableLeg(3, false, "example.com", now)
+	if _, result, _ := conntable.pair(key, query); result != legStored {
+		t.Fatalf("Bad result %d storing a query after one was answered, expecting %d", result, legStored)
+	}
+
+	//other clients aren't affected
+	query.srcIP = net.ParseIP("192.0.2.2")
+	key = conntableKey(&query.entry, packetString, query.srcIP, query.dstIP, query.srcPort, query.dstPort)
+	if _, result, _ := conntable.pair(key, query); result != legStored {
+		t.Fatalf("Bad result %d storing a query from another client, expecting %d", result, legStored)
+	}
+}
+
+func TestConntableCollect(t *testing.T) {
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	now := time.Now()
+
+	//out of order, as capture times can be
+	for id, inserted := range []time.Time{now, now.Add(-time.Hour), now.Add(time.Minute), now.Add(-time.Minute)} {
+		key, query := conntableLeg(uint16(id), false, "example.com", inserted)
+		conntable.pair(key, query)
+	}
+
+	collected := conntable.collect(now.Add(-time.Second))
+	if len(collected) != 2 || conntable.len() != 2 {
+		t.Fatalf("Collected %d entries leaving %d, expecting 2 and 2", len(collected), conntable.len())
+	}
+	for _, item := range collected {
+		if !item.inserted.Before(now) {
+			t.Fatalf("Collected query %d inserted at %s, after the cutoff", item.entry.ID, item.inserted)
+		}
+	}
+}
+
+// BenchmarkConntable pairs a query and response per op, split over a number
+// of workers like the packet handlers, with one lock and with the shards
+func BenchmarkConntable(b *testing.B) {
+	for _, shards := range []int{1, conntableShards} {
+		for _, workers := range []int{1, 2, 4, 8, 16} {
+			b.Run(fmt.Sprintf("shards-%d/workers-%d", shards, workers), func(b *testing.B) {
+				conntable := newConnectionTable(shards, conntableLimits{maxEntries: defaultConntableSize})
+				now := time.Now()
+
+				//build the legs up front so only the table is measured
+				type lookup struct {
+					key             string
+					query, response DNSMapEntry
+				}
+				lookups := make([][]lookup, workers)
+				for w := range lookups {
+					for i := 0; i < b.N/workers+1; i++ {
+						name := fmt.Sprintf("%d-%d.example.com", w, i)
+						key, query := conntableLeg(uint16(i), false, name, now)
+						_, response := conntableLeg(uint16(i), true, name, now)
+						lookups[w] = append(lookups[w], lookup{key, query, response})
+					}
+				}
+
+				var wg sync.WaitGroup
+				b.ResetTimer()
+				for w := 0; w < workers; w++ {
+					wg.Add(1)
+					go func(lookups []lookup) {
+						defer wg.Done()
+						for _, l := range lookups {
+							conntable.pair(l.key, l.query)
+							conntable.pair(l.key, l.response)
+						}
+					}(lookups[w])
+				}
+				wg.Wait()
+			})
+		}
+	}
+}
+
+func TestConnectionTables(t *testing.T) {
+	conntables := newConnectionTables(4, conntableLimits{maxEntries: 4 * conntableShards, maxPerClient: 2})
+	if len(conntables) != 4 || conntables[0].shards[0].maxEntries != 1 {
+		t.Fatalf("Bad conntables, %d tables of %d entries a shard, expecting 4 of 1", len(conntables), conntables[0].shards[0].maxEntries)
+	}
+
+	//the client's lookups land in different tables, but count against one limit
+	now := time.Now()
+	for id := uint16(1); id <= 3; id++ {
+		key, query := conntableLeg(id, false, "example.com", now)
+		want := map[bool]pairResult{true: legRejected, false: legStored}[id == 3]
+		if _, result, _ := conntables[id].pair(key, query); result != want {
+			t.Fatalf("Bad result %d storing query %d, expecting %d", result, id, want)
+		}
+	}
+
+	if conntables.len() != 2 {
+		t.Fatalf("Bad conntables size %d, expecting 2", conntables.len())
+	}
+	if collected := conntables.collect(now.Add(time.Second)); len(collected) != 2 || conntables.len() != 0 {
+		t.Fatalf("Collected %d entries leaving %d, expecting 2 and 0", len(collected), conntables.len())
+	}
+}
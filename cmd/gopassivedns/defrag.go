@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// defragLimits bounds the fragments each capture reader holds on to
+type defragLimits struct {
+	timeout  time.Duration // how long to wait for the rest of a datagram
+	maxBytes int64         // 0 to not reassemble fragments at all
+}
+
+// fragmentKey identifies the datagram a fragment belongs to.  IPv4 datagrams
+// are told apart by protocol as well as ID (RFC 791), IPv6 ones by the ID alone.
+type fragmentKey struct {
+	flow     gopacket.Flow
+	protocol layers.IPProtocol
+	id       uint32
+}
+
+// pendingDatagram is a datagram still waiting for some of its fragments
+type pendingDatagram struct {
+	key      fragmentKey
+	bytes    int64
+	lastSeen time.Time
+	older    *pendingDatagram
+	newer    *pendingDatagram
+
+	fragments  []datagramFragment
+	nextHeader layers.IPProtocol
+	final      bool // the last fragment has arrived, so length is known
+	length     int
+}
+
+// datagramFragment is the data of one fragment, at offset in the datagram's payload
+type datagramFragment struct {
+	offset int
+	data   []byte
+}
+
+// defragmenter reassembles the fragmented IPv4 and IPv6 datagrams read by one
+// capture reader.  The datagrams are kept in the order a fragment was last
+// added to them, so the one waiting longest is evicted first when the
+// fragments take up too much memory.
+type defragmenter struct {
+	pending   map[fragmentKey]*pendingDatagram
+	oldest    *pendingDatagram
+	newest    *pendingDatagram
+	bytes     int64
+	limits    defragLimits
+	lastSweep time.Time
+	stats     metrics
+}
+
+func newDefragmenter(limits defragLimits, stats metrics) *defragmenter {
+	return &defragmenter{
+		pending: make(map[fragmentKey]*pendingDatagram),
+		limits:  limits,
+		stats:   stats,
+	}
+}
+
+// defragPacket returns packet if it isn't a fragment.  Fragments are held on
+// to, returning nil, until the last one of a datagram arrives and a packet
+// holding the whole datagram is returned instead, with the link layer headers
+// of that last fragment.  found, ipv4 and ipv6 are what packet decoded to.
+func (d *defragmenter) defragPacket(packet gopacket.Packet, firstLayer gopacket.LayerType, found []gopacket.LayerType, ipv4 *layers.IPv4, ipv6 *layers.IPv6) gopacket.Packet {
+	timestamp := packet.Metadata().Timestamp
+	d.expire(timestamp)
+
+	var header, payload []byte
+	var datagram gopacket.SerializableLayer
+	switch {
+	case foundLayerType(layers.LayerTypeIPv4, found) && (ipv4.Flags&layers.IPv4MoreFragments != 0 || ipv4.FragOffset != 0):
+		reassembled := d.defragIPv4(ipv4, timestamp)
+		if reassembled == nil {
+			return nil
+		}
+		header, datagram, payload = ipv4.Contents, reassembled, reassembled.Payload
+	case foundLayerType(layers.LayerTypeIPv6, found) && ipv6.NextHeader == layers.IPProtocolIPv6Fragment:
+		reassembled := d.defragIPv6(ipv6, timestamp)
+		if reassembled == nil {
+			return nil
+		}
+		header, datagram, payload = ipv6.Contents, reassembled, reassembled.Payload
+	default:
+		return packet
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, datagram, gopacket.Payload(payload)); err != nil {
+		log.Debugf("Unable to rebuild a reassembled datagram: %s", err)
+		return nil
+	}
+
+	//the IP header is a slice of the packet's data, so where it starts can be
+	//told from how much room is left after it
+	data := packet.Data()
+	linkLength := cap(data) - cap(header)
+	data = append(data[:linkLength:linkLength], buffer.Bytes()...)
+
+	reassembled := gopacket.NewPacket(data, firstLayer, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	reassembled.Metadata().CaptureInfo = packet.Metadata().CaptureInfo
+	reassembled.Metadata().CaptureLength = len(data)
+	reassembled.Metadata().Length = len(data)
+	return reassembled
+}
+
+// defragIPv4 adds an IPv4 fragment, returning the reassembled datagram once
+// it is complete and nil until then
+func (d *defragmenter) defragIPv4(fragment *layers.IPv4, timestamp time.Time) *layers.IPv4 {
+	key := fragmentKey{flow: fragment.NetworkFlow(), protocol: fragment.Protocol, id: uint32(fragment.Id)}
+	offset := int(fragment.FragOffset) * 8
+	more := fragment.Flags&layers.IPv4MoreFragments != 0
+
+	//the reassembled datagram has a header without options
+	payload, nextHeader := d.addFragment(key, timestamp, offset, more, fragment.Protocol, fragment.Payload, 0xffff-20)
+	if payload == nil {
+		return nil
+	}
+
+	reassembled := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TOS:      fragment.TOS,
+		Id:       fragment.Id,
+		TTL:      fragment.TTL,
+		Protocol: nextHeader,
+		SrcIP:    fragment.SrcIP,
+		DstIP:    fragment.DstIP,
+	}
+	reassembled.Payload = payload
+	return reassembled
+}
+
+// defragIPv6 adds the IPv6 fragment, whose payload starts with the fragment
+// header, returning the reassembled datagram once it is complete and nil until
+// then
+func (d *defragmenter) defragIPv6(fragment *layers.IPv6, timestamp time.Time) *layers.IPv6 {
+	if len(fragment.Payload) < 8 {
+		return nil
+	}
+	header, data := fragment.Payload[:8], fragment.Payload[8:]
+	key := fragmentKey{flow: fragment.NetworkFlow(), id: binary.BigEndian.Uint32(header[4:8])}
+	offset := int(binary.BigEndian.Uint16(header[2:4]) &^ 0x7)
+	more := header[3]&0x1 != 0
+
+	payload, nextHeader := d.addFragment(key, timestamp, offset, more, layers.IPProtocol(header[0]), data, 0xffff)
+	if payload == nil {
+		return nil
+	}
+
+	reassembled := &layers.IPv6{
+		Version:      6,
+		TrafficClass: fragment.TrafficClass,
+		FlowLabel:    fragment.FlowLabel,
+		NextHeader:   nextHeader,
+		HopLimit:     fragment.HopLimit,
+		SrcIP:        fragment.SrcIP,
+		DstIP:        fragment.DstIP,
+	}
+	reassembled.Payload = payload
+	return reassembled
+}
+
+// addFragment adds the data of a fragment at offset in the datagram key's
+// payload, which can't be longer than maxLength.  more is set on every
+// fragment but the last.  Once the datagram is complete its payload and the
+// protocol the first fragment gave for it are returned, until then nil.
+func (d *defragmenter) addFragment(key fragmentKey, timestamp time.Time, offset int, more bool, nextHeader layers.IPProtocol, data []byte, maxLength int) ([]byte, layers.IPProtocol) {
+	//fragments other than the last are multiples of 8 bytes, RFC 791 and 8200
+	if offset+len(data) > maxLength || (more && len(data)%8 != 0) {
+		log.Debugf("Abandoning a datagram from %s: bad fragment at %d", key.flow, offset)
+		d.abandon(key)
+		return nil, 0
+	}
+
+	datagram := d.hold(key, timestamp, int64(len(data)))
+	if datagram == nil {
+		return nil, 0
+	}
+	if offset == 0 {
+		datagram.nextHeader = nextHeader
+	}
+	if !more {
+		datagram.final = true
+		datagram.length = offset + len(data)
+	}
+	datagram.fragments = append(datagram.fragments, datagramFragment{offset: offset, data: data})
+
+	payload, err := datagram.reassemble()
+	if err != nil {
+		log.Debugf("Abandoning a datagram from %s: %s", key.flow, err)
+		d.abandon(key)
+		return nil, 0
+	}
+	if payload == nil {
+		return nil, 0
+	}
+
+	d.complete(key)
+	return payload, datagram.nextHeader
+}
+
+// reassemble returns the datagram's payload once all of its fragments have
+// arrived.  RFC 8200 has datagrams with overlapping fragments dropped, which
+// is an error, but an exact copy of a fragment is ignored.
+func (p *pendingDatagram) reassemble() ([]byte, error) {
+	sort.SliceStable(p.fragments, func(i, j int) bool { return p.fragments[i].offset < p.fragments[j].offset })
+
+	next := 0
+	fragments := p.fragments[:0]
+	for i, fragment := range p.fragments {
+		if i > 0 && fragment.offset == p.fragments[i-1].offset && len(fragment.data) == len(p.fragments[i-1].data) {
+			continue
+		}
+		if fragment.offset < next {
+			return nil, errors.New("overlapping fragments")
+		}
+		next = fragment.offset + len(fragment.data)
+		fragments = append(fragments, fragment)
+	}
+	p.fragments = fragments
+
+	if p.final && next > p.length {
+		return nil, errors.New("fragment past the end of the datagram")
+	}
+	if !p.final || next != p.length {
+		return nil, nil
+	}
+
+	payload := make([]byte, 0, p.length)
+	for _, fragment := range p.fragments {
+		if fragment.offset != len(payload) {
+			//a hole
+			return nil, nil
+		}
+		payload = append(payload, fragment.data...)
+	}
+	return payload, nil
+}
+
+// hold accounts for bytes more of the datagram key and makes it the newest,
+// abandoning the oldest datagrams if that takes the defragmenter over its
+// limit.  The datagram is returned, or nil if it was abandoned itself.
+func (d *defragmenter) hold(key fragmentKey, timestamp time.Time, bytes int64) *pendingDatagram {
+	datagram, found := d.pending[key]
+	if found {
+		d.unlink(datagram)
+	} else {
+		datagram = &pendingDatagram{key: key}
+		d.pending[key] = datagram
+	}
+	d.link(datagram)
+	datagram.bytes += bytes
+	datagram.lastSeen = timestamp
+	d.bytes += bytes
+
+	//the oldest datagram is the one which has waited longest for a fragment
+	for d.bytes > d.limits.maxBytes && d.oldest != nil {
+		d.abandon(d.oldest.key)
+	}
+	return d.pending[key]
+}
+
+// expire abandons the datagrams that have timed out, checking at most once a
+// second of capture time
+func (d *defragmenter) expire(now time.Time) {
+	if now.Sub(d.lastSweep) < time.Second {
+		return
+	}
+	d.lastSweep = now
+	d.discardOlderThan(now.Add(-d.limits.timeout))
+}
+
+// discardOlderThan abandons the datagrams last added to before cutoff
+func (d *defragmenter) discardOlderThan(cutoff time.Time) {
+	//capture times aren't always in order, so check every datagram
+	for datagram := d.oldest; datagram != nil; {
+		next := datagram.newer
+		if datagram.lastSeen.Before(cutoff) {
+			d.abandon(datagram.key)
+		}
+		datagram = next
+	}
+}
+
+// abandon forgets the datagram key, which will never be reassembled
+func (d *defragmenter) abandon(key fragmentKey) {
+	d.forget(key)
+	if d.stats != nil {
+		d.stats.Incr("fragments_abandoned", 1)
+	}
+}
+
+// complete forgets the datagram key, which has been reassembled
+func (d *defragmenter) complete(key fragmentKey) {
+	d.forget(key)
+	if d.stats != nil {
+		d.stats.Incr("fragments_reassembled", 1)
+	}
+}
+
+// forget removes the datagram key and the fragments it holds
+func (d *defragmenter) forget(key fragmentKey) {
+	if datagram, found := d.pending[key]; found {
+		d.unlink(datagram)
+		d.bytes -= datagram.bytes
+		delete(d.pending, key)
+	}
+}
+
+// link makes datagram the newest
+func (d *defragmenter) link(datagram *pendingDatagram) {
+	datagram.older = d.newest
+	if d.newest != nil {
+		d.newest.newer = datagram
+	} else {
+		d.oldest = datagram
+	}
+	d.newest = datagram
+}
+
+// unlink takes datagram out of the age order
+func (d *defragmenter) unlink(datagram *pendingDatagram) {
+	if datagram.older != nil {
+		datagram.older.newer = datagram.newer
+	} else {
+		d.oldest = datagram.newer
+	}
+	if datagram.newer != nil {
+		datagram.newer.older = datagram.older
+	} else {
+		d.newest = datagram.older
+	}
+	datagram.older, datagram.newer = nil, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// newIPv6Fragment returns an IPv6 packet holding the fragment of datagram id at
+// offset, with more set if there are more fragments after it
+func newIPv6Fragment(id byte, offset int, more bool, data []byte) *layers.IPv6 {
+	flags := uint16(offset)
+	if more {
+		flags |= 1
+	}
+	fragment := &layers.IPv6{
+		Version:    6,
+		NextHeader: layers.IPProtocolIPv6Fragment,
+		SrcIP:      net.ParseIP("2001:db8::53"),
+		DstIP:      net.ParseIP("2001:db8::1"),
+	}
+	fragment.Payload = append([]byte{byte(layers.IPProtocolUDP), 0, byte(flags >> 8), byte(flags), 0, 0, 0, id}, data...)
+	return fragment
+}
+
+func TestDefragIPv6(t *testing.T) {
+	now := time.Now()
+	first, last := make([]byte, 16), []byte{1, 2, 3}
+	for i := range first {
+		first[i] = byte(i)
+	}
+
+	d := newDefragmenter(defragLimits{timeout: time.Minute, maxBytes: 1 << 20}, nil)
+	if d.defragIPv6(newIPv6Fragment(1, 16, false, last), now) != nil {
+		t.Fatal("Reassembled a datagram missing its first fragment")
+	}
+	//a retransmitted copy is ignored
+	if d.defragIPv6(newIPv6Fragment(1, 16, false, last), now) != nil {
+		t.Fatal("Reassembled a datagram from two copies of its last fragment")
+	}
+
+	datagram := d.defragIPv6(newIPv6Fragment(1, 0, true, first), now)
+	if datagram == nil || len(datagram.Payload) != 19 || datagram.Payload[15] != 15 || datagram.Payload[16] != 1 || datagram.NextHeader != layers.IPProtocolUDP {
+		t.Fatalf("Bad reassembled datagram %+v", datagram)
+	}
+	if len(d.pending) != 0 || d.bytes != 0 {
+		t.Fatalf("Reassembled datagram was kept, %d pending with %d bytes", len(d.pending), d.bytes)
+	}
+
+	//overlapping fragments drop the datagram
+	d.defragIPv6(newIPv6Fragment(2, 0, true, first), now)
+	if d.defragIPv6(newIPv6Fragment(2, 8, false, first), now) != nil || len(d.pending) != 0 {
+		t.Fatal("Overlapping fragments were not abandoned")
+	}
+
+	//fragments other than the last must be a multiple of 8 bytes
+	if d.defragIPv6(newIPv6Fragment(3, 0, true, last), now) != nil || len(d.pending) != 0 {
+		t.Fatal("A short fragment was not abandoned")
+	}
+}
+
+func TestDefragIPv4(t *testing.T) {
+	now := time.Now()
+	first, last := make([]byte, 16), []byte{1, 2, 3}
+	for i := range first {
+		first[i] = byte(i)
+	}
+	fragment := func(offset uint16, more bool, data []byte) *layers.IPv4 {
+		ipv4 := &layers.IPv4{Version: 4, Id: 1, FragOffset: offset / 8, Protocol: layers.IPProtocolUDP, SrcIP: net.ParseIP("192.0.2.53"), DstIP: net.ParseIP("192.0.2.1")}
+		if more {
+			ipv4.Flags = layers.IPv4MoreFragments
+		}
+		ipv4.Payload = data
+		return ipv4
+	}
+
+	d := newDefragmenter(defragLimits{timeout: time.Minute, maxBytes: 1 << 20}, nil)
+	if d.defragIPv4(fragment(16, false, last), now) != nil {
+		t.Fatal("Reassembled a datagram missing its first fragment")
+	}
+	//a fragment of another protocol's datagram with the same ID
+	other := fragment(0, true, first)
+	other.Protocol = layers.IPProtocolTCP
+	if d.defragIPv4(other, now) != nil {
+		t.Fatal("Reassembled fragments of different protocols into one datagram")
+	}
+	datagram := d.defragIPv4(fragment(0, true, first), now)
+	if datagram == nil || len(datagram.Payload) != 19 || datagram.Payload[15] != 15 || datagram.Payload[16] != 1 || datagram.Protocol != layers.IPProtocolUDP || datagram.Id != 1 {
+		t.Fatalf("Bad reassembled datagram %+v", datagram)
+	}
+	if len(d.pending) != 1 || d.oldest.key.protocol != layers.IPProtocolTCP {
+		t.Fatalf("Expecting only the TCP datagram pending, got %d datagrams with %d bytes", len(d.pending), d.bytes)
+	}
+}
+
+func TestDefragmenterLimits(t *testing.T) {
+	now := time.Now()
+	data := make([]byte, 64)
+
+	//room for two datagrams' first fragments
+	d := newDefragmenter(defragLimits{timeout: time.Minute, maxBytes: 128}, nil)
+	d.defragIPv6(newIPv6Fragment(1, 0, true, data), now)
+	d.defragIPv6(newIPv6Fragment(2, 0, true, data), now.Add(time.Millisecond))
+	d.defragIPv6(newIPv6Fragment(3, 0, true, data), now.Add(2*time.Millisecond))
+
+	if len(d.pending) != 2 || d.bytes != 128 {
+		t.Fatalf("Expecting 2 datagrams with 128 bytes, got %d with %d", len(d.pending), d.bytes)
+	}
+	for _, datagram := range d.pending {
+		if datagram.lastSeen.Equal(now) {
+			t.Fatal("The oldest datagram was not the one evicted")
+		}
+	}
+
+	//another fragment of datagram 2 makes datagram 3 the oldest
+	d.defragIPv6(newIPv6Fragment(2, 64, true, data[:8]), now.Add(3*time.Millisecond))
+	if len(d.pending) != 1 || d.oldest != d.newest || d.oldest.key.id != 2 || d.bytes != 72 {
+		t.Fatalf("Expecting datagram 2 alone with 72 bytes, got %d datagrams with %d", len(d.pending), d.bytes)
+	}
+
+	//the rest of datagrams 2 and 3 never arrive
+	d.expire(now.Add(2 * time.Minute))
+	if len(d.pending) != 0 || d.bytes != 0 {
+		t.Fatalf("Timed out datagrams were kept, %d pending with %d bytes", len(d.pending), d.bytes)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	log "github.com/sirupsen/logrus"
+)
+
+// dnstapTimeout bounds the Frame Streams handshake, so a connection which
+// never sends one doesn't tie up a goroutine
+const dnstapTimeout = 10 * time.Second
+
+// dnstapInput accepts dnstap connections from DNS servers, over Frame Streams
+// on a unix socket or TCP
+type dnstapInput struct {
+	listener net.Listener
+}
+
+// parseDnstapAddress splits a -dnstap address into the network and address
+// to listen on: unix:/path or a bare path for a unix socket, tcp:host:port for TCP
+func parseDnstapAddress(address string) (string, string, error) {
+	var network, listen string
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		network, listen = "unix", strings.TrimPrefix(address, "unix:")
+	case strings.HasPrefix(address, "tcp:"):
+		network, listen = "tcp", strings.TrimPrefix(address, "tcp:")
+	case strings.HasPrefix(address, "/"):
+		network, listen = "unix", address
+	default:
+		return "", "", fmt.Errorf("use unix:/path or tcp:host:port")
+	}
+	if listen == "" {
+		return "", "", fmt.Errorf("no %s address given", network)
+	}
+	return network, listen, nil
+}
+
+// newDnstapInput starts listening for dnstap connections on address
+func newDnstapInput(address string) (*dnstapInput, error) {
+	network, listen, err := parseDnstapAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		//a socket left behind by an earlier run would stop us listening, but
+		//anything else at that path isn't ours to remove
+		if info, err := os.Lstat(listen); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(listen)
+		}
+	}
+
+	listener, err := net.Listen(network, listen)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen for dnstap on %s: %s", address, err)
+	}
+	return &dnstapInput{listener: listener}, nil
+}
+
+// serve accepts dnstap connections until stop is closed, passing each message
+// to handle.  Connections are read concurrently, so handle must be safe to call
+// from more than one goroutine.  The returned channel is closed once the
+// listener and every connection have been closed.
+func (d *dnstapInput) serve(handle func(*dnstap.Message), stop chan struct{}) chan struct{} {
+	done := make(chan struct{})
+
+	var mu sync.Mutex
+	var stopped bool
+	conns := make(map[net.Conn]struct{})
+	go func() {
+		<-stop
+		mu.Lock()
+		stopped = true
+		d.listener.Close()
+		for conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}()
+
+	go func() {
+		var readers sync.WaitGroup
+		defer close(done)
+		defer readers.Wait()
+
+		for {
+			conn, err := d.listener.Accept()
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+					time.Sleep(100 * time.Millisecond)
+					continue
+				}
+				mu.Lock()
+				if !stopped {
+					log.Printf("gopassivedns: no longer accepting dnstap connections: %s", err)
+				}
+				mu.Unlock()
+				return
+			}
+
+			mu.Lock()
+			if stopped {
+				mu.Unlock()
+				conn.Close()
+				return
+			}
+			conns[conn] = struct{}{}
+			mu.Unlock()
+
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				readDnstap(conn, handle)
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+				conn.Close()
+			}()
+		}
+	}()
+
+	return done
+}
+
+// readDnstap passes the messages read from one dnstap connection to handle,
+// until the sender closes it or it fails
+func readDnstap(conn net.Conn, handle func(*dnstap.Message)) {
+	reader, err := dnstap.NewReader(conn, &dnstap.ReaderOptions{Bidirectional: true, Timeout: dnstapTimeout})
+	if err != nil {
+		log.Debugf("dnstap handshake failed: %s", err)
+		return
+	}
+	decoder := dnstap.NewDecoder(reader, int(dnstap.MaxPayloadSize))
+
+	for {
+		frame := &dnstap.Dnstap{}
+		if err := decoder.Decode(frame); err != nil {
+			if err != io.EOF {
+				log.Debugf("dnstap connection closed: %s", err)
+			}
+			return
+		}
+		if frame.GetType() != dnstap.Dnstap_MESSAGE || frame.GetMessage() == nil {
+			continue
+		}
+		handle(frame.GetMessage())
+	}
+}
+
+// dnstapFlowHash returns the flowHash of the packets carrying the lookup a
+// dnstap Message belongs to, so it is paired in the same conntable as them
+func dnstapFlowHash(message *dnstap.Message) uint64 {
+	network := layers.EndpointIPv4
+	if message.GetSocketFamily() == dnstap.SocketFamily_INET6 {
+		network = layers.EndpointIPv6
+	}
+	transport := layers.EndpointUDPPort
+	if message.GetSocketProtocol() == dnstap.SocketProtocol_TCP {
+		transport = layers.EndpointTCPPort
+	}
+
+	//NewFlow panics on an address too long to be IPv4 or IPv6, any table will do for those
+	queryAddress, responseAddress := message.GetQueryAddress(), message.GetResponseAddress()
+	if len(queryAddress) > gopacket.MaxEndpointSize || len(responseAddress) > gopacket.MaxEndpointSize {
+		return 0
+	}
+
+	var queryPort, responsePort [2]byte
+	binary.BigEndian.PutUint16(queryPort[:], uint16(message.GetQueryPort()))
+	binary.BigEndian.PutUint16(responsePort[:], uint16(message.GetResponsePort()))
+	return flowHash(gopacket.NewFlow(network, queryAddress, responseAddress),
+		gopacket.NewFlow(transport, queryPort[:], responsePort[:]))
+}
+
+// handleDnstapMessage logs the DNS message a dnstap Message carries like one
+// captured off the wire, with the addresses and time the server reported
+func handleDnstapMessage(conntable *connectionTable, message *dnstap.Message, logChan chan DNSLogEntry, syslogPriority string, entryOpts logEntryOptions, stats metrics) {
+	//the query address is always the one which sent the query, whichever
+	//end of the lookup the server was
+	srcIP, dstIP := net.IP(message.GetQueryAddress()), net.IP(message.GetResponseAddress())
+	srcPort, dstPort := uint16(message.GetQueryPort()), uint16(message.GetResponsePort())
+	wire := message.GetQueryMessage()
+	seconds, nanoseconds := message.GetQueryTimeSec(), message.GetQueryTimeNsec()
+
+	//the query types are odd and each is followed by its response type
+	if message.GetType()%2 == 0 {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		wire = message.GetResponseMessage()
+		seconds, nanoseconds = message.GetResponseTimeSec(), message.GetResponseTimeNsec()
+	}
+
+	if len(wire) == 0 {
+		log.Debugf("dnstap %s without a DNS message", message.GetType())
+		return
+	}
+
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(wire, gopacket.NilDecodeFeedback); err != nil {
+		log.Debugf("dnstap %s did not parse as DNS: %s", message.GetType(), err)
+		return
+	}
+
+	packetTime := time.Now()
+	if seconds != 0 {
+		packetTime = time.Unix(int64(seconds), int64(nanoseconds))
+	}
+
+	if stats != nil {
+		stats.Incr("dnstap_messages", 1)
+	}
+
+	length := len(wire)
+	protocol := strings.ToLower(message.GetSocketProtocol().String())
+	handleDNS(conntable, dns, logChan, syslogPriority, entryOpts, srcIP, dstIP, srcPort, dstPort, &length, &protocol, ingressInfo{}, packetTime, stats)
+}
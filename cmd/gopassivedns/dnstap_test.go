@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	dnstap "github.com/dnstap/golang-dnstap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// newDnstapLookup returns a dnstap query and response for an A lookup of
+// example.com by client, answered with 192.0.2.80
+func newDnstapLookup(t *testing.T, queryType, responseType dnstap.Message_Type, client, server net.IP) (*dnstap.Message, *dnstap.Message) {
+	question := []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}
+	query := &layers.DNS{ID: 4242, RD: true, QDCount: 1, Questions: question}
+	response := &layers.DNS{ID: 4242, QR: true, RD: true, RA: true, QDCount: 1, ANCount: 1, Questions: question,
+		Answers: []layers.DNSResourceRecord{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.ParseIP("192.0.2.80").To4()}}}
+
+	var wire [][]byte
+	for _, dns := range []*layers.DNS{query, response} {
+		buffer := gopacket.NewSerializeBuffer()
+		if err := dns.SerializeTo(buffer, gopacket.SerializeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		wire = append(wire, buffer.Bytes())
+	}
+
+	family, protocol := dnstap.SocketFamily_INET, dnstap.SocketProtocol_TCP
+	var queryPort, responsePort uint32 = 40000, 53
+	var seconds uint64 = 1600000000
+	var queryNanoseconds, responseNanoseconds uint32 = 0, 2000000
+	common := func(messageType dnstap.Message_Type) *dnstap.Message {
+		return &dnstap.Message{Type: &messageType, SocketFamily: &family, SocketProtocol: &protocol,
+			QueryAddress: client, ResponseAddress: server, QueryPort: &queryPort, ResponsePort: &responsePort}
+	}
+
+	queryMessage := common(queryType)
+	queryMessage.QueryMessage, queryMessage.QueryTimeSec, queryMessage.QueryTimeNsec = wire[0], &seconds, &queryNanoseconds
+	responseMessage := common(responseType)
+	responseMessage.ResponseMessage, responseMessage.ResponseTimeSec, responseMessage.ResponseTimeNsec = wire[1], &seconds, &responseNanoseconds
+	return queryMessage, responseMessage
+}
+
+// sendDnstap connects to the dnstap socket at path and sends messages,
+// returning the connection which is left open
+func sendDnstap(t *testing.T, path string, messages ...*dnstap.Message) net.Conn {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := dnstap.NewWriter(conn, &dnstap.WriterOptions{Bidirectional: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageType := dnstap.Dnstap_MESSAGE
+	encoder := dnstap.NewEncoder(writer)
+	for _, message := range messages {
+		if err := encoder.Encode(&dnstap.Dnstap{Type: &messageType, Message: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//the framestream writer buffers the frames
+	if err := writer.(interface{ Flush() error }).Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestHandleDnstapMessage(t *testing.T) {
+	client, server := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.53").To4()
+
+	for _, types := range [][]dnstap.Message_Type{
+		{dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE},
+		{dnstap.Message_RESOLVER_QUERY, dnstap.Message_RESOLVER_RESPONSE},
+	} {
+		logChan := make(chan DNSLogEntry, 10)
+		conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+		query, response := newDnstapLookup(t, types[0], types[1], client, server)
+
+		handleDnstapMessage(conntable, query, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, stats)
+		if len(logChan) != 0 || conntable.len() != 1 {
+			t.Fatalf("Bad %s handling, %d logs and %d conntable entries, expecting 0 and 1", types[0], len(logChan), conntable.len())
+		}
+
+		handleDnstapMessage(conntable, response, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, stats)
+		if len(logChan) != 1 || conntable.len() != 0 {
+			t.Fatalf("Bad %s handling, %d logs and %d conntable entries, expecting 1 and 0", types[1], len(logChan), conntable.len())
+		}
+
+		entry := <-logChan
+		if entry.Answer != "192.0.2.80" || entry.Question != "example.com" {
+			t.Fatalf("Bad %s log entry %s %s, expecting example.com 192.0.2.80", types[1], entry.Question, entry.Answer)
+		}
+		if !entry.Client.Equal(client) || entry.ClientPort != 40000 || !entry.Server.Equal(server) {
+			t.Fatalf("Bad %s addresses %s:%d to %s, expecting %s:40000 to %s", types[1], entry.Client, entry.ClientPort, entry.Server, client, server)
+		}
+		if entry.Proto != "tcp" || entry.Elapsed != int64(2*time.Millisecond) {
+			t.Fatalf("Bad %s protocol %s and elapsed %d, expecting tcp and 2ms", types[1], entry.Proto, entry.Elapsed)
+		}
+	}
+}
+
+func TestDnstapFlowHash(t *testing.T) {
+	client, server := net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.53").To4()
+	query, response := newDnstapLookup(t, dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE, client, server)
+
+	//the packets carrying the lookup are dispatched by their IP and TCP flows,
+	//the TCP layer only has a flow once it is decoded
+	buffer := gopacket.NewSerializeBuffer()
+	if err := (&layers.TCP{SrcPort: 40000, DstPort: 53, DataOffset: 5}).SerializeTo(buffer, gopacket.SerializeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	tcp := &layers.TCP{}
+	if err := tcp.DecodeFromBytes(buffer.Bytes(), gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	want := flowHash((&layers.IPv4{SrcIP: client, DstIP: server}).NetworkFlow(), tcp.TransportFlow())
+
+	for _, message := range []*dnstap.Message{query, response} {
+		if hash := dnstapFlowHash(message); hash != want {
+			t.Fatalf("Bad flow hash %x for the dnstap %s, expecting %x", hash, message.GetType(), want)
+		}
+	}
+}
+
+func TestDnstapInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopassivedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnstap.sock")
+
+	tap, err := newDnstapInput("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := make(chan *dnstap.Message, 10)
+	stop := make(chan struct{})
+	done := tap.serve(func(message *dnstap.Message) { messages <- message }, stop)
+
+	query, response := newDnstapLookup(t, dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE, net.ParseIP("::1"), net.ParseIP("::1"))
+	conn := sendDnstap(t, path, query, response)
+
+	for _, expected := range []dnstap.Message_Type{dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE} {
+		select {
+		case message := <-messages:
+			if message.GetType() != expected {
+				t.Fatalf("Bad dnstap message %s, expecting %s", message.GetType(), expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the dnstap %s", expected)
+		}
+	}
+
+	//the connection is still open, stopping must close it
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dnstap input did not stop")
+	}
+	conn.Close()
+
+	//the path can be listened on again, but a file which isn't a socket is
+	//left alone
+	tap, err = newDnstapInput(path)
+	if err != nil {
+		t.Fatalf("Unable to listen on the dnstap socket again: %s", err)
+	}
+	tap.listener.Close()
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDnstapInput(path); err == nil {
+		t.Fatal("newDnstapInput replaced a file which isn't a socket")
+	}
+}
+
+func TestDoCaptureWithDnstap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopassivedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnstap.sock")
+
+	tap, err := newDnstapInput("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logChan := make(chan DNSLogEntry, 100)
+	done := make(chan bool)
+	captured := make(chan struct{})
+	go func() {
+		doCapture(getHandle("100_udp_lookups"), tap, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, stats, done, nil)
+		close(captured)
+	}()
+
+	for i := 0; i < 50; i++ {
+		select {
+		case <-logChan:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the pcap logs, got %d", i)
+		}
+	}
+
+	//the pcap has been read, but dnstap carries on
+	select {
+	case <-captured:
+		t.Fatal("Capture stopped at the end of the pcap while reading dnstap")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	query, response := newDnstapLookup(t, dnstap.Message_CLIENT_QUERY, dnstap.Message_CLIENT_RESPONSE, net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.53").To4())
+	conn := sendDnstap(t, path, query, response)
+	defer conn.Close()
+
+	select {
+	case entry := <-logChan:
+		if entry.Question != "example.com" || entry.Answer != "192.0.2.80" {
+			t.Fatalf("Bad dnstap log entry %s %s, expecting example.com 192.0.2.80", entry.Question, entry.Answer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the dnstap log")
+	}
+
+	//stopping with the dnstap connection still open closes it before the logs
+	close(done)
+	select {
+	case <-captured:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Capture did not stop")
+	}
+	if _, more := <-logChan; more {
+		t.Fatal("Logged more than the pcap and dnstap lookups")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// EDNS option codes gopacket doesn't have constants for
+const (
+	dnsOptionCodeExtendedError layers.DNSOptionCode = 15 // RFC 8914
+)
+
+// ednsInfo is the decoded OPT pseudo-record of a DNS message, RFC 6891
+type ednsInfo struct {
+	Version        uint8           `json:"version" msgpack:"version"`
+	UDPSize        uint16          `json:"udp_size" msgpack:"udp_size"`
+	DO             bool            `json:"do" msgpack:"do"`
+	ExtendedRcode  uint16          `json:"extended_rcode" msgpack:"extended_rcode"` // the full 12 bit rcode
+	ClientSubnet   *clientSubnet   `json:"client_subnet,omitempty" msgpack:"client_subnet,omitempty"`
+	ClientCookie   string          `json:"client_cookie,omitempty" msgpack:"client_cookie,omitempty"`
+	ServerCookie   string          `json:"server_cookie,omitempty" msgpack:"server_cookie,omitempty"`
+	NSID           string          `json:"nsid,omitempty" msgpack:"nsid,omitempty"`
+	PaddingLength  int             `json:"padding,omitempty" msgpack:"padding,omitempty"`
+	ExtendedErrors []extendedError `json:"extended_errors,omitempty" msgpack:"extended_errors,omitempty"`
+}
+
+// clientSubnet is the EDNS Client Subnet option, RFC 7871
+type clientSubnet struct {
+	Family       uint16 `json:"family" msgpack:"family"`
+	Address      string `json:"address" msgpack:"address"`
+	SourcePrefix uint8  `json:"source_prefix" msgpack:"source_prefix"`
+	ScopePrefix  uint8  `json:"scope_prefix" msgpack:"scope_prefix"`
+}
+
+// extendedError is an Extended DNS Error option, RFC 8914
+type extendedError struct {
+	InfoCode uint16 `json:"info_code" msgpack:"info_code"`
+	Name     string `json:"name" msgpack:"name"`
+	Text     string `json:"text,omitempty" msgpack:"text,omitempty"`
+}
+
+// parseEDNS returns the EDNS information from the OPT record in the
+// additional section of msg, or nil if there isn't one.  Options which
+// don't parse are skipped rather than failing the whole record.
+func parseEDNS(msg layers.DNS) *ednsInfo {
+	for _, rr := range msg.Additionals {
+		if rr.Type != layers.DNSTypeOPT {
+			continue
+		}
+
+		//the class and TTL fields are reused for the EDNS header
+		edns := &ednsInfo{
+			UDPSize:       uint16(rr.Class),
+			ExtendedRcode: uint16(rr.TTL>>24)<<4 | uint16(msg.ResponseCode),
+			Version:       uint8(rr.TTL >> 16),
+			DO:            rr.TTL&0x8000 != 0,
+		}
+
+		for _, opt := range rr.OPT {
+			switch opt.Code {
+			case layers.DNSOptionCodeEDNSClientSubnet:
+				edns.ClientSubnet = parseClientSubnet(opt.Data)
+			case layers.DNSOptionCodeCookie:
+				if len(opt.Data) >= 8 {
+					edns.ClientCookie = hex.EncodeToString(opt.Data[:8])
+					edns.ServerCookie = hex.EncodeToString(opt.Data[8:])
+				}
+			case layers.DNSOptionCodeNSID:
+				edns.NSID = hex.EncodeToString(opt.Data)
+			case layers.DNSOptionCodePadding:
+				edns.PaddingLength = len(opt.Data)
+			case dnsOptionCodeExtendedError:
+				if len(opt.Data) >= 2 {
+					code := binary.BigEndian.Uint16(opt.Data[0:2])
+					edns.ExtendedErrors = append(edns.ExtendedErrors, extendedError{
+						InfoCode: code,
+						Name:     extendedErrorName(code),
+						Text:     string(opt.Data[2:]),
+					})
+				}
+			}
+		}
+		return edns
+	}
+	return nil
+}
+
+// parseClientSubnet decodes an ECS option.  The address is sent truncated to
+// the source prefix length, so it is padded back out to a full address.
+func parseClientSubnet(data []byte) *clientSubnet {
+	if len(data) < 4 {
+		return nil
+	}
+	ecs := &clientSubnet{
+		Family:       binary.BigEndian.Uint16(data[0:2]),
+		SourcePrefix: data[2],
+		ScopePrefix:  data[3],
+	}
+
+	var address net.IP
+	switch ecs.Family {
+	case 1:
+		address = make(net.IP, net.IPv4len)
+	case 2:
+		address = make(net.IP, net.IPv6len)
+	default:
+		return nil
+	}
+	if len(data)-4 > len(address) {
+		return nil
+	}
+	copy(address, data[4:])
+	ecs.Address = address.String()
+
+	return ecs
+}
+
+// extendedErrorName returns the IANA name for an Extended DNS Error info-code
+func extendedErrorName(code uint16) string {
+	switch code {
+	case 0:
+		return "Other Error"
+	case 1:
+		return "Unsupported DNSKEY Algorithm"
+	case 2:
+		return "Unsupported DS Digest Type"
+	case 3:
+		return "Stale Answer"
+	case 4:
+		return "Forged Answer"
+	case 5:
+		return "DNSSEC Indeterminate"
+	case 6:
+		return "DNSSEC Bogus"
+	case 7:
+		return "Signature Expired"
+	case 8:
+		return "Signature Not Yet Valid"
+	case 9:
+		return "DNSKEY Missing"
+	case 10:
+		return "RRSIGs Missing"
+	case 11:
+		return "No Zone Key Bit Set"
+	case 12:
+		return "NSEC Missing"
+	case 13:
+		return "Cached Error"
+	case 14:
+		return "Not Ready"
+	case 15:
+		return "Blocked"
+	case 16:
+		return "Censored"
+	case 17:
+		return "Filtered"
+	case 18:
+		return "Prohibited"
+	case 19:
+		return "Stale NXDomain Answer"
+	case 20:
+		return "Not Authoritative"
+	case 21:
+		return "Not Supported"
+	case 22:
+		return "No Reachable Authority"
+	case 23:
+		return "Network Error"
+	case 24:
+		return "Invalid Data"
+	case 25:
+		return "Signature Expired before Valid"
+	case 26:
+		return "Too Early"
+	case 27:
+		return "Unsupported NSEC3 Iterations Value"
+	case 28:
+		return "Unable to conform to policy"
+	case 29:
+		return "Synthesized"
+	default:
+		return "Unassigned"
+	}
+}
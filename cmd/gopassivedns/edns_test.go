@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestParseEDNS(t *testing.T) {
+	msg := layers.DNS{
+		ResponseCode: layers.DNSResponseCodeServFail,
+		Additionals: []layers.DNSResourceRecord{
+			{
+				Type:  layers.DNSTypeOPT,
+				Class: 1232,
+				TTL:   0x01008000, // extended rcode 1, version 0, DO
+				OPT: []layers.DNSOPT{
+					{Code: layers.DNSOptionCodeEDNSClientSubnet, Data: []byte{0, 1, 24, 0, 192, 0, 2}},
+					{Code: layers.DNSOptionCodeCookie, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}},
+					{Code: layers.DNSOptionCodeNSID, Data: []byte("ns1")},
+					{Code: layers.DNSOptionCodePadding, Data: make([]byte, 40)},
+					{Code: dnsOptionCodeExtendedError, Data: append([]byte{0, 6}, []byte("signature invalid")...)},
+				},
+			},
+		},
+	}
+
+	edns := parseEDNS(msg)
+	if edns == nil {
+		t.Fatal("no EDNS information parsed")
+	}
+
+	if edns.UDPSize != 1232 || edns.Version != 0 || !edns.DO {
+		t.Fatalf("Bad EDNS header %d %d %t", edns.UDPSize, edns.Version, edns.DO)
+	}
+
+	// the extended rcode is the top 8 bits on top of the 4 bit SERVFAIL
+	if edns.ExtendedRcode != 18 {
+		t.Fatalf("Bad extended rcode %d, expecting 18", edns.ExtendedRcode)
+	}
+
+	if edns.ClientSubnet == nil || edns.ClientSubnet.Address != "192.0.2.0" || edns.ClientSubnet.SourcePrefix != 24 || edns.ClientSubnet.Family != 1 {
+		t.Fatalf("Bad client subnet %+v", edns.ClientSubnet)
+	}
+
+	if edns.ClientCookie != "0102030405060708" || edns.ServerCookie != "090a0b0c0d0e0f10" {
+		t.Fatalf("Bad cookies %s %s", edns.ClientCookie, edns.ServerCookie)
+	}
+
+	if edns.NSID != "6e7331" {
+		t.Fatalf("Bad NSID %s", edns.NSID)
+	}
+
+	if edns.PaddingLength != 40 {
+		t.Fatalf("Bad padding length %d", edns.PaddingLength)
+	}
+
+	if len(edns.ExtendedErrors) != 1 || edns.ExtendedErrors[0].InfoCode != 6 ||
+		edns.ExtendedErrors[0].Name != "DNSSEC Bogus" || edns.ExtendedErrors[0].Text != "signature invalid" {
+		t.Fatalf("Bad extended errors %+v", edns.ExtendedErrors)
+	}
+
+	entry := DNSLogEntry{Server: net.ParseIP("192.0.2.53"), Client: net.ParseIP("192.0.2.1"), EDNS: edns}
+	encoded, err := entry.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(encoded), `"client_subnet":{"family":1,"address":"192.0.2.0","source_prefix":24,"scope_prefix":0}`) {
+		t.Fatalf("client subnet missing from %s", encoded)
+	}
+}
+
+func TestParseEDNSMissing(t *testing.T) {
+	if edns := parseEDNS(layers.DNS{}); edns != nil {
+		t.Fatalf("expected no EDNS information, got %+v", edns)
+	}
+}
+
+func TestParseClientSubnet(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "IPv4", data: []byte{0, 1, 24, 0, 198, 51, 100}, want: "198.51.100.0"},
+		{name: "IPv6", data: []byte{0, 2, 48, 0, 0x20, 0x01, 0x0d, 0xb8, 0, 1}, want: "2001:db8:1::"},
+		{name: "bad family", data: []byte{0, 3, 0, 0}, want: ""},
+		{name: "too long", data: []byte{0, 1, 32, 0, 1, 2, 3, 4, 5}, want: ""},
+		{name: "too short", data: []byte{0, 1}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			if ecs := parseClientSubnet(tt.data); ecs != nil {
+				got = ecs.Address
+			}
+			if got != tt.want {
+				t.Errorf("parseClientSubnet() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
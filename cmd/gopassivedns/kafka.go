@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// kafkaFlushFrequency is the longest a batch of log entries is held
+	// before being sent, even if it hasn't reached the batch size.
+	kafkaFlushFrequency time.Duration = 500 * time.Millisecond
+	kafkaConnectRetries int           = 10
+	kafkaConnectTimeout time.Duration = 5 * time.Second
+)
+
+// newKafkaConfig builds the producer configuration from the logging options.
+func newKafkaConfig(opts *logOptions) (*sarama.Config, error) {
+	conf := sarama.NewConfig()
+	conf.ClientID = "gopassivedns"
+
+	acks, err := kafkaAcksToType(opts.KafkaAcks)
+	if err != nil {
+		return nil, err
+	}
+	conf.Producer.RequiredAcks = acks
+
+	compression, err := kafkaCompressionToType(opts.KafkaCompression)
+	if err != nil {
+		return nil, err
+	}
+	conf.Producer.Compression = compression
+	if compression == sarama.CompressionZSTD {
+		// zstd was only added to the protocol in Kafka 2.1
+		conf.Version = sarama.V2_1_0_0
+	}
+
+	partitioner, err := kafkaPartitionKeyToType(opts.KafkaPartitionKey)
+	if err != nil {
+		return nil, err
+	}
+	conf.Producer.Partitioner = partitioner
+
+	conf.Producer.Retry.Max = opts.KafkaRetries
+	conf.Producer.Flush.Messages = opts.KafkaBatchSize
+	conf.Producer.Flush.Frequency = kafkaFlushFrequency
+	conf.Producer.Return.Errors = true
+	conf.Producer.Return.Successes = false
+
+	return conf, conf.Validate()
+}
+
+func kafkaAcksToType(acks string) (sarama.RequiredAcks, error) {
+	acks = strings.ToUpper(acks)
+	switch acks {
+	case "NONE", "0":
+		return sarama.NoResponse, nil
+	case "LOCAL", "1":
+		return sarama.WaitForLocal, nil
+	case "ALL", "-1":
+		return sarama.WaitForAll, nil
+	default:
+		return 0, fmt.Errorf("invalid kafka acks: %s", acks)
+	}
+}
+
+func kafkaCompressionToType(compression string) (sarama.CompressionCodec, error) {
+	compression = strings.ToUpper(compression)
+	switch compression {
+	case "NONE", "":
+		return sarama.CompressionNone, nil
+	case "GZIP":
+		return sarama.CompressionGZIP, nil
+	case "SNAPPY":
+		return sarama.CompressionSnappy, nil
+	case "LZ4":
+		return sarama.CompressionLZ4, nil
+	case "ZSTD":
+		return sarama.CompressionZSTD, nil
+	default:
+		return 0, fmt.Errorf("invalid kafka compression: %s", compression)
+	}
+}
+
+// kafkaPartitionKeyToType returns the partitioner for a partition key, random
+// without one so messages are spread evenly
+func kafkaPartitionKeyToType(key string) (sarama.PartitionerConstructor, error) {
+	switch strings.ToUpper(key) {
+	case "":
+		return sarama.NewRandomPartitioner, nil
+	case "CLIENT", "SENSOR":
+		return sarama.NewHashPartitioner, nil
+	default:
+		return nil, fmt.Errorf("invalid kafka partition key: %s", key)
+	}
+}
+
+// kafkaMessageKey returns the partition key for a log entry, or nil when
+// messages should be spread randomly across partitions.
+func kafkaMessageKey(message *DNSLogEntry, opts *logOptions) sarama.Encoder {
+	switch strings.ToUpper(opts.KafkaPartitionKey) {
+	case "CLIENT":
+		return sarama.StringEncoder(message.Client.String())
+	case "SENSOR":
+		return sarama.StringEncoder(opts.SensorName)
+	default:
+		return nil
+	}
+}
+
+func kafkaBrokers(brokers string) []string {
+	var ret []string
+	for _, broker := range strings.Split(brokers, ",") {
+		broker = strings.TrimSpace(broker)
+		if broker != "" {
+			ret = append(ret, broker)
+		}
+	}
+	return ret
+}
+
+func kafkaProducer(brokers []string, conf *sarama.Config) sarama.AsyncProducer {
+	// we want to have retries because the brokers may not be reachable yet.
+	for i := 1; i <= kafkaConnectRetries; i++ {
+		producer, err := sarama.NewAsyncProducer(brokers, conf)
+		if err != nil {
+			log.Printf("Failed to connect to kafka brokers %s. %s retrying in %s.", strings.Join(brokers, ","), err, kafkaConnectTimeout)
+			time.Sleep(kafkaConnectTimeout)
+			continue
+		}
+		return producer
+	}
+
+	log.Fatalf("Unable to connect to kafka brokers after %d retries\n", kafkaConnectRetries)
+
+	return nil
+}
+
+// watchKafkaErrors reports failed deliveries until the producer is closed.
+func watchKafkaErrors(errs <-chan *sarama.ProducerError, stats metrics, done chan bool) {
+	for err := range errs {
+		log.Debugf("kafka delivery to topic %s failed: %s", err.Msg.Topic, err.Err)
+		if stats != nil {
+			stats.Incr("kafka_delivery_errors", 1)
+		}
+	}
+	done <- true
+}
+
+// logs to kafka
+func logConnKafka(logC chan DNSLogEntry, opts *logOptions, stats metrics) {
+	conf, err := newKafkaConfig(opts)
+	if err != nil {
+		log.Fatalf("invalid kafka configuration: %s", err)
+	}
+
+	producer := kafkaProducer(kafkaBrokers(opts.KafkaBrokers), conf)
+
+	done := make(chan bool)
+	go watchKafkaErrors(producer.Errors(), stats, done)
+
+	for message := range logC {
+		encoded, err := message.Encode()
+		if err != nil {
+			log.Debugf("unable to encode log entry for kafka: %s", err)
+			continue
+		}
+
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic: opts.KafkaTopic,
+			Key:   kafkaMessageKey(&message, opts),
+			Value: sarama.ByteEncoder(encoded),
+		}
+	}
+
+	// flush anything still batched before returning
+	producer.AsyncClose()
+	<-done
+}
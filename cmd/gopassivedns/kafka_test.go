@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+)
+
+func TestKafkaAcksToType(t *testing.T) {
+	m := make(map[string]sarama.RequiredAcks)
+
+	m["none"] = sarama.NoResponse
+	m["LOCAL"] = sarama.WaitForLocal
+	m["all"] = sarama.WaitForAll
+	m["-1"] = sarama.WaitForAll
+
+	for k, v := range m {
+		acks, err := kafkaAcksToType(k)
+		if acks != v || err != nil {
+			t.Fatalf("acks %s did not parse as %d", k, v)
+		}
+	}
+
+	if _, err := kafkaAcksToType("some"); err == nil {
+		t.Fatal("acks 'some' did not return an error")
+	}
+}
+
+func TestKafkaCompressionToType(t *testing.T) {
+	m := make(map[string]sarama.CompressionCodec)
+
+	m[""] = sarama.CompressionNone
+	m["gzip"] = sarama.CompressionGZIP
+	m["SNAPPY"] = sarama.CompressionSnappy
+	m["lz4"] = sarama.CompressionLZ4
+	m["zstd"] = sarama.CompressionZSTD
+
+	for k, v := range m {
+		codec, err := kafkaCompressionToType(k)
+		if codec != v || err != nil {
+			t.Fatalf("compression %s did not parse as %s", k, v)
+		}
+	}
+
+	if _, err := kafkaCompressionToType("brotli"); err == nil {
+		t.Fatal("compression 'brotli' did not return an error")
+	}
+}
+
+func TestNewKafkaConfigBadPartitionKey(t *testing.T) {
+	_, err := newKafkaConfig(&logOptions{KafkaAcks: "local", KafkaPartitionKey: "qname", KafkaBatchSize: 1})
+	if err == nil {
+		t.Fatal("newKafkaConfig did not fail with an invalid partition key")
+	}
+}
+
+func TestKafkaMessageKey(t *testing.T) {
+	message := &DNSLogEntry{Client: net.ParseIP("10.1.1.1")}
+
+	key := kafkaMessageKey(message, &logOptions{KafkaPartitionKey: "client"})
+	if key == nil || string(key.(sarama.StringEncoder)) != "10.1.1.1" {
+		t.Fatalf("expected client key 10.1.1.1, got %v", key)
+	}
+
+	key = kafkaMessageKey(message, &logOptions{KafkaPartitionKey: "sensor", SensorName: "sensor1"})
+	if key == nil || string(key.(sarama.StringEncoder)) != "sensor1" {
+		t.Fatalf("expected sensor key sensor1, got %v", key)
+	}
+
+	if key = kafkaMessageKey(message, &logOptions{}); key != nil {
+		t.Fatalf("expected no key for random partitioning, got %v", key)
+	}
+}
+
+func TestKafkaBrokers(t *testing.T) {
+	brokers := kafkaBrokers("10.0.0.1:9092, 10.0.0.2:9092,,")
+	if len(brokers) != 2 || brokers[0] != "10.0.0.1:9092" || brokers[1] != "10.0.0.2:9092" {
+		t.Fatalf("unexpected broker list %v", brokers)
+	}
+}
+
+func TestLogConnKafka(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader("pdns", 0, broker.BrokerID()),
+		"ProduceRequest": sarama.NewMockProduceResponse(t),
+	})
+
+	opts := &logOptions{
+		KafkaBrokers:      broker.Addr(),
+		KafkaTopic:        "pdns",
+		KafkaAcks:         "local",
+		KafkaCompression:  "gzip",
+		KafkaPartitionKey: "client",
+		KafkaRetries:      3,
+		KafkaBatchSize:    10,
+	}
+
+	var logChan = make(chan DNSLogEntry)
+	var done = make(chan bool)
+
+	go func() {
+		logConnKafka(logChan, opts, stats)
+		done <- true
+	}()
+
+	for i := 0; i < 25; i++ {
+		logChan <- DNSLogEntry{
+			QueryID:  uint16(i),
+			Question: "www.example.com",
+			Client:   net.ParseIP("10.1.1.1"),
+			Server:   net.ParseIP("10.2.2.2"),
+		}
+	}
+	close(logChan)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("logConnKafka did not flush and exit")
+	}
+
+	var produced int
+	for _, rr := range broker.History() {
+		if _, ok := rr.Request.(*sarama.ProduceRequest); ok {
+			produced++
+		}
+	}
+
+	if produced == 0 {
+		t.Fatal("mock broker did not receive any produce requests")
+	}
+}
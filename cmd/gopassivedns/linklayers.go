@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// linkTypeLinuxSLL2 is LINKTYPE_LINUX_SLL2, the cooked capture header newer
+// versions of tcpdump write for the any device.  It is 276, but gopacket's
+// LinkType is a uint8 so that is how it arrives from pcap.
+const linkTypeLinuxSLL2 layers.LinkType = 276 & 0xff
+
+// the layers gopacket doesn't have
+var (
+	layerTypeLinuxSLL2 = gopacket.RegisterLayerType(1000, gopacket.LayerTypeMetadata{Name: "LinuxSLL2", Decoder: gopacket.DecodeFunc(decodeLinuxSLL2)})
+	layerTypeRawIP     = gopacket.RegisterLayerType(1001, gopacket.LayerTypeMetadata{Name: "RawIP", Decoder: gopacket.DecodeFunc(decodeRawIP)})
+)
+
+// linkLayers decodes the link layer headers, VLAN tags and MPLS labels in front
+// of the IP header, whichever link type the packets were captured with
+type linkLayers struct {
+	ethernet layers.Ethernet
+	sll      layers.LinuxSLL
+	sll2     linuxSLL2
+	loopback layers.Loopback
+	raw      rawIP
+	vlans    dot1QStack
+	mpls     mplsLabel
+}
+
+// firstLayerType returns the layer packets captured with linkType start with
+func firstLayerType(linkType layers.LinkType) (gopacket.LayerType, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return layers.LayerTypeEthernet, nil
+	case layers.LinkTypeLinuxSLL:
+		return layers.LayerTypeLinuxSLL, nil
+	case linkTypeLinuxSLL2:
+		return layerTypeLinuxSLL2, nil
+	case layers.LinkTypeNull, dltLoop:
+		return layers.LayerTypeLoopback, nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6, dltRaw:
+		return layerTypeRawIP, nil
+	default:
+		return layers.LayerTypeEthernet, fmt.Errorf("unsupported link type %s", linkType)
+	}
+}
+
+// decodingLayers returns the link layer decoders, for a DecodingLayerParser
+func (l *linkLayers) decodingLayers() []gopacket.DecodingLayer {
+	return []gopacket.DecodingLayer{&l.ethernet, &l.sll, &l.sll2, &l.loopback, &l.raw, &l.vlans, &l.mpls}
+}
+
+// reset forgets the VLAN tags of the last packet, it must be called before
+// decoding each packet
+func (l *linkLayers) reset() {
+	l.vlans.ids = l.vlans.ids[:0]
+}
+
+// dot1QStack decodes 802.1Q tags, keeping the VLAN ID of each one so both the
+// outer and inner tags of QinQ are recorded, outermost first
+type dot1QStack struct {
+	layers.Dot1Q
+	ids []uint16
+}
+
+func (d *dot1QStack) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if err := d.Dot1Q.DecodeFromBytes(data, df); err != nil {
+		return err
+	}
+	d.ids = append(d.ids, d.VLANIdentifier)
+	return nil
+}
+
+// mplsLabel decodes one MPLS label, the parser comes back to it for each label
+// in the stack.  MPLS doesn't say what it carries, so after the last label the
+// IP version is taken from the payload.
+type mplsLabel struct {
+	layers.BaseLayer
+	next gopacket.LayerType
+}
+
+func (m *mplsLabel) CanDecode() gopacket.LayerClass {
+	return layers.LayerTypeMPLS
+}
+
+func (m *mplsLabel) NextLayerType() gopacket.LayerType {
+	return m.next
+}
+
+func (m *mplsLabel) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 4 {
+		df.SetTruncated()
+		return errors.New("MPLS label too short")
+	}
+	m.BaseLayer = layers.BaseLayer{Contents: data[:4], Payload: data[4:]}
+	m.next = layers.LayerTypeMPLS
+	//the bottom of stack bit is set on the last label
+	if binary.BigEndian.Uint32(data[:4])&0x100 != 0 {
+		m.next = ipLayerType(data[4:])
+	}
+	return nil
+}
+
+// linuxSLL2 decodes a LINKTYPE_LINUX_SLL2 header, which unlike the first
+// version says which interface the packet was captured on
+type linuxSLL2 struct {
+	layers.BaseLayer
+	protocol layers.EthernetType
+	ifindex  int
+}
+
+func (s *linuxSLL2) LayerType() gopacket.LayerType {
+	return layerTypeLinuxSLL2
+}
+
+func (s *linuxSLL2) CanDecode() gopacket.LayerClass {
+	return layerTypeLinuxSLL2
+}
+
+func (s *linuxSLL2) NextLayerType() gopacket.LayerType {
+	return s.protocol.LayerType()
+}
+
+func (s *linuxSLL2) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	if len(data) < 20 {
+		df.SetTruncated()
+		return errors.New("Linux SLL2 header too short")
+	}
+	s.protocol = layers.EthernetType(binary.BigEndian.Uint16(data[0:2]))
+	s.ifindex = int(binary.BigEndian.Uint32(data[4:8]))
+	s.BaseLayer = layers.BaseLayer{Contents: data[:20], Payload: data[20:]}
+	return nil
+}
+
+func decodeLinuxSLL2(data []byte, p gopacket.PacketBuilder) error {
+	sll2 := &linuxSLL2{}
+	if err := sll2.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(sll2)
+	return p.NextDecoder(sll2.NextLayerType())
+}
+
+// rawIP is the empty link layer of raw IP captures, where the packet starts
+// with an IPv4 or IPv6 header
+type rawIP struct {
+	layers.BaseLayer
+	next gopacket.LayerType
+}
+
+func (r *rawIP) LayerType() gopacket.LayerType {
+	return layerTypeRawIP
+}
+
+func (r *rawIP) CanDecode() gopacket.LayerClass {
+	return layerTypeRawIP
+}
+
+func (r *rawIP) NextLayerType() gopacket.LayerType {
+	return r.next
+}
+
+func (r *rawIP) DecodeFromBytes(data []byte, df gopacket.DecodeFeedback) error {
+	r.BaseLayer = layers.BaseLayer{Payload: data}
+	r.next = ipLayerType(data)
+	return nil
+}
+
+func decodeRawIP(data []byte, p gopacket.PacketBuilder) error {
+	raw := &rawIP{}
+	if err := raw.DecodeFromBytes(data, p); err != nil {
+		return err
+	}
+	p.AddLayer(raw)
+	return p.NextDecoder(raw.NextLayerType())
+}
+
+// ipLayerType returns the IP layer data starts with, from the version field
+func ipLayerType(data []byte) gopacket.LayerType {
+	if len(data) == 0 {
+		return gopacket.LayerTypePayload
+	}
+	switch data[0] >> 4 {
+	case 4:
+		return layers.LayerTypeIPv4
+	case 6:
+		return layers.LayerTypeIPv6
+	default:
+		return gopacket.LayerTypePayload
+	}
+}
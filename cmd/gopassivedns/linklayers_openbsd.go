@@ -0,0 +1,10 @@
+package main
+
+import "github.com/google/gopacket/layers"
+
+// libpcap gives captures the DLT value of their link type rather than its
+// LINKTYPE value, and OpenBSD numbers these two differently to everyone else
+const (
+	dltLoop layers.LinkType = 12
+	dltRaw  layers.LinkType = 14
+)
@@ -0,0 +1,13 @@
+//go:build !openbsd
+// +build !openbsd
+
+package main
+
+import "github.com/google/gopacket/layers"
+
+// libpcap gives captures the DLT value of their link type rather than its
+// LINKTYPE value.  DLT_LOOP is the same as LINKTYPE_LOOP, but DLT_RAW is 12.
+const (
+	dltLoop layers.LinkType = layers.LinkTypeLoop
+	dltRaw  layers.LinkType = 12
+)
@@ -7,51 +7,59 @@ import (
 	"log/syslog"
 	"net"
 
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/gopacket/layers"
 	"github.com/pquerna/ffjson/ffjson"
 	log "github.com/sirupsen/logrus"
-	"github.com/smira/go-statsd"
 	"github.com/vmihailenco/msgpack/v5"
 	lumberjack "gopkg.in/natefinch/lumberjack.v2"
 )
 
 // codebeat:disable[TOO_MANY_IVARS]
 type logOptions struct {
-	quiet          bool
-	debug          bool
-	Filename       string
-	FluentdSocket  string
-	MaxAge         int
-	MaxBackups     int
-	MaxSize        int
-	KafkaBrokers   string
-	KafkaTopic     string
-	SyslogFacility string
-	SyslogPriority string
-	SensorName     string
-	closed         bool
-	control        chan string
+	quiet             bool
+	debug             bool
+	Filename          string
+	FluentdSocket     string
+	MaxAge            int
+	MaxBackups        int
+	MaxSize           int
+	KafkaBrokers      string
+	KafkaTopic        string
+	KafkaAcks         string
+	KafkaCompression  string
+	KafkaPartitionKey string
+	KafkaRetries      int
+	KafkaBatchSize    int
+	SyslogFacility    string
+	SyslogPriority    string
+	SensorName        string
+	closed            bool
+	control           chan string
 }
 
 // newLogOptions returns the logging configuration
 func newLogOptions(config *pdnsConfig) *logOptions {
 	return &logOptions{
-		quiet:          config.quiet,
-		debug:          config.debug,
-		Filename:       config.logFile,
-		FluentdSocket:  config.fluentdSocket,
-		KafkaBrokers:   config.kafkaBrokers,
-		KafkaTopic:     config.kafkaTopic,
-		MaxAge:         config.logMaxAge,
-		MaxSize:        config.logMaxSize,
-		MaxBackups:     config.logMaxBackups,
-		SyslogFacility: config.syslogFacility,
-		SyslogPriority: config.syslogPriority,
-		SensorName:     config.sensorName,
+		quiet:             config.quiet,
+		debug:             config.debug,
+		Filename:          config.logFile,
+		FluentdSocket:     config.fluentdSocket,
+		KafkaBrokers:      config.kafkaBrokers,
+		KafkaTopic:        config.kafkaTopic,
+		KafkaAcks:         config.kafkaAcks,
+		KafkaCompression:  config.kafkaCompression,
+		KafkaPartitionKey: config.kafkaPartitionKey,
+		KafkaRetries:      config.kafkaRetries,
+		KafkaBatchSize:    config.kafkaBatchSize,
+		MaxAge:            config.logMaxAge,
+		MaxSize:           config.logMaxSize,
+		MaxBackups:        config.logMaxBackups,
+		SyslogFacility:    config.syslogFacility,
+		SyslogPriority:    config.syslogPriority,
+		SensorName:        config.sensorName,
 	}
 }
 
@@ -68,7 +76,7 @@ func (lo *logOptions) LogToFile() bool {
 }
 
 func (lo *logOptions) LogToKafka() bool {
-	return !(lo.KafkaBrokers == "" && lo.KafkaTopic == "")
+	return (lo.KafkaBrokers != "" && lo.KafkaTopic != "")
 }
 
 func (lo *logOptions) LogToSyslog() bool {
@@ -92,24 +100,111 @@ type DNSLogEntry struct {
 	Server              net.IP                 `json:"dst"`
 	Client              net.IP                 `json:"src"`
 	Timestamp           string                 `json:"tstamp"`
-	Elapsed             int64                  `json:"elapsed"`
+	Elapsed             int64                  `json:"elapsed"` // nanoseconds between the query and response being captured
 	ClientPort          uint16                 `json:"sport"`
 	Level               string                 `json:"level"` // syslog level
 	Length              int                    `json:"bytes"` // kept for legacy reasons
 	Proto               string                 `json:"protocol"`
+	Interface           string                 `json:"interface,omitempty"` // where the query was captured, empty when reading a pcap
+	VLANs               []uint16               `json:"vlan,omitempty"`      // the query's 802.1Q VLAN IDs, outermost first
+	Tunnel              *tunnelInfo            `json:"tunnel,omitempty"`    // the tunnel the query was decapsulated from
 	Truncated           bool                   `json:"truncated"`
 	AuthoritativeAnswer bool                   `json:"aa"`
 	RecursionDesired    bool                   `json:"rd"`
 	RecursionAvailable  bool                   `json:"ra"`
-	ResponseSz          uint16                 `json:"response_size"` // response size
-	QuestionSz          uint16                 `json:"question_size"` // question size
+	ResponseSz          uint16                 `json:"response_size"`        // response size
+	QuestionSz          uint16                 `json:"question_size"`        // question size
+	Section             string                 `json:"section"`              // answer, authority or additional
+	RData               rdata                  `json:"rdata,omitempty"`      // structured answer, only set when enabled
+	EDNS                *ednsInfo              `json:"edns,omitempty"`       // from the response
+	QueryEDNS           *ednsInfo              `json:"query_edns,omitempty"` // from the query, this is where ECS is usually found
 	Additionals         bool                   `json:"additionals"`
+	ProcessingLag       int64                  `json:"processing_lag"` // nanoseconds between the response being captured and logged
 	encoded             []byte                 //to hold the marshaled data structure
 	err                 error                  //encoding errors
 }
 
 // codebeat:enable[TOO_MANY_IVARS]
 
+// logSections selects which sections of a response are logged
+type logSections uint8
+
+const (
+	logAnswers logSections = 1 << iota
+	logAuthorities
+	logAdditionals
+)
+
+// the section names used in log entries and the log_sections option
+const (
+	answerSection     string = "answer"
+	authoritySection  string = "authority"
+	additionalSection string = "additional"
+)
+
+func (ls logSections) has(section logSections) bool {
+	return ls&section != 0
+}
+
+// logEntryOptions controls what goes into each DNSLogEntry
+type logEntryOptions struct {
+	sections        logSections
+	rdata           bool // add the structured rdata object to each entry
+	timestampFormat timestampFormat
+	mismatches      bool // log queries whose response has another question as MISMATCH
+}
+
+// timestampFormat is how the capture time is written to tstamp
+type timestampFormat uint8
+
+const (
+	timestampRFC3339 timestampFormat = iota // RFC 3339 with nanoseconds, in UTC
+	timestampEpoch                          // seconds since the epoch with nanoseconds
+)
+
+// parseTimestampFormat converts the timestamp_format option into a timestampFormat
+func parseTimestampFormat(format string) (timestampFormat, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "rfc3339":
+		return timestampRFC3339, nil
+	case "epoch":
+		return timestampEpoch, nil
+	default:
+		return 0, fmt.Errorf("invalid timestamp format: %s", format)
+	}
+}
+
+// format returns t as a tstamp string
+func (tf timestampFormat) format(t time.Time) string {
+	if tf == timestampEpoch {
+		return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// parseLogSections converts a comma separated list of section names, e.g.
+// "answer,authority", into logSections. An empty list logs the answers only.
+func parseLogSections(sections string) (logSections, error) {
+	if strings.TrimSpace(sections) == "" {
+		return logAnswers, nil
+	}
+
+	var parsed logSections
+	for _, section := range strings.Split(sections, ",") {
+		switch strings.ToLower(strings.TrimSpace(section)) {
+		case answerSection:
+			parsed |= logAnswers
+		case authoritySection:
+			parsed |= logAuthorities
+		case additionalSection:
+			parsed |= logAdditionals
+		default:
+			return 0, fmt.Errorf("invalid section: %s", section)
+		}
+	}
+	return parsed, nil
+}
+
 // private, idempotent function that ensures the json is encoded
 func (dle *DNSLogEntry) ensureEncoded() {
 	if dle.encoded == nil && dle.err == nil {
@@ -143,75 +238,153 @@ func initLogging(opts *logOptions, config *pdnsConfig) chan DNSLogEntry {
 
 }
 
-func watchLogStats(stats *statsd.Client, logC chan DNSLogEntry, logs []chan DNSLogEntry) {
-	for {
-		stats.Gauge("incoming_log_depth", int64(len(logC)))
-		for i, logChan := range logs {
-			stats.Gauge(strconv.Itoa(i)+".log_depth", int64(len(logChan)))
-		}
+// logSink is the channel feeding one of the log outputs, and the options it
+// was started with
+type logSink struct {
+	name string
+	c    chan DNSLogEntry
+	opts *logOptions
+}
 
-		time.Sleep(15 * time.Second)
+// the log sinks, in the order they are started
+var logSinkNames = []string{"stdout", "file", "kafka", "syslog", "fluentd"}
+
+func watchLogStats(stats metrics, logC chan DNSLogEntry, logs []logSink) {
+	stats.Gauge("incoming_log_depth", int64(len(logC)))
+	for _, sink := range logs {
+		stats.Gauge("log_depth", int64(len(sink.c)), metricTag{name: "sink", value: sink.name})
 	}
 }
 
-// Spin up required logging threads and then round-robin log messages to log sinks
-func logConn(logC chan DNSLogEntry, opts *logOptions, stats *statsd.Client) {
+// Spin up required logging threads and then round-robin log messages to log sinks.
+// The sinks whose options change are torn down and rebuilt when new options arrive on reload.
+func logConn(logC chan DNSLogEntry, opts *logOptions, stats metrics, reload chan *logOptions) {
 
 	//holds the channels for the outgoing log channels
-	var logs []chan DNSLogEntry
+	logs := startLogSinks(opts, stats)
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
 
-	if opts.LogToStdout() {
-		log.Debug("STDOUT logging enabled")
-		stdoutChan := make(chan DNSLogEntry)
-		logs = append(logs, stdoutChan)
-		go logConnStdout(stdoutChan)
+	//setup is done, now we sit here and dispatch messages to the configured sinks
+	for {
+		select {
+		case message, more := <-logC:
+			if !more {
+				//the channel was closed, so close the other channels
+				closeLogSinks(logs)
+				return
+			}
+			for _, sink := range logs {
+				sink.c <- message
+			}
+		case newOpts := <-reload:
+			logs = reloadLogSinks(logs, newOpts, stats)
+		case <-ticker.C:
+			if stats != nil {
+				watchLogStats(stats, logC, logs)
+			}
+		}
 	}
+}
 
-	if opts.LogToFile() {
-		log.Debug("file logging enabled to " + opts.Filename)
-		fileChan := make(chan DNSLogEntry)
-		logs = append(logs, fileChan)
-		go logConnFile(fileChan, opts)
+// sinkOptions returns the options the sink name is started with, leaving out
+// everything else, and whether opts enables the sink at all
+func sinkOptions(name string, opts *logOptions) (logOptions, bool) {
+	switch name {
+	case "stdout":
+		return logOptions{}, opts.LogToStdout()
+	case "file":
+		return logOptions{Filename: opts.Filename, MaxAge: opts.MaxAge, MaxBackups: opts.MaxBackups, MaxSize: opts.MaxSize}, opts.LogToFile()
+	case "kafka":
+		return logOptions{
+			KafkaBrokers:      opts.KafkaBrokers,
+			KafkaTopic:        opts.KafkaTopic,
+			KafkaAcks:         opts.KafkaAcks,
+			KafkaCompression:  opts.KafkaCompression,
+			KafkaPartitionKey: opts.KafkaPartitionKey,
+			KafkaRetries:      opts.KafkaRetries,
+			KafkaBatchSize:    opts.KafkaBatchSize,
+			SensorName:        opts.SensorName,
+		}, opts.LogToKafka()
+	case "syslog":
+		return logOptions{SyslogFacility: opts.SyslogFacility, SyslogPriority: opts.SyslogPriority}, opts.LogToSyslog()
+	case "fluentd":
+		return logOptions{FluentdSocket: opts.FluentdSocket, SensorName: opts.SensorName}, opts.LogToFluentd()
+	default:
+		return logOptions{}, false
 	}
+}
 
-	if opts.LogToKafka() {
-		log.Debug("kafka logging enabled")
-		kafkaChan := make(chan DNSLogEntry)
-		logs = append(logs, kafkaChan)
-		go logConnKafka(kafkaChan, opts)
+// startLogSinks spins up a goroutine for each configured sink and returns their channels
+func startLogSinks(opts *logOptions, stats metrics) []logSink {
+	var logs []logSink
+	for _, name := range logSinkNames {
+		if _, enabled := sinkOptions(name, opts); enabled {
+			logs = append(logs, startLogSink(name, opts, stats))
+		}
 	}
+	return logs
+}
 
-	if opts.LogToSyslog() {
-		log.Debug("syslog logging enabled")
-		syslogChan := make(chan DNSLogEntry)
-		logs = append(logs, syslogChan)
-		go logConnSyslog(syslogChan, opts)
-	}
+// startLogSink spins up the goroutine for the sink name
+func startLogSink(name string, opts *logOptions, stats metrics) logSink {
+	sinkChan := make(chan DNSLogEntry)
 
-	if opts.LogToFluentd() {
+	switch name {
+	case "stdout":
+		log.Debug("STDOUT logging enabled")
+		go logConnStdout(sinkChan)
+	case "file":
+		log.Debug("file logging enabled to " + opts.Filename)
+		go logConnFile(sinkChan, opts)
+	case "kafka":
+		log.Debug("kafka logging enabled")
+		go logConnKafka(sinkChan, opts, stats)
+	case "syslog":
+		log.Debug("syslog logging enabled")
+		go logConnSyslog(sinkChan, opts)
+	case "fluentd":
 		log.Debug("fluentd logging enabled")
-		fluentdlogChan := make(chan DNSLogEntry)
-		logs = append(logs, fluentdlogChan)
-		go logConnFluentd(fluentdlogChan, opts)
+		go logConnFluentd(sinkChan, opts)
 	}
 
-	if stats != nil {
-		go watchLogStats(stats, logC, logs)
+	return logSink{name: name, c: sinkChan, opts: opts}
+}
+
+// reloadLogSinks restarts the sinks whose options are different in newOpts,
+// starts the sinks it enables and closes the ones it disables.  The other
+// sinks keep running, so a reload doesn't reconnect to Kafka or fluentd
+// unless their settings have changed.
+func reloadLogSinks(logs []logSink, newOpts *logOptions, stats metrics) []logSink {
+	running := make(map[string]logSink)
+	for _, sink := range logs {
+		running[sink.name] = sink
 	}
 
-	//setup is done, now we sit here and dispatch messages to the configured sinks
-	for message := range logC {
-		for _, logChan := range logs {
-			logChan <- message
+	var reloaded []logSink
+	for _, name := range logSinkNames {
+		newSettings, enabled := sinkOptions(name, newOpts)
+		if sink, found := running[name]; found {
+			if settings, _ := sinkOptions(name, sink.opts); enabled && settings == newSettings {
+				reloaded = append(reloaded, sink)
+				continue
+			}
+			log.Printf("Closing the %s log sink.", name)
+			close(sink.c)
+		}
+		if enabled {
+			log.Printf("Starting the %s log sink.", name)
+			reloaded = append(reloaded, startLogSink(name, newOpts, stats))
 		}
 	}
+	return reloaded
+}
 
-	//if the range exits, the channel was closed, so close the other channels
-	for _, logChan := range logs {
-		close(logChan)
+// closing a sink's channel makes it flush and exit
+func closeLogSinks(logs []logSink) {
+	for _, sink := range logs {
+		close(sink.c)
 	}
-
-	return
 }
 
 // logs to stdout
@@ -232,25 +405,18 @@ func logConnFile(logC chan DNSLogEntry, opts *logOptions) {
 		MaxAge:     opts.MaxAge, //days
 	}
 
-	enc := ffjson.NewEncoder(bufio.NewWriter(logger))
+	writer := bufio.NewWriter(logger)
+	enc := ffjson.NewEncoder(writer)
 
 	for message := range logC {
 		enc.Encode(message)
 	}
 
+	writer.Flush()
 	logger.Close()
 
 }
 
-// logs to kafka
-func logConnKafka(logC chan DNSLogEntry, opts *logOptions) {
-	for message := range logC {
-		encoded, _ := message.Encode()
-		fmt.Println("Kafka: " + string(encoded))
-
-	}
-}
-
 // logs to syslog
 func logConnSyslog(logC chan DNSLogEntry, opts *logOptions) {
 
@@ -272,6 +438,8 @@ func logConnSyslog(logC chan DNSLogEntry, opts *logOptions) {
 		encoded, _ := message.Encode()
 		logger.Write([]byte(encoded))
 	}
+
+	logger.Close()
 }
 
 // logs to fluentd via a unix socket
@@ -1,25 +1,25 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
-	"io"
 	"net"
 	"os"
 	"os/signal"
 	"runtime/pprof"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	dnstap "github.com/dnstap/golang-dnstap"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/tcpassembly"
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 	log "github.com/sirupsen/logrus"
-	"github.com/smira/go-statsd"
 )
 
 const (
@@ -29,95 +29,166 @@ const (
 	udpString    string = "udp"
 	tcpString    string = "tcp"
 	packetString string = "packet"
-)
-
-var (
-	// global channel to recieve reassembled TCP streams
-	// consumed in doCapture. THis is global because the interface in gopacket
-	// doesn't initiate or have an
-	reassemblerChan chan TCPDataStruct
+	// logged as the answer for queries the conntable GC removes unanswered
+	noAnswerString string = "NOANSWER"
+	// logged as the answer for queries whose response asked another question
+	mismatchString string = "MISMATCH"
 )
 
 // DNSMapEntry for DNS connection table entry
-// the 'inserted' value is used in connection table cleanup
+// the 'inserted' value is used in connection table cleanup, the addresses
+// are kept so an unanswered query can still be logged when it is cleaned up
 type DNSMapEntry struct {
 	entry    layers.DNS
 	inserted time.Time
-}
-
-// connectionTable stores the connection table
-type connectionTable struct {
-	connections map[string]DNSMapEntry
-	sync.RWMutex
+	srcIP    net.IP
+	dstIP    net.IP
+	srcPort  uint16
+	dstPort  uint16
+	length   int
+	protocol string
+	ingress  ingressInfo
 }
 
 // TCPDataStruct struct to store reassembled TCP streams
+// one of these is made for every DNS message on the stream
 type TCPDataStruct struct {
-	DNSData []byte
-	IPLayer gopacket.Flow
-	Length  int
+	DNSData   []byte
+	IPLayer   gopacket.Flow
+	Transport gopacket.Flow // the TCP ports
+	Length    int           // the length of the DNS message
+	Size      int           // the on-wire length of the segments that carried the message, like a UDP packet's
+	FirstSeen time.Time     // capture time of the segment holding the first byte of the message
+	LastSeen  time.Time     // capture time of the segment that completed the message
+	Ingress   ingressInfo   // where the stream's first segment was captured
 }
 
-// TCP reassembly stuff, all the work is done in run()
+// TCP reassembly stuff, all the work is done in Reassembled()
 //
-type dnsStreamFactory struct{}
+// dnsStreamFactory makes the streams for one packet processing thread. Before
+// each packet is assembled, ingress is set to where it was captured, so a new
+// stream knows where its first segment was captured, and overhead to its
+// on-wire length less the TCP payload.  The streams are called back from the
+// assembler on the same thread, which handles every message they frame with
+// handle.
+type dnsStreamFactory struct {
+	ingress  ingressInfo
+	overhead int
+	handle   func(TCPDataStruct)
+}
 
 type dnsStream struct {
 	net, transport gopacket.Flow
-	r              tcpreader.ReaderStream
+	ingress        ingressInfo
+	factory        *dnsStreamFactory
+	framer         dnsFramer
 }
 
 func (d *dnsStreamFactory) New(net, transport gopacket.Flow) tcpassembly.Stream {
-	dstream := &dnsStream{
+	return &dnsStream{
 		net:       net,
 		transport: transport,
-		r:         tcpreader.NewReaderStream(),
+		ingress:   d.ingress,
+		factory:   d,
 	}
-	go dstream.run() // Important... we must guarantee that data from the reader stream is read.
+}
 
-	// ReaderStream implements tcpassembly.Stream, so we can return a pointer to it.
-	return &dstream.r
+// Reassembled is called by the assembler with the stream data in order, and
+// hands every DNS message on the half-stream on as soon as it is complete, so
+// pipelined queries and answers (RFC 7766) on one connection are all seen.
+// Each direction of a connection is its own dnsStream.  The framer copies the
+// data, as the assembler reuses the buffers once we return.
+func (d *dnsStream) Reassembled(reassembly []tcpassembly.Reassembly) {
+	for _, r := range reassembly {
+		if r.Skip != 0 && !d.framer.lost {
+			log.Debugf("Lost TCP data on %s %s, ignoring the rest of the stream", d.net, d.transport)
+			d.framer.lost = true
+		}
+		if len(r.Bytes) == 0 {
+			continue
+		}
+		//segments which arrived out of order are counted with the headers of
+		//the packet that filled the gap, they are almost always the same size
+		for _, frame := range d.framer.push(r.Bytes, r.Seen, len(r.Bytes)+d.factory.overhead) {
+			d.factory.handle(TCPDataStruct{
+				DNSData:   frame.data,
+				IPLayer:   d.net,
+				Transport: d.transport,
+				Length:    len(frame.data),
+				Size:      frame.size,
+				FirstSeen: frame.first,
+				LastSeen:  frame.last,
+				Ingress:   d.ingress,
+			})
+		}
+	}
 }
 
-func (d *dnsStream) run() {
-	var data []byte
-	var tmp = make([]byte, 4096)
+// ReassemblyComplete is called by the assembler when the stream is closed or
+// flushed, any partial message left on it is dropped
+func (d *dnsStream) ReassemblyComplete() {
+}
 
-	for {
-		count, err := d.r.Read(tmp)
-
-		if err == io.EOF {
-			//we must read to EOF, so we also use it as a signal to send the reassembed
-			//stream into the channel
-			// Ensure the length of data is at least two for integer parsing,
-			// skip to next iterator if too short
-			if len(data) < 2 {
-				return
-			}
-			// Parse the actual integer
-			DNSdatalen := int(binary.BigEndian.Uint16(data[:2]))
-			// Ensure the length of data is the parsed size +2,
-			// skip to next iterator if too short
-			if len(data) < DNSdatalen+2 {
-				return
-			}
-			reassemblerChan <- TCPDataStruct{
-				DNSData: data[2 : DNSdatalen+2],
-				IPLayer: d.net,
-				Length:  int(binary.BigEndian.Uint16(data[:2])),
-			}
-			return
-		} else if err != nil {
-			log.Debug("Error when reading DNS buf: ", err)
-		} else if count > 0 {
-			data = append(data, tmp...)
+// dnsFrame is one DNS message read from a TCP stream
+type dnsFrame struct {
+	data  []byte
+	first time.Time
+	last  time.Time
+	size  int // the on-wire length of the segments it was read from
+}
+
+// dnsFramer splits one direction of a TCP stream into two byte length prefixed
+// DNS messages, RFC 1035 4.2.2, and remembers when each one started and the
+// segments it arrived in.
+type dnsFramer struct {
+	buf   []byte
+	first time.Time
+	size  int
+	// once data has been lost we can't find the message boundaries again
+	lost bool
+}
+
+// push adds the next segment of the stream, whose packet was captured bytes
+// long on the wire, and returns the messages it completed.  A segment carrying the end of one message
+// and the start of the next counts towards the size of both.
+func (f *dnsFramer) push(data []byte, seen time.Time, captured int) []dnsFrame {
+	if f.lost {
+		return nil
+	}
+	if len(f.buf) == 0 {
+		f.first = seen
+		f.size = 0
+	}
+	f.buf = append(f.buf, data...)
+	f.size += captured
+
+	var frames []dnsFrame
+	for len(f.buf) >= 2 {
+		length := int(binary.BigEndian.Uint16(f.buf[:2]))
+		if len(f.buf) < length+2 {
+			break
+		}
+		//zero length messages can't be DNS, skip them
+		if length > 0 {
+			frames = append(frames, dnsFrame{
+				data:  append([]byte(nil), f.buf[2:length+2]...),
+				first: f.first,
+				last:  seen,
+				size:  f.size,
+			})
 		}
+		f.buf = f.buf[length+2:]
+		//anything left over started in this segment
+		f.first = seen
+		f.size = captured
 	}
+	return frames
 }
 
-//	takes the src IP, dst IP, DNS question, DNS reply and the logs struct to populate.
+//	takes the server IP, client port, client IP, DNS question, DNS reply, the times they
+//	were captured and the logs struct to populate.
 //	returns nothing, but populates the logs array
-func initLogEntry(syslogPriority string, srcIP net.IP, srcPort uint16, dstIP net.IP, length *int, protocol *string, question layers.DNS, answer layers.DNS, timestamp time.Time, logs *[]DNSLogEntry) {
+func initLogEntry(syslogPriority string, opts logEntryOptions, serverIP net.IP, clientPort uint16, clientIP net.IP, length *int, protocol *string, ingress ingressInfo, question layers.DNS, answer layers.DNS, queryTime time.Time, responseTime time.Time, logs *[]DNSLogEntry) {
 
 	/*
 	   http://forums.devshed.com/dns-36/dns-packet-question-section-1-a-183026.html
@@ -127,7 +198,8 @@ func initLogEntry(syslogPriority string, srcIP net.IP, srcPort uint16, dstIP net
 	   the same on all of those entries, however, so you can rebuild the query that
 	   way.
 
-	   TODO: Also loop through Additional records in addition to Answers
+	   The authority and additional sections are logged the same way when enabled,
+	   with the section name on each entry so referrals and glue can be told apart.
 	*/
 
 	if *protocol == packetString {
@@ -139,88 +211,171 @@ func initLogEntry(syslogPriority string, srcIP net.IP, srcPort uint16, dstIP net
 		additionals = true
 	}
 
+	// the fields shared by every entry logged for this answer
+	base := DNSLogEntry{
+		Level:               syslogPriority,
+		QueryID:             answer.ID,
+		Question:            string(question.Questions[0].Name),
+		ResponseCode:        answer.ResponseCode,
+		QuestionType:        TypeString(question.Questions[0].Type),
+		AuthoritativeAnswer: answer.AA, // this is in the header, not the answer slice
+		RecursionDesired:    question.RD,
+		RecursionAvailable:  question.RA,
+		Server:              serverIP,
+		Client:              clientIP,
+		ClientPort:          clientPort,
+		Length:              *length,
+		Proto:               *protocol,
+		Interface:           ingress.iface,
+		VLANs:               ingress.vlans,
+		Tunnel:              ingress.tunnel,
+		Truncated:           answer.TC,                               // this is in the header, not the answer slice
+		QuestionSz:          uint16(len(question.Questions[0].Name)), // this captures the size of the question name to see name server requet padding in the <payload>.domain.com data exfiltration model.
+		Additionals:         additionals,
+		EDNS:                parseEDNS(answer),
+		QueryEDNS:           parseEDNS(question),
+		Timestamp:           opts.timestampFormat.format(responseTime),
+		Elapsed:             responseTime.Sub(queryTime).Nanoseconds(),
+		ProcessingLag:       time.Since(responseTime).Nanoseconds(),
+	}
+
 	// a response code other than 0 means failure of some kind
 	if answer.ResponseCode != 0 {
-		*logs = append(*logs, DNSLogEntry{
-			Level:               syslogPriority,
-			QueryID:             answer.ID,
-			Question:            string(question.Questions[0].Name),
-			ResponseCode:        answer.ResponseCode,
-			QuestionType:        TypeString(question.Questions[0].Type),
-			Answer:              answer.ResponseCode.String(),
-			AnswerType:          "",
-			TTL:                 0,
-			AuthoritativeAnswer: answer.AA,
-			RecursionDesired:    question.RD,
-			RecursionAvailable:  question.RA,
-			Server:              srcIP, //this is the answer packet, which comes from the server...
-			Client:              dstIP, //...and goes to the client
-			Timestamp:           time.Now().UTC().String(),
-			Elapsed:             time.Now().Sub(timestamp).Nanoseconds(),
-			ClientPort:          srcPort,
-			Length:              *length,
-			Proto:               *protocol,
-			Truncated:           answer.TC,
-			ResponseSz:          0,
-			QuestionSz:          uint16(len(question.Questions[0].Name)),
-			Additionals:         additionals,
-		})
+		if opts.sections.has(logAnswers) {
+			entry := base
+			entry.Answer = answer.ResponseCode.String()
+			entry.AnswerType = ""
+			entry.TTL = 0
+			entry.Section = answerSection
+			entry.ResponseSz = 0
+			*logs = append(*logs, entry)
+		}
+	} else if opts.sections.has(logAnswers) {
+		appendRRLogEntries(base, opts, answerSection, answer.Answers, logs)
+	}
 
-	} else {
-		for _, ans := range answer.Answers {
-
-			*logs = append(*logs, DNSLogEntry{
-				QueryID:             answer.ID,
-				Question:            string(question.Questions[0].Name),
-				ResponseCode:        answer.ResponseCode,
-				QuestionType:        TypeString(question.Questions[0].Type),
-				Answer:              RRString(ans),
-				AnswerType:          TypeString(ans.Type),
-				TTL:                 ans.TTL,
-				Server:              srcIP, //this is the answer packet, which comes from the server...
-				Client:              dstIP, //...and goes to the client
-				Timestamp:           time.Now().UTC().String(),
-				Elapsed:             time.Now().Sub(timestamp).Nanoseconds(),
-				ClientPort:          srcPort,
-				Level:               syslogPriority,
-				AuthoritativeAnswer: answer.AA, // this is in the header, not the answer slice
-				RecursionDesired:    question.RD,
-				RecursionAvailable:  question.RA,
-				Length:              *length,
-				Proto:               *protocol,
-				Truncated:           answer.TC,                               // this is in the header, not the answer slice
-				ResponseSz:          ans.DataLength,                          // each answer has its own size
-				QuestionSz:          uint16(len(question.Questions[0].Name)), // this captures the size of the question name to see name server requet padding in the <payload>.domain.com data exfiltration model.
-				Additionals:         additionals,
-			})
+	//the SOA in the authority section of an NXDOMAIN is logged alongside the rcode entry
+	if opts.sections.has(logAuthorities) {
+		appendRRLogEntries(base, opts, authoritySection, answer.Authorities, logs)
+	}
+	if opts.sections.has(logAdditionals) {
+		appendRRLogEntries(base, opts, additionalSection, answer.Additionals, logs)
+	}
+}
+
+// appendRRLogEntries adds a copy of base for each resource record in one section of the answer
+func appendRRLogEntries(base DNSLogEntry, opts logEntryOptions, section string, records []layers.DNSResourceRecord, logs *[]DNSLogEntry) {
+	for _, ans := range records {
+		//the OPT pseudo-record describes the message, not the name being looked up
+		if ans.Type == layers.DNSTypeOPT {
+			continue
 		}
+
+		entry := base
+		//decode once and use it for both the answer string and the rdata object
+		if opts.rdata {
+			entry.RData = decodeRData(ans)
+			entry.Answer = entry.RData.String()
+		} else {
+			entry.Answer = RRString(ans)
+		}
+		entry.AnswerType = TypeString(ans.Type)
+		entry.TTL = ans.TTL
+		entry.Section = section
+		entry.ResponseSz = ans.DataLength // each answer has its own size
+		*logs = append(*logs, entry)
+	}
+}
+
+// gcSettings controls the conntable GC and can be changed on reload
+type gcSettings struct {
+	maxAge        time.Duration
+	interval      time.Duration
+	logUnanswered bool
+}
+
+//	builds the log entry for a query which was garbage collected without ever
+//	seeing an answer. The entry keeps the time the query was seen.
+func initUnansweredLogEntry(syslogPriority string, opts logEntryOptions, item DNSMapEntry) DNSLogEntry {
+	question := item.entry
+	protocol := item.protocol
+	if protocol == packetString {
+		protocol = udpString
+	}
+
+	return DNSLogEntry{
+		Level:              syslogPriority,
+		QueryID:            question.ID,
+		Question:           string(question.Questions[0].Name),
+		QuestionType:       TypeString(question.Questions[0].Type),
+		Answer:             noAnswerString,
+		AnswerType:         "",
+		TTL:                0,
+		Section:            answerSection,
+		RecursionDesired:   question.RD,
+		RecursionAvailable: question.RA,
+		Server:             item.dstIP, //this is the query packet, which goes to the server...
+		Client:             item.srcIP, //...and comes from the client
+		Timestamp:          opts.timestampFormat.format(item.inserted),
+		ProcessingLag:      time.Since(item.inserted).Nanoseconds(),
+		ClientPort:         item.srcPort,
+		Length:             item.length,
+		Proto:              protocol,
+		Interface:          item.ingress.iface,
+		VLANs:              item.ingress.vlans,
+		Tunnel:             item.ingress.tunnel,
+		QuestionSz:         uint16(len(question.Questions[0].Name)),
+		QueryEDNS:          parseEDNS(question),
 	}
 }
 
-//	background task to clear out stale entries in the conntable
-//	takes a pointer to the conntable to clean, the maximum age of an entry and how often to run GC
-func cleanDNSCache(conntable *connectionTable, maxAge time.Duration, interval time.Duration, stats *statsd.Client, finished chan bool) {
-	scheduled := time.NewTicker(interval)
+//	builds the log entry for a query whose response, seen at responseTime, has a
+//	different question section.  It is logged like an unanswered query.
+func initMismatchLogEntry(syslogPriority string, opts logEntryOptions, query DNSMapEntry, responseTime time.Time) DNSLogEntry {
+	entry := initUnansweredLogEntry(syslogPriority, opts, query)
+	entry.Answer = mismatchString
+	entry.Timestamp = opts.timestampFormat.format(responseTime)
+	entry.Elapsed = responseTime.Sub(query.inserted).Nanoseconds()
+	entry.ProcessingLag = time.Since(responseTime).Nanoseconds()
+	return entry
+}
+
+//	background task to clear out stale entries in the conntables
+//	takes the conntables to clean, the maximum age of an entry and how often to run GC
+//	if settings.logUnanswered is set, questions which never saw an answer are logged as NOANSWER
+func cleanDNSCache(conntables connectionTables, settings gcSettings, logChan chan DNSLogEntry, syslogPriority string, entryOpts logEntryOptions, stats metrics, finished chan bool, reload chan gcSettings) {
+	scheduled := time.NewTicker(settings.interval)
 	for {
 		select {
 		case <-scheduled.C:
 			//max_age should be negative, e.g. -1m
-			cleanupCutoff := time.Now().Add(maxAge)
-			conntable.RLock()
-			for key, item := range conntable.connections {
-				if item.inserted.Before(cleanupCutoff) {
-					conntable.RUnlock()
-					conntable.Lock()
-					log.Debug("conntable GC: cleanup query ID " + key)
-					delete(conntable.connections, key)
-					conntable.Unlock()
-					conntable.RLock()
-					if stats != nil {
-						stats.Incr("cache_entries_dropped", 1)
-					}
+			cleanupCutoff := time.Now().Add(settings.maxAge)
+			var unanswered []DNSLogEntry
+			collected := conntables.collect(cleanupCutoff)
+			for _, item := range collected {
+				log.Debug("conntable GC: cleanup query ID " + strconv.Itoa(int(item.entry.ID)))
+				if settings.logUnanswered && !item.entry.QR && len(item.entry.Questions) > 0 {
+					unanswered = append(unanswered, initUnansweredLogEntry(syslogPriority, entryOpts, item))
 				}
 			}
-			conntable.RUnlock()
+			if stats != nil && len(collected) > 0 {
+				stats.Incr("cache_entries_dropped", int64(len(collected)))
+			}
+			//send outside the lock so a full log channel doesn't stall the packet handlers
+			for _, logEntry := range unanswered {
+				logChan <- logEntry
+			}
+			if stats != nil && len(unanswered) > 0 {
+				stats.Incr("unanswered_queries", int64(len(unanswered)))
+			}
+		case newSettings := <-reload:
+			if newSettings.interval != settings.interval {
+				scheduled.Stop()
+				scheduled = time.NewTicker(newSettings.interval)
+			}
+			settings = newSettings
+			conntables.setKeepEvicted(settings.logUnanswered)
+			log.Printf("gopassivedns: conntable GC now removes entries older than %s every %s", settings.maxAge, settings.interval)
 		case <-finished:
 			log.Printf("gopassivedns: cleanDNSCache cleanly exiting %s", time.Now().String())
 			return
@@ -229,82 +384,160 @@ func cleanDNSCache(conntable *connectionTable, maxAge time.Duration, interval ti
 }
 
 // handleDNS processses the DNS layer
-func handleDNS(conntable *connectionTable, dns *layers.DNS, logChan chan DNSLogEntry, syslogPriority string, srcIP, dstIP net.IP, srcPort, dstPort uint16, length *int, protocol *string, packetTime time.Time, stats *statsd.Client) {
+func handleDNS(conntable *connectionTable, dns *layers.DNS, logChan chan DNSLogEntry, syslogPriority string, entryOpts logEntryOptions, srcIP, dstIP net.IP, srcPort, dstPort uint16, length *int, protocol *string, ingress ingressInfo, packetTime time.Time, stats metrics) {
 	//skip non-query stuff (Updates, AXFRs, etc)
 	if dns.OpCode != layers.DNSOpCodeQuery {
 		log.Debug("Saw non-query DNS packet")
 	}
 
+	//without a question there is nothing to match the legs on, or to log
+	if len(dns.Questions) == 0 {
+		log.Debug("Saw DNS packet without a question, query ID " + strconv.Itoa(int(dns.ID)))
+		return
+	}
+
 	//pre-allocated for initLogEntry
 	logs := []DNSLogEntry{}
 
-	// generate a more unique key for a conntable map to avoid hash key collisions as dns.ID is not very unique
-	var uid string
-	if dstPort == 53 {
-		uid = fmt.Sprintf("%s->%d:%d", strconv.Itoa(int(dns.ID)), srcPort, dstPort)
-	} else {
-		uid = fmt.Sprintf("%s->%d:%d", strconv.Itoa(int(dns.ID)), dstPort, srcPort)
+	uid := conntableKey(dns, *protocol, srcIP, dstIP, srcPort, dstPort)
+	leg := DNSMapEntry{
+		entry:    *dns,
+		inserted: packetTime,
+		srcIP:    srcIP,
+		dstIP:    dstIP,
+		srcPort:  srcPort,
+		dstPort:  dstPort,
+		length:   *length,
+		protocol: *protocol,
+		ingress:  ingress,
 	}
 
-	conntable.RLock()
-	//lookup the query ID:source port in our connection table
-	item, foundItem := conntable.connections[uid]
-	//this is a Query Response packet and we saw the question go out...
-	//if we saw a leg of this already...
-	if foundItem {
+	//lookup the query ID, addresses, ports and question in our connection table
+	item, result, evicted := conntable.pair(uid, leg)
+	if stats != nil && evicted.maxEntries > 0 {
+		stats.Incr("conntable_evictions", int64(evicted.maxEntries), metricTag{name: "reason", value: evictMaxEntries})
+	}
+	if stats != nil && evicted.maxMemory > 0 {
+		stats.Incr("conntable_evictions", int64(evicted.maxMemory), metricTag{name: "reason", value: evictMaxMemory})
+	}
+	//the table only keeps the evicted entries when unanswered queries are logged
+	unanswered := 0
+	for _, evictedItem := range evicted.items {
+		if !evictedItem.entry.QR && len(evictedItem.entry.Questions) > 0 {
+			logChan <- initUnansweredLogEntry(syslogPriority, entryOpts, evictedItem)
+			unanswered++
+		}
+	}
+	if stats != nil && unanswered > 0 {
+		stats.Incr("unanswered_queries", int64(unanswered))
+	}
+
+	switch result {
+	case legStored:
+		//This is the initial query.  save it for later.
+		log.Debug("Got a leg of query ID " + strconv.Itoa(int(dns.ID)))
+	case legRejected:
+		//one client shouldn't be able to fill the conntable
+		if stats != nil {
+			stats.Incr("conntable_rejected", 1)
+		}
+		log.Debugf("Client %s has too many lookups waiting, dropping query ID %d", leg.client(), dns.ID)
+	case legRepeated:
+		//a retransmission, keep the first one so elapsed covers the whole lookup
+		log.Debug("Got a repeated leg of query ID " + strconv.Itoa(int(dns.ID)))
+	case legMismatched:
+		//the key ignores the case of the name, so the other leg may not have asked this
+		if stats != nil {
+			stats.Incr("question_mismatch", 1)
+		}
+		log.Debugf("Query ID %d from %s:%d to %s:%d has question %s, expecting %s", dns.ID, srcIP, srcPort, dstIP, dstPort, questionString(dns), questionString(&item.entry))
+		if entryOpts.mismatches {
+			//the waiting leg is usually the query, but over TCP the response can arrive first
+			query, responseTime := item, packetTime
+			if item.entry.QR {
+				query, responseTime = leg, item.inserted
+			}
+			logChan <- initMismatchLogEntry(syslogPriority, entryOpts, query, responseTime)
+		}
+	case legPaired:
 		//if we just got the reply
 		if dns.QR {
 			if stats != nil {
 				stats.Incr("log_qr", 1)
+				stats.Timing("answer_latency", packetTime.Sub(item.inserted))
 			}
 			log.Debug("Got 'answer' leg of query ID: " + strconv.Itoa(int(dns.ID)))
-			initLogEntry(syslogPriority, srcIP, srcPort, dstIP, length, protocol, item.entry, *dns, item.inserted, &logs)
+			//this is the answer packet, which comes from the server and goes to the client
+			initLogEntry(syslogPriority, entryOpts, srcIP, dstPort, dstIP, length, protocol, item.ingress, item.entry, *dns, item.inserted, packetTime, &logs)
 		} else {
 			if stats != nil {
 				stats.Incr("log_no_qr", 1)
 			}
 			//we just got the question, so we should already have the reply. This is most commonly seen with DNS packets over TCP
 			log.Debug("Got the 'question' leg of query ID " + strconv.Itoa(int(dns.ID)))
-			initLogEntry(syslogPriority, srcIP, srcPort, dstIP, length, protocol, *dns, item.entry, item.inserted, &logs)
+			initLogEntry(syslogPriority, entryOpts, dstIP, srcPort, srcIP, length, protocol, ingress, *dns, item.entry, packetTime, item.inserted, &logs)
 		}
-		conntable.RUnlock()
-		conntable.Lock()
-		delete(conntable.connections, uid)
-		conntable.Unlock()
 		//TODO: send the array itself, not the elements of the array
 		//to reduce the number of channel transactions
 		for _, logEntry := range logs {
 			logChan <- logEntry
 		}
+	}
+}
 
-	} else {
-		//This is the initial query.  save it for later.
-		log.Debug("Got a leg of query ID " + strconv.Itoa(int(dns.ID)))
-		mapEntry := DNSMapEntry{
-			entry:    *dns,
-			inserted: packetTime,
+// conntableKey returns the key both legs of a lookup are stored under: the
+// protocol, client and server address and port, query ID and question. The
+// client is the side that sent the query, whichever leg this is.
+func conntableKey(dns *layers.DNS, protocol string, srcIP, dstIP net.IP, srcPort, dstPort uint16) string {
+	clientIP, clientPort, serverIP, serverPort := srcIP, srcPort, dstIP, dstPort
+	if dns.QR {
+		clientIP, clientPort, serverIP, serverPort = dstIP, dstPort, srcIP, srcPort
+	}
+	question := dns.Questions[0]
+
+	return fmt.Sprintf("%s %s:%d->%s:%d %d %s %d %d", protocol, clientIP, clientPort, serverIP, serverPort,
+		dns.ID, strings.ToLower(string(question.Name)), question.Type, question.Class)
+}
+
+// questionsMatch reports whether the response repeats the question section of
+// the query exactly, including the case of the names (0x20 randomisation).
+func questionsMatch(query, response *layers.DNS) bool {
+	if len(query.Questions) != len(response.Questions) {
+		return false
+	}
+	for i, question := range query.Questions {
+		other := response.Questions[i]
+		if !bytes.Equal(question.Name, other.Name) || question.Type != other.Type || question.Class != other.Class {
+			return false
 		}
-		conntable.RUnlock()
-		conntable.Lock()
-		conntable.connections[uid] = mapEntry
-		conntable.Unlock()
 	}
+	return true
+}
+
+// questionString returns the question section for logging, e.g. "example.com A IN"
+func questionString(dns *layers.DNS) string {
+	questions := make([]string, 0, len(dns.Questions))
+	for _, question := range dns.Questions {
+		questions = append(questions, string(question.Name)+" "+TypeString(question.Type)+" "+ClassString(question.Class))
+	}
+	return strings.Join(questions, ", ")
 }
 
 // validate if DNS packet, make conntable entry and output
 //   to log channel if there is a match
 //
 //   we pass packet by value here because we turned on ZeroCopy for the capture, which reuses the capture buffer
-func handlePacket(conntable *connectionTable, packets chan *packetData, logChan chan DNSLogEntry, syslogPriority string, gcInterval time.Duration, gcAge time.Duration, threadNum int, stats *statsd.Client) {
-	//TCP reassembly init
-	streamFactory := &dnsStreamFactory{}
+func handlePacket(conntable *connectionTable, packets chan *packetData, logChan chan DNSLogEntry, syslogPriority string, entryOpts logEntryOptions, gcInterval time.Duration, gcAge time.Duration, threadNum int, stats metrics) {
+	//TCP reassembly init, the messages on the streams are handled right here
+	streamFactory := &dnsStreamFactory{handle: func(message TCPDataStruct) {
+		handleTCPMessage(conntable, message, logChan, syslogPriority, entryOpts, stats)
+	}}
 	streamPool := tcpassembly.NewStreamPool(streamFactory)
 	assembler := tcpassembly.NewAssembler(streamPool)
 	ticker := time.Tick(time.Minute)
 
 	// do the string conversion once for each goroutine reduces the allocations for each for loop.
-	packetWallTimeStatName := strconv.Itoa(threadNum) + ".packet_wall_time"
-	dnsLookupsStatName := strconv.Itoa(threadNum) + ".dns_lookups"
+	workerTag := metricTag{name: "worker", value: strconv.Itoa(threadNum)}
 
 	for {
 		select {
@@ -334,7 +567,7 @@ func handlePacket(conntable *connectionTable, packets chan *packetData, logChan
 			} else {
 				log.Debug("Adding wall time not packet time to message.")
 				if stats != nil {
-					stats.Incr(packetWallTimeStatName, 1)
+					stats.Incr("packet_wall_time", 1, workerTag)
 				}
 				packetTime = time.Now()
 			}
@@ -343,31 +576,20 @@ func handlePacket(conntable *connectionTable, packets chan *packetData, logChan
 			// But that will leave the connection hanging around in memory, because the inital handshake won't
 			// parse as DNS, nor will the connection closing.
 
-			if packet.IsTCPStream() {
-				handleDNS(conntable,
-					packet.GetDNSLayer(),
-					logChan,
-					syslogPriority,
-					srcIP,
-					dstIP,
-					srcPort,
-					dstPort,
-					packet.GetSize(),
-					packet.GetProto(),
-					packetTime,
-					stats)
-			} else if packet.HasTCPLayer() {
+			if packet.HasTCPLayer() {
 				// because most ipv6 packets are dual stack we need to look at the src ip address to identify if its an IPv6 lookup
 				// ot ipv4. If we simply look at the layers dual stack includes both.
+				streamFactory.ingress = packet.GetIngress()
+				streamFactory.overhead = *packet.GetSize() - len(packet.GetTCPLayer().Payload)
 				if srcIP.To4() != nil {
 					assembler.AssembleWithTimestamp(
 						packet.GetIPv4Layer().NetworkFlow(),
-						packet.GetTCPLayer(), *packet.GetTimestamp())
+						packet.GetTCPLayer(), packetTime)
 					continue
 				} else {
 					assembler.AssembleWithTimestamp(
 						packet.GetIPv6Layer().NetworkFlow(),
-						packet.GetTCPLayer(), *packet.GetTimestamp())
+						packet.GetTCPLayer(), packetTime)
 					continue
 				}
 
@@ -376,16 +598,18 @@ func handlePacket(conntable *connectionTable, packets chan *packetData, logChan
 					packet.GetDNSLayer(),
 					logChan,
 					syslogPriority,
+					entryOpts,
 					srcIP,
 					dstIP,
 					srcPort,
 					dstPort,
 					packet.GetSize(),
 					packet.GetProto(),
+					packet.GetIngress(),
 					packetTime,
 					stats)
 				if stats != nil {
-					stats.Incr(dnsLookupsStatName, 1)
+					stats.Incr("dns_lookups", 1, workerTag)
 				}
 			} else {
 				//UDP and doesn't parse as DNS?
@@ -398,40 +622,114 @@ func handlePacket(conntable *connectionTable, packets chan *packetData, logChan
 	}
 }
 
-// setup a device or pcap file for capture, returns a handle
-func initHandle(config *pdnsConfig) *pcap.Handle {
+// handleTCPMessage handles a DNS message framed from a reassembled TCP stream
+func handleTCPMessage(conntable *connectionTable, message TCPDataStruct, logChan chan DNSLogEntry, syslogPriority string, entryOpts logEntryOptions, stats metrics) {
+	if stats != nil {
+		stats.Incr("reassembed_tcp", 1)
+	}
 
-	var handle *pcap.Handle
-	var err error
+	packet := newTCPData(message)
+	packet.Parse()
+	if !packet.HasDNSLayer() {
+		log.Debug("Reassembled TCP message did not parse as DNS")
+		return
+	}
 
-	if config.device != "" && !config.pfring {
-		handle, err = pcap.OpenLive(config.device, config.snapLen, true, pcap.BlockForever)
-		if err != nil {
-			log.Debug(err)
-			return nil
+	handleDNS(conntable,
+		packet.GetDNSLayer(),
+		logChan,
+		syslogPriority,
+		entryOpts,
+		packet.GetSrcIP(),
+		packet.GetDstIP(),
+		packet.GetSrcPort(),
+		packet.GetDstPort(),
+		packet.GetSize(),
+		packet.GetProto(),
+		packet.GetIngress(),
+		*packet.GetTimestamp(),
+		stats)
+}
+
+// flowHash returns the same hash for both directions of a conversation, so the
+// query and response of a lookup are handled by the same packet processing
+// thread whether they came over UDP or were reassembled from TCP.  transport
+// may be empty, e.g. for a fragment without the UDP header.
+func flowHash(network, transport gopacket.Flow) uint64 {
+	//both FastHashes are symmetric, so the combination is too
+	return network.FastHash() ^ transport.FastHash()*0x100000001b3
+}
+
+// workerFor returns which of the packet processing threads handles a flow
+// with the given hash, for any number of threads.  FastHash taken modulo
+// anything but a power of two is lumpy, so the hash is mixed with a Fibonacci
+// multiplier first and its top 32 bits are scaled to the number of threads.
+func workerFor(hash uint64, numprocs int) int {
+	mixed := (hash * 0x9e3779b97f4a7c15) >> 32
+	return int(mixed * uint64(numprocs) >> 32)
+}
+
+// setup the devices or pcap file for capture, returns a capture source
+func initHandle(config *pdnsConfig) captureSource {
+
+	var source captureSource
+
+	if devices := parseDevices(config.device); len(devices) > 0 {
+		var sources multiSource
+		for i, device := range devices {
+			deviceSource, err := openDevice(config, device, i)
+			if err != nil {
+				log.Debug(err)
+				sources.Close()
+				return nil
+			}
+			sources = append(sources, deviceSource)
+		}
+		source = sources
+		if len(sources) == 1 {
+			source = sources[0]
 		}
 	} else if config.pcapFile != "" {
-		handle, err = pcap.OpenOffline(config.pcapFile)
+		handle, err := pcap.OpenOffline(config.pcapFile)
 		if err != nil {
 			log.Debug(err)
 			return nil
 		}
+		source = &pcapSource{handle: handle}
 	} else {
 		log.Debug("You must specify either a capture device or a pcap file")
 		return nil
 	}
 
-	err = handle.SetBPFFilter(config.bpf)
+	err := source.SetBPFFilter(config.bpf)
 	if err != nil {
 		log.Debug(err)
+		source.Close()
 		return nil
 	}
 
-	return handle
+	return source
+}
+
+// openDevice starts a live capture on device, the index-th device in the -dev
+// list, using AF_PACKET, PF_RING or libpcap as config asks
+func openDevice(config *pdnsConfig, device string, index int) (captureSource, error) {
+	switch {
+	case config.afpacket:
+		return newAFPacketSource(config, device, index)
+	case config.pfring:
+		return newPFRingSource(config, device)
+	default:
+		handle, err := pcap.OpenLive(device, config.snapLen, true, pcap.BlockForever)
+		if err != nil {
+			return nil, err
+		}
+		return &pcapSource{handle: handle, iface: device}, nil
+	}
 }
 
 // kick off packet procesing threads and start the packet capture loop
-func doCapture(handle *pcap.Handle, config *pdnsConfig, logChan chan DNSLogEntry, reassembledChan chan TCPDataStruct, stats *statsd.Client, finished chan bool) {
+func doCapture(source captureSource, tap *dnstapInput, config *pdnsConfig, logChan chan DNSLogEntry, stats metrics, finished chan bool, reload chan *pdnsConfig) {
 
 	gcAgeDur, err := time.ParseDuration(config.gcAge)
 
@@ -445,8 +743,19 @@ func doCapture(handle *pcap.Handle, config *pdnsConfig, logChan chan DNSLogEntry
 		log.Fatal("Your gc_age parameter was not parseable.  Use a string like '3m'")
 	}
 
-	//setup the global channel for reassembled TCP streams
-	reassemblerChan = reassembledChan
+	sections, err := parseLogSections(config.logSections)
+
+	if err != nil {
+		log.Fatalf("Your log_sections parameter was not parseable: %s", err)
+	}
+
+	tsFormat, err := parseTimestampFormat(config.timestampFormat)
+
+	if err != nil {
+		log.Fatalf("Your timestamp_format parameter was not parseable: %s", err)
+	}
+
+	entryOpts := logEntryOptions{sections: sections, rdata: config.logRData, timestampFormat: tsFormat, mismatches: config.logMismatches}
 
 	/* init channels for the packet handlers and kick off handler threads */
 	var channels []chan *packetData
@@ -455,80 +764,81 @@ func doCapture(handle *pcap.Handle, config *pdnsConfig, logChan chan DNSLogEntry
 		channels = append(channels, make(chan *packetData, packetQueue))
 	}
 
-	//DNS IDs are stored as uint16s by the gopacket DNS layer
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
+	//each packet processing thread pairs the lookups dispatched to it in a
+	//conntable of its own
+	conntables := newConnectionTables(config.numprocs, conntableLimits{
+		maxEntries:   config.conntableMaxEntries,
+		maxBytes:     int64(config.conntableMaxMemory) * 1024 * 1024,
+		maxPerClient: config.conntableMaxPerClient,
+	})
+	//queries evicted to make room are logged like those the GC collects
+	conntables.setKeepEvicted(config.logUnanswered)
 
 	//setup garbage collection for this map
-	go cleanDNSCache(&conntable, gcAgeDur, gcIntervalDur, stats, finished)
+	gcReload := make(chan gcSettings)
+	go cleanDNSCache(conntables, gcSettings{maxAge: gcAgeDur, interval: gcIntervalDur, logUnanswered: config.logUnanswered}, logChan, config.syslogPriority, entryOpts, stats, finished, gcReload)
 
+	var workers sync.WaitGroup
 	for i := 0; i < config.numprocs; i++ {
 		log.Debugf("Starting packet processing thread %d", i)
-		go handlePacket(&conntable, channels[i], logChan, config.syslogPriority, gcIntervalDur, gcAgeDur, i, stats)
-	}
-
-	// Use the handle as a packet source to process all packets
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	//only decode packet in response to function calls, this moves the
-	//packet processing to the processing threads
-	packetSource.DecodeOptions.Lazy = true
-	//We don't mutate bytes of the packets, so no need to make a copy
-	//this does mean we need to pass the packet via the channel, not a pointer to the packet
-	//as the underlying buffer will get re-allocated
-	packetSource.DecodeOptions.NoCopy = true
-
-	var ethLayer layers.Ethernet
-	var IPv4Layer layers.IPv4
-	var IPv6Layer layers.IPv6
-
-	parser := gopacket.NewDecodingLayerParser(
-		layers.LayerTypeEthernet,
-		&ethLayer,
-		&IPv4Layer,
-		&IPv6Layer,
-	)
-
-	foundLayerTypes := []gopacket.LayerType{}
+		workers.Add(1)
+		go func(i int) {
+			defer workers.Done()
+			handlePacket(conntables[i], channels[i], logChan, config.syslogPriority, entryOpts, gcIntervalDur, gcAgeDur, i, stats)
+		}(i)
+	}
+
+	//each socket or handle gets its own reader, which sends packets straight to the packet processing threads
+	stop := make(chan struct{})
+	var readersDone chan struct{}
+	if source != nil {
+		readersDone = readPackets(source.PacketSources(), channels, dispatchOptions{
+			decapsulate: config.decapsulate,
+			defrag: defragLimits{
+				timeout:  time.Duration(config.defragTimeout) * time.Second,
+				maxBytes: int64(config.defragMaxMemory) * 1024 * 1024,
+			},
+		}, stats, stop)
+	}
+
+	//dnstap messages arrive already decoded by the server, so they skip the
+	//packet processing threads and go straight to the conntable of the thread
+	//their flow would be dispatched to
+	var dnstapDone chan struct{}
+	if tap != nil {
+		dnstapDone = tap.serve(func(message *dnstap.Message) {
+			handleDnstapMessage(conntables.forFlow(dnstapFlowHash(message)), message, logChan, config.syslogPriority, entryOpts, stats)
+		}, stop)
+	}
+
 	scheduled := time.NewTicker(time.Duration(config.statsdInterval) * time.Second)
+	lastStats := captureStats{}
 
 CAPTURE:
 	for {
 		select {
-		case reassembledTCP := <-reassembledChan:
-			pd := newTCPData(reassembledTCP)
-			channels[int(reassembledTCP.IPLayer.FastHash())&(config.numprocs-1)] <- pd
-			if stats != nil {
-				stats.Incr("reassembed_tcp", 1)
+		case <-readersDone:
+			//if we get here, we're likely reading a pcap and we've finished
+			//or, potentially, the physical device we've been reading from has been
+			//downed.  Or something else crazy has gone wrong...so we break
+			//out of the capture loop entirely.
+			log.Debug("all packet sources have finished")
+			if dnstapDone != nil {
+				//dnstap keeps arriving until we are told to stop, a nil
+				//channel takes this case out of the select
+				readersDone = nil
+				continue
 			}
-		case packet := <-packetSource.Packets():
-			if packet != nil {
-				parser.DecodeLayers(packet.Data(), &foundLayerTypes)
-				if foundLayerType(layers.LayerTypeIPv4, foundLayerTypes) {
-					pd := newPacketData(packet)
-					channels[int(IPv4Layer.NetworkFlow().FastHash())&(config.numprocs-1)] <- pd
-					if stats != nil {
-						stats.Incr("packets", 1)
-					}
-				}
-				if foundLayerType(layers.LayerTypeIPv6, foundLayerTypes) {
-					pd := newPacketData(packet)
-					channels[int(IPv6Layer.NetworkFlow().FastHash())&(config.numprocs-1)] <- pd
-					if stats != nil {
-						stats.Incr("packets_v6", 1)
-					}
+			break CAPTURE
+		case <-scheduled.C:
+			if source == nil {
+				if stats != nil {
+					stats.Gauge("conntable_size", int64(conntables.len()))
+					stats.Gauge("conntable_bytes", conntables.bytes())
 				}
-			} else {
-				//if we get here, we're likely reading a pcap and we've finished
-				//or, potentially, the physical device we've been reading from has been
-				//downed.  Or something else crazy has gone wrong...so we break
-				//out of the capture loop entirely.
-
-				log.Debug("packetSource returned nil")
-				break CAPTURE
+				continue
 			}
-		case <-scheduled.C:
-			handleStats, err := handle.Stats()
+			sourceStats, err := source.CaptureStats()
 
 			if err != nil {
 				log.Printf("gopassivedns: doCapture error getting handle stats %s", err)
@@ -536,22 +846,64 @@ CAPTURE:
 			}
 
 			log.Printf("Statistics received: %d, dropped: %d, interface dropped %d",
-				handleStats.PacketsReceived,
-				handleStats.PacketsDropped,
-				handleStats.PacketsIfDropped,
+				sourceStats.received,
+				sourceStats.dropped,
+				sourceStats.ifDropped,
 			)
 			if stats != nil {
-				stats.Incr("packets_received", int64(handleStats.PacketsReceived))
-				stats.Incr("packets_dropped", int64(handleStats.PacketsDropped))
-				stats.Incr("packets_ifdropped", int64(handleStats.PacketsIfDropped))
-				stats.GetLostPackets()
+				//the capture stats are running totals, so only count what is new since the last report
+				delta := captureStatsDelta(sourceStats, lastStats)
+				stats.Incr("packets_received", delta.received)
+				stats.Incr("packets_dropped", delta.dropped)
+				stats.Incr("packets_ifdropped", delta.ifDropped)
+
+				stats.Gauge("conntable_size", int64(conntables.len()))
+				stats.Gauge("conntable_bytes", conntables.bytes())
 			}
+			lastStats = sourceStats
+		case newConfig := <-reload:
+			reloadCapture(source, config, newConfig, gcReload)
+			scheduled.Stop()
+			scheduled = time.NewTicker(time.Duration(config.statsdInterval) * time.Second)
 		case <-finished:
 			log.Printf("gopassivedns: doCapture cleanly exiting.")
+			close(stop)
+			if readersDone != nil {
+				<-readersDone
+			}
+			if dnstapDone != nil {
+				<-dnstapDone
+			}
 			break CAPTURE
 		}
 	}
-	gracefulShutdown(channels, reassembledChan, logChan)
+	gracefulShutdown(channels, &workers, logChan)
+}
+
+// reloadCapture applies the parts of newConfig which can change without
+// restarting the capture handle or losing the conntable: the BPF filter,
+// the GC settings and the handle stats interval. config is updated to match.
+func reloadCapture(source captureSource, config *pdnsConfig, newConfig *pdnsConfig, gcReload chan gcSettings) {
+	if source != nil && newConfig.bpf != config.bpf {
+		if err := source.SetBPFFilter(newConfig.bpf); err != nil {
+			log.Printf("gopassivedns: unable to apply BPF filter '%s', keeping '%s': %s", newConfig.bpf, config.bpf, err)
+		} else {
+			log.Printf("gopassivedns: BPF filter is now '%s'", newConfig.bpf)
+			config.bpf = newConfig.bpf
+		}
+	}
+
+	if newConfig.gcAge != config.gcAge || newConfig.gcInterval != config.gcInterval || newConfig.logUnanswered != config.logUnanswered {
+		//both durations were checked by validateConfig when the config was loaded
+		gcAgeDur, _ := time.ParseDuration(newConfig.gcAge)
+		gcIntervalDur, _ := time.ParseDuration(newConfig.gcInterval)
+		gcReload <- gcSettings{maxAge: gcAgeDur, interval: gcIntervalDur, logUnanswered: newConfig.logUnanswered}
+		config.gcAge = newConfig.gcAge
+		config.gcInterval = newConfig.gcInterval
+		config.logUnanswered = newConfig.logUnanswered
+	}
+
+	config.statsdInterval = newConfig.statsdInterval
 }
 
 func main() {
@@ -574,44 +926,45 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	var stats *statsd.Client = nil
+	statsdClient := newStatsClient(config)
+	stats := newMetrics(config, statsdClient)
 
-	if config.statsdHost != "" {
-		stats = statsd.NewClient(
-			config.statsdHost,
-			statsd.TagStyle(statsd.TagFormatDatadog),
-			statsd.MetricPrefix(fmt.Sprintf("%s.%s.", config.statsdPrefix, config.sensorName)),
-			statsd.FlushInterval(time.Duration(config.statsdInterval)*time.Second),
-			statsd.BufPoolCapacity(packetQueue),
-			statsd.SendLoopCount(config.numprocs),
-		)
-	}
+	//with -dnstap the capture is optional
+	var source captureSource
+	if config.device != "" || config.pcapFile != "" || config.dnstap == "" {
+		source = initHandle(config)
 
-	handle := initHandle(config)
+		if source == nil {
+			log.Fatal("Could not initilize the capture.")
+		}
+	}
 
-	if handle == nil {
-		log.Fatal("Could not initilize the capture.")
+	var tap *dnstapInput
+	if config.dnstap != "" {
+		var err error
+		tap, err = newDnstapInput(config.dnstap)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	logOpts := newLogOptions(config)
 
 	logChan := initLogging(logOpts, config)
 
-	// setup the global reassembledChannel for tcp stream reassembly.
-	reassembledChan := make(chan TCPDataStruct)
-
 	sigs := make(chan os.Signal, 1)
 	done := make(chan bool, 1)
+	reload := newReloader(config, statsdClient)
 
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGKILL, syscall.SIGTERM, syscall.SIGHUP)
 
-	go watchSignals(sigs, done)
+	go watchSignals(sigs, done, reload)
 
 	// spin up logging thread(s)
-	go logConn(logChan, logOpts, stats)
+	go logConn(logChan, logOpts, stats, reload.logs)
 
 	// spin up the actual capture threads
-	doCapture(handle, config, logChan, reassembledChan, stats, done)
+	doCapture(source, tap, config, logChan, stats, done, reload.capture)
 
 	log.Debug("Done!  Goodbye.")
 }
@@ -7,6 +7,8 @@ import (
 	"net"
 	"os"
 	"os/user"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -14,9 +16,10 @@ import (
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/smira/go-statsd"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
-var stats *statsd.Client = nil
+var stats metrics = nil
 
 func getPacketData(which string) *gopacket.PacketSource {
 	var pcapFile string = "data/" + which + ".pcap"
@@ -29,7 +32,7 @@ func getPacketData(which string) *gopacket.PacketSource {
 	return gopacket.NewPacketSource(handle, handle.LinkType())
 }
 
-func getHandle(which string) *pcap.Handle {
+func getHandle(which string) captureSource {
 	var pcapFile string = "data/" + which + ".pcap"
 
 	handle, err := pcap.OpenOffline(pcapFile)
@@ -37,7 +40,7 @@ func getHandle(which string) *pcap.Handle {
 		return nil
 	}
 
-	return handle
+	return &pcapSource{handle: handle}
 }
 
 func getDNSLayers(which string) []*layers.DNS {
@@ -74,7 +77,10 @@ func ToSlice(c chan DNSLogEntry) []DNSLogEntry {
 func LogMirrorBg(source chan DNSLogEntry, target chan DNSLogEntry) {
 	for {
 		select {
-		case i := <-source:
+		case i, more := <-source:
+			if !more {
+				return
+			}
 			target <- i
 		case <-time.After(time.Second):
 			return
@@ -96,7 +102,7 @@ func BenchmarkALogEntry(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		logs = nil
-		initLogEntry(syslogPriority, srcIP, srcPort, dstIP, &length, &logProtocol, *DNSlayers[0], *DNSlayers[1], time.Now(), &logs)
+		initLogEntry(syslogPriority, logEntryOptions{sections: logAnswers}, srcIP, srcPort, dstIP, &length, &logProtocol, ingressInfo{}, *DNSlayers[0], *DNSlayers[1], time.Now(), time.Now(), &logs)
 	}
 }
 
@@ -112,7 +118,7 @@ func BenchmarkLogMarshal(b *testing.B) {
 	logs := []DNSLogEntry{}
 
 	logs = nil
-	initLogEntry(syslogPriority, srcIP, srcPort, dstIP, &length, &logProtocol, *DNSlayers[0], *DNSlayers[1], time.Now(), &logs)
+	initLogEntry(syslogPriority, logEntryOptions{sections: logAnswers}, srcIP, srcPort, dstIP, &length, &logProtocol, ingressInfo{}, *DNSlayers[0], *DNSlayers[1], time.Now(), time.Now(), &logs)
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
@@ -196,15 +202,13 @@ func BenchmarkHandleUDPPackets(b *testing.B) {
 		b.StopTimer()
 		packetChan := make(chan *packetData, 101)
 		for packet := range packetSource.Packets() {
-			packetChan <- newPacketData(packet)
+			packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 		}
 		close(packetChan)
 
 		b.StartTimer()
-		var conntable = connectionTable{
-			connections: make(map[string]DNSMapEntry),
-		}
-		handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+		conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+		handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 	}
 	close(logChan)
 }
@@ -361,15 +365,13 @@ func TestParseA(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 
 	//Consume load
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("a")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -436,15 +438,13 @@ func TestParseAAAA(t *testing.T) {
 	var syslogPriority string = "DEBUG"
 	var packetChan = make(chan *packetData)
 	var logChan = make(chan DNSLogEntry)
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, nil)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, nil)
 
 	packetSource := getPacketData("aaaa")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -513,15 +513,13 @@ func TestParseIPv6(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 
 	//Consume load
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("ipv6")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -590,15 +588,13 @@ func TestParseTXT(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 
 	//Consume load
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("txt")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -655,15 +651,13 @@ func TestParseSOA(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 
 	//Consume load
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("soa")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -691,6 +685,10 @@ func TestParseSOA(t *testing.T) {
 			t.Fatalf("Bad question type %s, expecting SOA\n", log.QuestionType)
 		}
 
+		if log.Answer != "ns1.google.com dns-admin.google.com 326921480 900 900 1800 60" {
+			t.Fatalf("Bad answer %s, expecting ns1.google.com dns-admin.google.com 326921480 900 900 1800 60\n", log.Answer)
+		}
+
 		if log.AnswerType != "SOA" {
 			t.Fatalf("Bad answer type %s, expecting SOA\n", log.AnswerType)
 		}
@@ -720,15 +718,13 @@ func TestParseCNAME(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 
 	//Consume load
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("cname")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -785,15 +781,13 @@ func TestParsePTR(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 
 	//Consume load
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("ptr")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -852,15 +846,13 @@ func TestParseNS(t *testing.T) {
 	var syslogPriority string = "DEBUG"
 	var packetChan = make(chan *packetData)
 	var logChan = make(chan DNSLogEntry)
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, nil)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, nil)
 
 	packetSource := getPacketData("ns")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -927,15 +919,13 @@ func TestParseMX(t *testing.T) {
 	var packetChan = make(chan *packetData)
 	var logChan = make(chan DNSLogEntry)
 
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, nil)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, nil)
 
 	packetSource := getPacketData("mx")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	select {
@@ -963,8 +953,8 @@ func TestParseMX(t *testing.T) {
 			t.Fatalf("Bad question type %s, expecting MX\n", log.QuestionType)
 		}
 
-		if log.Answer != "alt3.aspmx.l.google.com" {
-			t.Fatalf("Bad answer %s, expecting alt3.aspmx.l.google.com\n", log.Answer)
+		if log.Answer != "40 alt3.aspmx.l.google.com" {
+			t.Fatalf("Bad answer %s, expecting 40 alt3.aspmx.l.google.com\n", log.Answer)
 		}
 
 		if log.AnswerType != "MX" {
@@ -994,7 +984,7 @@ func TestParseMX(t *testing.T) {
 	}
 }
 
-func TestParseNXDOMAIN(t *testing.T) {
+func TestParseMXRData(t *testing.T) {
 	gcAge, _ := time.ParseDuration("-1m")
 	gcInterval, _ := time.ParseDuration("3m")
 
@@ -1002,15 +992,76 @@ func TestParseNXDOMAIN(t *testing.T) {
 	var packetChan = make(chan *packetData)
 	var logChan = make(chan DNSLogEntry)
 
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers, rdata: true}, gcInterval, gcAge, 1, nil)
+
+	packetSource := getPacketData("mx")
+	packetSource.DecodeOptions.Lazy = true
+	for packet := range packetSource.Packets() {
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
+	}
+
+	logs := ToSlice(logChan)
+
+	if len(logs) != 5 {
+		t.Fatalf("Expecting 5 logs, got %d", len(logs))
 	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, nil)
+
+	log := logs[0]
+
+	mx, ok := log.RData.(mxRData)
+	if !ok {
+		t.Fatalf("Bad rdata %T, expecting mxRData\n", log.RData)
+	}
+
+	if mx.Preference != 40 || mx.Exchange != "alt3.aspmx.l.google.com" {
+		t.Fatalf("Bad rdata %d %s, expecting 40 alt3.aspmx.l.google.com\n", mx.Preference, mx.Exchange)
+	}
+
+	if log.Answer != "40 alt3.aspmx.l.google.com" {
+		t.Fatalf("Bad answer %s, expecting 40 alt3.aspmx.l.google.com\n", log.Answer)
+	}
+
+	encoded, err := log.Encode()
+	if err != nil {
+		t.Fatal("log marshaling error!")
+	}
+
+	if !strings.Contains(string(encoded), `"rdata":{"preference":40,"exchange":"alt3.aspmx.l.google.com"}`) {
+		t.Fatalf("rdata missing from %s", encoded)
+	}
+
+	packed, err := log.MarshalMsgpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var unpacked map[string]interface{}
+	if err := msgpack.Unmarshal(packed, &unpacked); err != nil {
+		t.Fatal(err)
+	}
+
+	rd, ok := unpacked["rdata"].(map[string]interface{})
+	if !ok || rd["exchange"] != "alt3.aspmx.l.google.com" {
+		t.Fatalf("Bad msgpack rdata %v", unpacked["rdata"])
+	}
+}
+
+func TestParseNXDOMAIN(t *testing.T) {
+	gcAge, _ := time.ParseDuration("-1m")
+	gcInterval, _ := time.ParseDuration("3m")
+
+	var syslogPriority string = "DEBUG"
+	var packetChan = make(chan *packetData)
+	var logChan = make(chan DNSLogEntry)
+
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, nil)
 
 	packetSource := getPacketData("nxdomain")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	logs := ToSlice(logChan)
@@ -1065,6 +1116,42 @@ func TestParseNXDOMAIN(t *testing.T) {
 	}
 }
 
+func TestParseNXDOMAINAuthority(t *testing.T) {
+	gcAge, _ := time.ParseDuration("-1m")
+	gcInterval, _ := time.ParseDuration("3m")
+
+	var syslogPriority string = "DEBUG"
+	var packetChan = make(chan *packetData)
+	var logChan = make(chan DNSLogEntry)
+
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers | logAuthorities}, gcInterval, gcAge, 1, nil)
+
+	packetSource := getPacketData("nxdomain")
+	packetSource.DecodeOptions.Lazy = true
+	for packet := range packetSource.Packets() {
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
+	}
+
+	logs := ToSlice(logChan)
+
+	if len(logs) != 2 {
+		t.Fatalf("Expecting an rcode and an authority log, got %d", len(logs))
+	}
+
+	if logs[0].Section != "answer" || logs[0].Answer != "Non-Existent Domain" {
+		t.Fatalf("Bad first log %s %s, expecting the rcode in the answer section\n", logs[0].Section, logs[0].Answer)
+	}
+
+	if logs[1].Section != "authority" || logs[1].AnswerType != "SOA" {
+		t.Fatalf("Bad second log %s %s, expecting an SOA in the authority section\n", logs[1].Section, logs[1].AnswerType)
+	}
+
+	if logs[1].Question != "asdtartfgeasf.asdfgsdf.com" {
+		t.Fatalf("Bad question %s, expecting asdtartfgeasf.asdfgsdf.com\n", logs[1].Question)
+	}
+}
+
 func TestParseMultipleUDPPackets(t *testing.T) {
 	gcAge, _ := time.ParseDuration("-1m")
 	gcInterval, _ := time.ParseDuration("3m")
@@ -1075,15 +1162,13 @@ func TestParseMultipleUDPPackets(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 	var syslogPriority string = "DEBUG"
 
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, nil)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, nil)
 
 	packetSource := getPacketData("multiple_udp")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 	}
 
 	logs := ToSlice(logChan)
@@ -1128,23 +1213,29 @@ func TestDoCaptureIPv6TCP(t *testing.T) {
 
 	handle := getHandle("ipv6_tcp")
 	var logChan = make(chan DNSLogEntry, 400)
-	var reChan = make(chan TCPDataStruct, 1000)
 	var logStash = make(chan DNSLogEntry, 400)
 	var done = make(chan bool, 1)
 
 	go LogMirrorBg(logChan, logStash)
 
-	doCapture(handle, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, reChan, stats, done)
+	doCapture(handle, nil, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, stats, done, nil)
 
 	logs := ToSlice(logStash)
-	if len(logs) != 0 {
-		t.Errorf("expected 0 got %d", len(logs))
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 got %d", len(logs))
+	}
+
+	if logs[0].Question != "_spf.google.com" || logs[0].AnswerType != "TXT" {
+		t.Fatalf("Bad question %s %s, expecting _spf.google.com TXT", logs[0].Question, logs[0].AnswerType)
+	}
+
+	if logs[0].Proto != "tcp" {
+		t.Fatalf("Bad protocol %s, expecting tcp", logs[0].Proto)
 	}
-	//fmt.Println(len(logs))
 }
 
 /*
-doCapture(handle *pcap.Handle, logChan chan DNSLogEntry,
+doCapture(source captureSource, logChan chan DNSLogEntry,
 	gcAge string, gcInterval string, numprocs int) {
 */
 
@@ -1152,13 +1243,12 @@ func TestDoCaptureUDP(t *testing.T) {
 
 	handle := getHandle("100_udp_lookups")
 	var logChan = make(chan DNSLogEntry, 100)
-	var reChan = make(chan TCPDataStruct)
 	var logStash = make(chan DNSLogEntry, 100)
 	var done = make(chan bool, 1)
 
 	go LogMirrorBg(logChan, logStash)
 
-	doCapture(handle, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, reChan, stats, done)
+	doCapture(handle, nil, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, stats, done, nil)
 
 	logs := ToSlice(logStash)
 
@@ -1172,13 +1262,12 @@ func TestDoCaptureTCP(t *testing.T) {
 
 	handle := getHandle("100_tcp_lookups")
 	var logChan = make(chan DNSLogEntry, 400)
-	var reChan = make(chan TCPDataStruct, 1000)
 	var logStash = make(chan DNSLogEntry, 400)
 	var done = make(chan bool, 1)
 
 	go LogMirrorBg(logChan, logStash)
 
-	doCapture(handle, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, reChan, stats, done)
+	doCapture(handle, nil, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, stats, done, nil)
 
 	logs := ToSlice(logStash)
 
@@ -1188,6 +1277,302 @@ func TestDoCaptureTCP(t *testing.T) {
 
 }
 
+func TestDoCaptureMultipleSources(t *testing.T) {
+
+	udp := getHandle("100_udp_lookups").(*pcapSource)
+	udp.iface = "eth0"
+	tcp := getHandle("100_tcp_lookups").(*pcapSource)
+	tcp.iface = "eth1"
+	var logChan = make(chan DNSLogEntry, 400)
+	var logStash = make(chan DNSLogEntry, 400)
+	var done = make(chan bool, 1)
+
+	go LogMirrorBg(logChan, logStash)
+
+	//each source is read by its own goroutine, and capture only ends when both have finished
+	doCapture(multiSource{udp, tcp}, nil, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, stats, done, nil)
+
+	logs := ToSlice(logStash)
+
+	if len(logs) != 350 {
+		t.Fatalf("Expecting 350 logs, got %d", len(logs))
+	}
+
+	//reassembled TCP keeps the interface its packets were captured on
+	for _, entry := range logs {
+		want := map[string]string{udpString: "eth0", tcpString: "eth1"}[entry.Proto]
+		if entry.Interface != want {
+			t.Fatalf("Bad interface %s for a %s lookup, expecting %s", entry.Interface, entry.Proto, want)
+		}
+	}
+
+}
+
+func TestLinkTypes(t *testing.T) {
+	//the cname lookup, re-encapsulated in each of the link layers
+	for which, vlans := range map[string][]uint16{
+		"cname":      nil,
+		"cname_vlan": {100},
+		"cname_qinq": {200, 100},
+		"cname_mpls": nil,
+		"cname_sll":  nil,
+		"cname_sll2": nil,
+		"cname_raw":  nil,
+	} {
+		source := getHandle(which).PacketSources()[0]
+		firstLayer, err := firstLayerType(source.linkType)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		packetChan := make(chan *packetData, 10)
+		for packet := range source.packets.Packets() {
+			packetChan <- newPacketData(packet, firstLayer, "")
+		}
+		close(packetChan)
+
+		logChan := make(chan DNSLogEntry, 10)
+		conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+		handlePacket(conntable, packetChan, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, time.Minute, -time.Minute, 0, stats)
+		close(logChan)
+
+		var logs []DNSLogEntry
+		for entry := range logChan {
+			logs = append(logs, entry)
+		}
+
+		if len(logs) != 1 {
+			t.Fatalf("Expecting 1 log from %s, got %d", which, len(logs))
+		}
+		if logs[0].Question != "ipv6.google.com" || !reflect.DeepEqual(logs[0].VLANs, vlans) {
+			t.Fatalf("Bad entry for %s with question %s and VLANs %v, expecting ipv6.google.com and %v", which, logs[0].Question, logs[0].VLANs, vlans)
+		}
+	}
+}
+
+func TestFirstLayerType(t *testing.T) {
+	for linkType, want := range map[layers.LinkType]gopacket.LayerType{
+		layers.LinkTypeEthernet: layers.LayerTypeEthernet,
+		layers.LinkTypeNull:     layers.LayerTypeLoopback,
+		dltLoop:                 layers.LayerTypeLoopback,
+		layers.LinkTypeRaw:      layerTypeRawIP,
+		dltRaw:                  layerTypeRawIP,
+		linkTypeLinuxSLL2:       layerTypeLinuxSLL2,
+	} {
+		if got, err := firstLayerType(linkType); err != nil || got != want {
+			t.Fatalf("Bad first layer %s for link type %d, expecting %s (%v)", got, linkType, want, err)
+		}
+	}
+
+	if _, err := firstLayerType(layers.LinkTypeFDDI); err == nil {
+		t.Fatal("firstLayerType did not fail on FDDI")
+	}
+}
+
+func TestTunnels(t *testing.T) {
+	vni, session := uint32(42), uint16(7)
+	//the cname lookup, mirrored from 10.0.0.5 to 10.0.0.9 in each of the tunnels
+	for which, tunnel := range map[string]tunnelInfo{
+		"cname_gre":     {Type: tunnelGRE},
+		"cname_erspan2": {Type: tunnelERSPAN, Session: &session},
+		"cname_erspan3": {Type: tunnelERSPAN, Session: &session},
+		"cname_vxlan":   {Type: tunnelVXLAN, VNI: &vni},
+		"cname_geneve":  {Type: tunnelGeneve, VNI: &vni},
+	} {
+		tunnel.Src, tunnel.Dst = "10.0.0.5", "10.0.0.9"
+
+		packetChan := make(chan *packetData, 10)
+		for packet := range getPacketData(which).Packets() {
+			pd := newPacketData(packet, layers.LayerTypeEthernet, "")
+			pd.decapsulate = true
+			packetChan <- pd
+		}
+		close(packetChan)
+
+		logChan := make(chan DNSLogEntry, 10)
+		conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+		handlePacket(conntable, packetChan, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, time.Minute, -time.Minute, 0, stats)
+		close(logChan)
+
+		var logs []DNSLogEntry
+		for entry := range logChan {
+			logs = append(logs, entry)
+		}
+
+		if len(logs) != 1 {
+			t.Fatalf("Expecting 1 log from %s, got %d", which, len(logs))
+		}
+		if logs[0].Question != "ipv6.google.com" || logs[0].Client.To4() != nil || logs[0].Server.To4() != nil {
+			t.Fatalf("Bad entry for %s with question %s from %s to %s, expecting ipv6.google.com between IPv6 addresses", which, logs[0].Question, logs[0].Client, logs[0].Server)
+		}
+		if logs[0].Tunnel == nil || !reflect.DeepEqual(*logs[0].Tunnel, tunnel) {
+			t.Fatalf("Bad tunnel %+v for %s, expecting %+v", logs[0].Tunnel, which, tunnel)
+		}
+	}
+
+	//without -decapsulate the tunnel is left alone
+	packetChan := make(chan *packetData, 10)
+	for packet := range getPacketData("cname_vxlan").Packets() {
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
+	}
+	close(packetChan)
+
+	logChan := make(chan DNSLogEntry, 10)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	handlePacket(conntable, packetChan, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, time.Minute, -time.Minute, 0, stats)
+	close(logChan)
+
+	if entry, more := <-logChan; more {
+		t.Fatalf("Logged %s from a tunnel without decapsulating it", entry.Question)
+	}
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	//the txt lookup, with the response split into 3 fragments that arrive out of order
+	for which, client := range map[string]string{"txt_fragmented": "::1", "txt_fragmented_v4": "192.0.2.10"} {
+		packetChan := make(chan *packetData, 10)
+		dispatchPackets(getHandle(which).PacketSources()[0], []chan *packetData{packetChan}, dispatchOptions{defrag: defragLimits{timeout: time.Minute, maxBytes: 1 << 20}}, stats, make(chan struct{}))
+		close(packetChan)
+
+		if len(packetChan) != 2 {
+			t.Fatalf("Expecting the query and reassembled response from %s, got %d packets", which, len(packetChan))
+		}
+
+		logChan := make(chan DNSLogEntry, 10)
+		conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+		handlePacket(conntable, packetChan, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, time.Minute, -time.Minute, 0, stats)
+		close(logChan)
+
+		var logs []DNSLogEntry
+		for entry := range logChan {
+			logs = append(logs, entry)
+		}
+
+		//one for each of the two TXT records
+		if len(logs) != 2 {
+			t.Fatalf("Expecting 2 logs from %s, got %d", which, len(logs))
+		}
+		for _, entry := range logs {
+			if entry.Question != "gmail.com" || entry.AnswerType != "TXT" || entry.Client.String() != client {
+				t.Fatalf("Bad entry for %s with question %s and %s answer from %s, expecting gmail.com and TXT from %s", which, entry.Question, entry.AnswerType, entry.Client, client)
+			}
+		}
+	}
+
+	//without reassembly only the query gets through
+	packetChan := make(chan *packetData, 10)
+	dispatchPackets(getHandle("txt_fragmented_v4").PacketSources()[0], []chan *packetData{packetChan}, dispatchOptions{}, stats, make(chan struct{}))
+	if len(packetChan) != 4 {
+		t.Fatalf("Expecting the query and 3 fragments without reassembly, got %d packets", len(packetChan))
+	}
+}
+
+func TestDNSFramer(t *testing.T) {
+	stream := []byte{0, 3, 'a', 'b', 'c', 0, 0, 0, 2, 'd', 'e', 0, 4, 'f'}
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	//one byte at a time, as if every byte arrived in its own 60 byte packet
+	var framer dnsFramer
+	var frames []dnsFrame
+	for i, b := range stream {
+		frames = append(frames, framer.push([]byte{b}, start.Add(time.Duration(i)*time.Millisecond), 60)...)
+	}
+
+	if len(frames) != 2 {
+		t.Fatalf("Bad number of messages %d, expecting 2", len(frames))
+	}
+	if string(frames[0].data) != "abc" || !frames[0].first.Equal(start) || !frames[0].last.Equal(start.Add(4*time.Millisecond)) || frames[0].size != 5*60 {
+		t.Fatalf("Bad first message %q %s %s %d", frames[0].data, frames[0].first, frames[0].last, frames[0].size)
+	}
+	//the empty message is skipped, "de" starts at offset 7
+	if string(frames[1].data) != "de" || !frames[1].first.Equal(start.Add(7*time.Millisecond)) || !frames[1].last.Equal(start.Add(10*time.Millisecond)) || frames[1].size != 4*60 {
+		t.Fatalf("Bad second message %q %s %s %d", frames[1].data, frames[1].first, frames[1].last, frames[1].size)
+	}
+
+	//the whole stream in one segment, which carried both messages
+	framer = dnsFramer{}
+	frames = framer.push(stream, start, 100)
+	if len(frames) != 2 || string(frames[0].data) != "abc" || string(frames[1].data) != "de" || frames[0].size != 100 || frames[1].size != 100 {
+		t.Fatalf("Bad messages %+v from a single segment", frames)
+	}
+
+	//the truncated message is completed by the next segment, and carried by both
+	frames = framer.push([]byte{'g', 'h', 'i'}, start.Add(time.Second), 50)
+	if len(frames) != 1 || string(frames[0].data) != "fghi" || !frames[0].first.Equal(start) || frames[0].size != 150 {
+		t.Fatalf("Bad message %+v from a continued segment", frames)
+	}
+
+	//nothing is framed after data has been lost
+	framer = dnsFramer{lost: true}
+	if frames = framer.push(stream, start, 100); len(frames) != 0 {
+		t.Fatalf("Expecting no messages after lost data, got %d", len(frames))
+	}
+}
+
+func TestDoCapturePipelinedTCP(t *testing.T) {
+
+	handle := getHandle("pipelined_tcp")
+	var logChan = make(chan DNSLogEntry, 10)
+	var logStash = make(chan DNSLogEntry, 10)
+	var done = make(chan bool, 1)
+
+	go LogMirrorBg(logChan, logStash)
+
+	doCapture(handle, nil, &pdnsConfig{gcAge: "-1m", gcInterval: "3m", numprocs: 8, statsdInterval: 3}, logChan, stats, done, nil)
+
+	logs := ToSlice(logStash)
+
+	//four queries on one connection, pipelined and split across segments
+	if len(logs) != 4 {
+		t.Fatalf("Expecting 4 logs, got %d", len(logs))
+	}
+
+	//the responses arrive in two segments, a and b in the first, d in the
+	//second and c split over both.  The queries all started 3ms earlier.
+	expected := map[string]struct {
+		length  int
+		elapsed time.Duration
+	}{
+		"a.example.com": {179, 3 * time.Millisecond},
+		"b.example.com": {179, 3 * time.Millisecond},
+		"c.example.com": {179 + 177, 4 * time.Millisecond},
+		"d.example.com": {177, 3 * time.Millisecond},
+	}
+
+	answers := make(map[string]string)
+	for _, log := range logs {
+		answers[log.Question] = log.Answer
+
+		//the ports and size come from the reassembled stream
+		if log.ClientPort != 40000 || log.Proto != "tcp" {
+			t.Fatalf("Bad client port %d %s, expecting 40000 tcp", log.ClientPort, log.Proto)
+		}
+		if log.Length != expected[log.Question].length {
+			t.Fatalf("Bad length %d for %s, expecting the %d bytes of the response's segments", log.Length, log.Question, expected[log.Question].length)
+		}
+
+		//the times come from the capture, which was made on 2021-06-01
+		if !strings.HasPrefix(log.Timestamp, "2021-06-01T12:00:00.") {
+			t.Fatalf("Bad timestamp %s for %s, expecting the capture time", log.Timestamp, log.Question)
+		}
+		//the response is timed from the segment that completed it
+		if log.Elapsed != expected[log.Question].elapsed.Nanoseconds() {
+			t.Fatalf("Bad elapsed %d for %s, expecting %s between query and response", log.Elapsed, log.Question, expected[log.Question].elapsed)
+		}
+	}
+
+	for question, answer := range map[string]string{
+		"a.example.com": "192.0.2.1",
+		"b.example.com": "192.0.2.2",
+		"c.example.com": "192.0.2.3",
+		"d.example.com": "192.0.2.4",
+	} {
+		if answers[question] != answer {
+			t.Fatalf("Bad answer %s for %s, expecting %s", answers[question], question, answer)
+		}
+	}
+}
+
 /*
 
 func TestDoCaptureMixed(*testing.T){
@@ -1233,16 +1618,14 @@ func TestConntableGC(t *testing.T) {
 	var logChan = make(chan DNSLogEntry)
 	var finished = make(chan bool)
 
-	var conntable = connectionTable{
-		connections: make(map[string]DNSMapEntry),
-	}
-	go cleanDNSCache(&conntable, gcAge, gcInterval, stats, finished)
-	go handlePacket(&conntable, packetChan, logChan, syslogPriority, gcInterval, gcAge, 1, stats)
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	go cleanDNSCache(connectionTables{conntable}, gcSettings{maxAge: gcAge, interval: gcInterval}, logChan, syslogPriority, logEntryOptions{}, stats, finished, nil)
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, gcInterval, gcAge, 1, stats)
 
 	packetSource := getPacketData("mx")
 	packetSource.DecodeOptions.Lazy = true
 	for packet := range packetSource.Packets() {
-		packetChan <- newPacketData(packet)
+		packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
 		time.Sleep(time.Duration(11) * time.Second)
 	}
 
@@ -1254,6 +1637,183 @@ func TestConntableGC(t *testing.T) {
 	}
 }
 
+func TestConntableGCUnanswered(t *testing.T) {
+	var syslogPriority string = "DEBUG"
+	var packetChan = make(chan *packetData)
+	var logChan = make(chan DNSLogEntry)
+	var finished = make(chan bool)
+	defer close(finished)
+
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	settings := gcSettings{maxAge: -time.Second, interval: 100 * time.Millisecond, logUnanswered: true}
+	go cleanDNSCache(connectionTables{conntable}, settings, logChan, syslogPriority, logEntryOptions{}, stats, finished, nil)
+	go handlePacket(conntable, packetChan, logChan, syslogPriority, logEntryOptions{sections: logAnswers}, settings.interval, settings.maxAge, 1, stats)
+
+	//only send the question, the capture is old enough to be collected straight away
+	packetSource := getPacketData("mx")
+	packetSource.DecodeOptions.Lazy = true
+	packet, err := packetSource.NextPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetChan <- newPacketData(packet, layers.LayerTypeEthernet, "")
+
+	select {
+	case logEntry := <-logChan:
+		if logEntry.Answer != "NOANSWER" {
+			t.Fatalf("expected a NOANSWER entry, got %s", logEntry.Answer)
+		}
+		if logEntry.Question != "google.com" || logEntry.QuestionType != "MX" {
+			t.Fatalf("unexpected question %s %s", logEntry.Question, logEntry.QuestionType)
+		}
+		if logEntry.Client.String() != "172.17.64.6" || logEntry.Server.String() != "172.17.0.1" {
+			t.Fatalf("unexpected client/server %s/%s", logEntry.Client, logEntry.Server)
+		}
+		if logEntry.Proto != "udp" {
+			t.Fatalf("expected proto udp, got %s", logEntry.Proto)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the unanswered query to be logged")
+	}
+}
+
+func TestWorkerForDistribution(t *testing.T) {
+	const flows = 60000
+
+	for _, numprocs := range []int{1, 2, 3, 6, 8, 12} {
+		counts := make([]int, numprocs)
+		for i := 0; i < flows; i++ {
+			src := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4()
+			flow := gopacket.NewFlow(layers.EndpointIPv4, src, net.IPv4(192, 0, 2, 53).To4())
+			counts[workerFor(flow.FastHash(), numprocs)]++
+		}
+
+		//every worker should get within 10% of an even share
+		even := flows / numprocs
+		for worker, count := range counts {
+			if count < even*9/10 || count > even*11/10 {
+				t.Fatalf("Worker %d of %d got %d flows, expecting about %d", worker, numprocs, count, even)
+			}
+		}
+	}
+}
+
+func TestFlowHashSymmetric(t *testing.T) {
+	client, server := net.IPv4(192, 0, 2, 1).To4(), net.IPv4(192, 0, 2, 53).To4()
+	network := gopacket.NewFlow(layers.EndpointIPv4, client, server)
+	hashes := make(map[uint64]bool)
+
+	for port := 1024; port < 2048; port++ {
+		transport := gopacket.NewFlow(layers.EndpointUDPPort, []byte{byte(port >> 8), byte(port)}, []byte{0, 53})
+
+		hash := flowHash(network, transport)
+		if reverse := flowHash(network.Reverse(), transport.Reverse()); reverse != hash {
+			t.Fatalf("Bad hash %x for the response from port %d, expecting %x", reverse, port, hash)
+		}
+		hashes[hash] = true
+	}
+
+	//lookups between the same two hosts are spread over the workers by port
+	if len(hashes) != 1024 {
+		t.Fatalf("Only %d different hashes for 1024 client ports", len(hashes))
+	}
+}
+
+func TestConntableKey(t *testing.T) {
+	client, server := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")
+	question := []layers.DNSQuestion{{Name: []byte("Example.COM"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}
+
+	query := &layers.DNS{ID: 4242, Questions: question}
+	response := &layers.DNS{ID: 4242, QR: true, Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+
+	key := conntableKey(query, packetString, client, server, 40000, 53)
+	if other := conntableKey(response, packetString, server, client, 53, 40000); other != key {
+		t.Fatalf("Bad key %s for the response, expecting %s", other, key)
+	}
+
+	//the same ID and ports from another client or resolver is another lookup
+	if other := conntableKey(query, packetString, net.ParseIP("192.0.2.2"), server, 40000, 53); other == key {
+		t.Fatalf("Key %s is shared by two clients", key)
+	}
+	if other := conntableKey(query, packetString, client, net.ParseIP("192.0.2.54"), 40000, 53); other == key {
+		t.Fatalf("Key %s is shared by two servers", key)
+	}
+	if other := conntableKey(query, tcpString, client, server, 40000, 53); other == key {
+		t.Fatalf("Key %s is shared by UDP and TCP", key)
+	}
+	mx := &layers.DNS{ID: 4242, Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeMX, Class: layers.DNSClassIN}}}
+	if other := conntableKey(mx, packetString, client, server, 40000, 53); other == key {
+		t.Fatalf("Key %s is shared by two question types", key)
+	}
+}
+
+func TestHandleDNSQuestionMismatch(t *testing.T) {
+	client, server := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")
+	logChan := make(chan DNSLogEntry, 10)
+	protocol := packetString
+	length := 100
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+
+	query := &layers.DNS{ID: 4242, RD: true, Questions: []layers.DNSQuestion{{Name: []byte("eXaMpLe.CoM"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+	handleDNS(conntable, query, logChan, "DEBUG", logEntryOptions{sections: logAnswers, mismatches: true}, client, server, 40000, 53, &length, &protocol, ingressInfo{}, time.Now(), stats)
+
+	//the case of the name differs, so this isn't the answer to our query
+	spoofed := &layers.DNS{ID: 4242, QR: true, Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		Answers: []layers.DNSResourceRecord{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.ParseIP("203.0.113.1")}}}
+	handleDNS(conntable, spoofed, logChan, "DEBUG", logEntryOptions{sections: logAnswers, mismatches: true}, server, client, 53, 40000, &length, &protocol, ingressInfo{}, time.Now(), stats)
+
+	//the query is logged as MISMATCH, but still waits for its real answer
+	if len(logChan) != 1 || conntable.len() != 1 {
+		t.Fatalf("Mismatched response was logged, %d logs and %d conntable entries", len(logChan), conntable.len())
+	}
+	if entry := <-logChan; entry.Answer != mismatchString || entry.Question != "eXaMpLe.CoM" || !entry.Client.Equal(client) || entry.ClientPort != 40000 {
+		t.Fatalf("Bad mismatch log entry %s %s %s:%d, expecting MISMATCH for eXaMpLe.CoM", entry.Answer, entry.Question, entry.Client, entry.ClientPort)
+	}
+
+	//without log_mismatches there is only the metric
+	handleDNS(conntable, spoofed, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, server, client, 53, 40000, &length, &protocol, ingressInfo{}, time.Now(), stats)
+	if len(logChan) != 0 || conntable.len() != 1 {
+		t.Fatalf("Mismatched response was logged, %d logs and %d conntable entries", len(logChan), conntable.len())
+	}
+
+	answer := &layers.DNS{ID: 4242, QR: true, Questions: query.Questions,
+		Answers: []layers.DNSResourceRecord{{Name: []byte("eXaMpLe.CoM"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, IP: net.ParseIP("192.0.2.80")}}}
+	handleDNS(conntable, answer, logChan, "DEBUG", logEntryOptions{sections: logAnswers, mismatches: true}, server, client, 53, 40000, &length, &protocol, ingressInfo{}, time.Now(), stats)
+
+	if len(logChan) != 1 || conntable.len() != 0 {
+		t.Fatalf("Matching response wasn't logged, %d logs and %d conntable entries", len(logChan), conntable.len())
+	}
+	if entry := <-logChan; entry.Answer != "192.0.2.80" || !entry.Client.Equal(client) || entry.ClientPort != 40000 {
+		t.Fatalf("Bad log entry %s %s:%d", entry.Answer, entry.Client, entry.ClientPort)
+	}
+}
+
+func TestHandleDNSEvictedUnanswered(t *testing.T) {
+	client, server := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.53")
+	logChan := make(chan DNSLogEntry, 10)
+	protocol := packetString
+	length := 100
+
+	for _, keep := range []bool{false, true} {
+		//one shard with room for one query, so the second evicts the first
+		conntable := newConnectionTable(1, conntableLimits{maxEntries: 1})
+		conntable.setKeepEvicted(keep)
+		for _, name := range []string{"first.example.com", "second.example.com"} {
+			query := &layers.DNS{ID: 4242, RD: true, Questions: []layers.DNSQuestion{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}}}
+			handleDNS(conntable, query, logChan, "DEBUG", logEntryOptions{sections: logAnswers}, client, server, 40000, 53, &length, &protocol, ingressInfo{}, time.Now(), stats)
+		}
+
+		if want := map[bool]int{true: 1, false: 0}[keep]; len(logChan) != want || conntable.len() != 1 {
+			t.Fatalf("Bad eviction handling, %d logs and %d conntable entries, expecting %d and 1", len(logChan), conntable.len(), want)
+		}
+		if keep {
+			if entry := <-logChan; entry.Answer != "NOANSWER" || entry.Question != "first.example.com" {
+				t.Fatalf("Bad evicted query log entry %s %s, expecting NOANSWER for first.example.com", entry.Answer, entry.Question)
+			}
+		}
+	}
+}
+
 /*
 func TestTcpNoPayload(*testing.T){
 
@@ -1398,6 +1958,50 @@ func TestParsePriority(t *testing.T) {
 
 }
 
+func TestParseTimestampFormat(t *testing.T) {
+	captured := time.Date(2021, 6, 1, 12, 0, 0, 1500, time.UTC)
+
+	for format, want := range map[string]string{
+		"":        "2021-06-01T12:00:00.0000015Z",
+		"rfc3339": "2021-06-01T12:00:00.0000015Z",
+		"EPOCH":   "1622548800.000001500",
+	} {
+		tf, err := parseTimestampFormat(format)
+		if err != nil {
+			t.Fatalf("Bad timestamp format %s: %s", format, err)
+		}
+		if got := tf.format(captured); got != want {
+			t.Fatalf("Bad timestamp %s for format %s, expecting %s", got, format, want)
+		}
+	}
+
+	if _, err := parseTimestampFormat("unix"); err == nil {
+		t.Fatal("expected an error for an unknown timestamp format")
+	}
+}
+
+func TestParseLogSections(t *testing.T) {
+	m := make(map[string]logSections)
+
+	m["answer"] = logAnswers
+	m["answer,authority"] = logAnswers | logAuthorities
+	m["Answer, Additional"] = logAnswers | logAdditionals
+	m["authority,additional"] = logAuthorities | logAdditionals
+	m[""] = logAnswers
+
+	for k, v := range m {
+		sections, err := parseLogSections(k)
+		if sections != v || err != nil {
+			t.Fatalf("sections %q parsed as %d, expecting %d", k, sections, v)
+		}
+	}
+
+	sections, err := parseLogSections("answer,glue")
+	if sections != 0 || err == nil {
+		t.Fatal("sections 'answer,glue' did not return an error")
+	}
+}
+
 /*
 func TestInitLogging(t *testing.T){
 
@@ -1412,13 +2016,15 @@ func TestMain(m *testing.M) {
 	flag.Parse()
 
 	if *statsdHost != "" {
-		stats = statsd.NewClient(
+		statsdClient := &statsClient{}
+		statsdClient.Swap(statsd.NewClient(
 			*statsdHost,
 			statsd.TagStyle(statsd.TagFormatDatadog),
 			statsd.MetricPrefix(fmt.Sprintf("%s.%s.", *statsdPrefix, "gopassivedns")),
 			statsd.FlushInterval(time.Duration(*statsdInterval)*time.Second),
 			statsd.BufPoolCapacity(packetQueue),
-		)
+		))
+		stats = statsdClient
 	}
 
 	os.Exit(m.Run())
@@ -23,13 +23,21 @@ type logEntry struct {
 	Level               string                 `msgpack:"level,omitempty"` // syslog level omitted if empty
 	Length              int                    `msgpack:"bytes"`
 	Proto               string                 `msgpack:"protocol"`
+	Interface           string                 `msgpack:"interface,omitempty"`
+	VLANs               []uint16               `msgpack:"vlan,omitempty"`
+	Tunnel              *tunnelInfo            `msgpack:"tunnel,omitempty"`
 	Truncated           bool                   `msgpack:"truncated"`
 	AuthoritativeAnswer bool                   `msgpack:"aa"`
 	RecursionDesired    bool                   `msgpack:"rd"`
 	RecursionAvailable  bool                   `msgpack:"ra"`
 	ResponseSz          uint16                 `msgpack:"response_size"` // response size
 	QuestionSz          uint16                 `msgpack:"question_size"` // question size
+	Section             string                 `msgpack:"section"`
+	RData               rdata                  `msgpack:"rdata,omitempty"`
+	EDNS                *ednsInfo              `msgpack:"edns,omitempty"`
+	QueryEDNS           *ednsInfo              `msgpack:"query_edns,omitempty"`
 	Additionals         bool                   `msgpack:"additionals"`
+	ProcessingLag       int64                  `msgpack:"processing_lag"`
 }
 
 // MarshalMsgpack returns the binary messagepack encoded log entry.
@@ -50,13 +58,21 @@ func (dle *DNSLogEntry) MarshalMsgpack() ([]byte, error) {
 		Level:               dle.Level,
 		Length:              dle.Length,
 		Proto:               dle.Proto,
+		Interface:           dle.Interface,
+		VLANs:               dle.VLANs,
+		Tunnel:              dle.Tunnel,
 		Truncated:           dle.Truncated,
 		AuthoritativeAnswer: dle.AuthoritativeAnswer,
 		RecursionDesired:    dle.RecursionDesired,
 		RecursionAvailable:  dle.RecursionAvailable,
 		ResponseSz:          dle.ResponseSz,
 		QuestionSz:          dle.QuestionSz,
+		Section:             dle.Section,
+		RData:               dle.RData,
+		EDNS:                dle.EDNS,
+		QueryEDNS:           dle.QueryEDNS,
 		Additionals:         dle.Additionals,
+		ProcessingLag:       dle.ProcessingLag,
 	})
 }
 
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"time"
+)
+
+// metricTag labels a metric, e.g. with the worker or log sink it came from.
+type metricTag struct {
+	name  string
+	value string
+}
+
+// metrics is implemented by each telemetry backend (statsd and Prometheus).
+type metrics interface {
+	// Incr adds count to a counter.
+	Incr(stat string, count int64, tags ...metricTag)
+	// Gauge sets a gauge to value.
+	Gauge(stat string, value int64, tags ...metricTag)
+	// Timing records a duration, e.g. the time taken to answer a query.
+	Timing(stat string, value time.Duration, tags ...metricTag)
+}
+
+// multiMetrics sends every metric to each of its backends.
+type multiMetrics []metrics
+
+func (m multiMetrics) Incr(stat string, count int64, tags ...metricTag) {
+	for _, backend := range m {
+		backend.Incr(stat, count, tags...)
+	}
+}
+
+func (m multiMetrics) Gauge(stat string, value int64, tags ...metricTag) {
+	for _, backend := range m {
+		backend.Gauge(stat, value, tags...)
+	}
+}
+
+func (m multiMetrics) Timing(stat string, value time.Duration, tags ...metricTag) {
+	for _, backend := range m {
+		backend.Timing(stat, value, tags...)
+	}
+}
+
+// newMetrics returns the metrics backends enabled in config. The statsd client
+// is always part of it, so that a statsd target can be added on SIGHUP.
+func newMetrics(config *pdnsConfig, statsdClient *statsClient) metrics {
+	if config.prometheusListen == "" {
+		return statsdClient
+	}
+
+	prom := newPromMetrics()
+	go servePromMetrics(config.prometheusListen, prom)
+
+	return multiMetrics{statsdClient, prom}
+}
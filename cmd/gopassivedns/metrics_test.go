@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/smira/go-statsd"
+)
+
+func TestStatsdName(t *testing.T) {
+	if name := statsdName("packets", nil); name != "packets" {
+		t.Fatalf("expected packets, got %s", name)
+	}
+
+	if name := statsdName("dns_lookups", []metricTag{{name: "worker", value: "3"}}); name != "3.dns_lookups" {
+		t.Fatalf("expected 3.dns_lookups, got %s", name)
+	}
+}
+
+func TestNilStatsClient(t *testing.T) {
+	var stats *statsClient
+
+	// none of these should panic without a statsd target
+	stats.Incr("packets", 1)
+	stats.Gauge("conntable_size", 1)
+	stats.Timing("answer_latency", time.Millisecond)
+}
+
+func TestStatsClientSwapInFlight(t *testing.T) {
+	delay := statsdCloseDelay
+	statsdCloseDelay = 100 * time.Millisecond
+	defer func() { statsdCloseDelay = delay }()
+
+	stats := &statsClient{}
+	stats.Swap(statsd.NewClient("127.0.0.1:8125", statsd.MaxPacketSize(16)))
+
+	// a packet handler that fetched the client just before a reload
+	old := stats.get()
+	stats.Swap(nil)
+
+	// every one of these fills the buffer and queues a packet, which panics if
+	// the client has been closed
+	for i := 0; i < 10; i++ {
+		old.Incr("packets", 1)
+	}
+
+	time.Sleep(2 * statsdCloseDelay)
+	stats.Incr("packets", 1)
+}
+
+func TestPromMetrics(t *testing.T) {
+	prom := newPromMetrics()
+
+	var stats metrics = multiMetrics{&statsClient{}, prom}
+	stats.Incr("packets", 2)
+	stats.Incr("packets", 3)
+	stats.Incr("dns_lookups", 1, metricTag{name: "worker", value: "1"})
+	stats.Gauge("log_depth", 7, metricTag{name: "sink", value: "stdout"})
+	stats.Timing("answer_latency", 20*time.Millisecond)
+
+	server := httptest.NewServer(promhttp.HandlerFor(prom.registry, promhttp.HandlerOpts{}))
+	defer server.Close()
+
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{
+		"gopassivedns_packets_total 5",
+		`gopassivedns_dns_lookups_total{worker="1"} 1`,
+		`gopassivedns_log_depth{sink="stdout"} 7`,
+		"gopassivedns_answer_latency_seconds_count 1",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scrape did not contain %q", want)
+		}
+	}
+}
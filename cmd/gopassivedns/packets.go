@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"net"
 	"time"
@@ -17,10 +18,15 @@ type packetData struct {
 	packet   gopacket.Packet
 	tcpdata  TCPDataStruct
 	datatype string
+	// the layer the packet starts with, from the link type it was captured with
+	firstLayer gopacket.LayerType
+	ingress    ingressInfo
+	// decode the packets carried in tunnels instead of the tunnel
+	decapsulate bool
 
 	foundLayerTypes []gopacket.LayerType
 
-	ethLayer  *layers.Ethernet
+	link      *linkLayers
 	IPv4Layer *layers.IPv4
 	IPv6Layer *layers.IPv6
 	udpLayer  *layers.UDP
@@ -31,17 +37,29 @@ type packetData struct {
 
 // codebeat:enable[TOO_MANY_IVARS]
 
+// ingressInfo is where a packet was captured: the interface, the VLAN IDs it
+// was tagged with and the tunnel it arrived in
+type ingressInfo struct {
+	iface  string
+	vlans  []uint16
+	tunnel *tunnelInfo
+}
+
 func newTCPData(tcpdata TCPDataStruct) *packetData {
 	return &packetData{
 		datatype: tcpString,
 		tcpdata:  tcpdata,
+		ingress:  tcpdata.Ingress,
 	}
 }
 
-func newPacketData(packet gopacket.Packet) *packetData {
+// newPacketData wraps a packet captured on iface, which starts with firstLayer
+func newPacketData(packet gopacket.Packet, firstLayer gopacket.LayerType, iface string) *packetData {
 	return &packetData{
-		datatype: packetString,
-		packet:   packet,
+		datatype:   packetString,
+		packet:     packet,
+		firstLayer: firstLayer,
+		ingress:    ingressInfo{iface: iface},
 	}
 }
 
@@ -61,27 +79,24 @@ func (pd *packetData) Parse() error {
 
 		return nil
 	case packetString:
-		pd.ethLayer = &layers.Ethernet{}
+		pd.link = &linkLayers{}
 		pd.IPv4Layer = &layers.IPv4{}
 		pd.IPv6Layer = &layers.IPv6{}
 		pd.udpLayer = &layers.UDP{}
 		pd.tcpLayer = &layers.TCP{}
 		pd.dns = &layers.DNS{}
 		pd.payload = &gopacket.Payload{}
-		//we're constraining the set of layer decoders that gopacket will apply
-		//to this traffic. this MASSIVELY speeds up the parsing phase
-		parser := gopacket.NewDecodingLayerParser(
-			layers.LayerTypeEthernet,
-			pd.ethLayer,
-			pd.IPv4Layer,
-			pd.IPv6Layer,
-			pd.udpLayer,
-			pd.tcpLayer,
-			pd.dns,
-			pd.payload,
-		)
-
+		parser := pd.newParser(pd.firstLayer, pd.link)
 		parser.DecodeLayers(pd.packet.Data(), &pd.foundLayerTypes)
+		pd.ingress.vlans = pd.link.vlans.ids
+		//AF_PACKET passes the outermost tag alongside the packet instead
+		if vlan, found := ancillaryVLAN(pd.packet.Metadata().CaptureInfo); found {
+			pd.ingress.vlans = append([]uint16{vlan}, pd.ingress.vlans...)
+		}
+
+		if pd.decapsulate {
+			pd.decapsulateTunnels()
+		}
 
 		return nil
 	default:
@@ -89,6 +104,24 @@ func (pd *packetData) Parse() error {
 	}
 }
 
+// newParser returns a parser for packets starting with first, decoding into
+// link and the layers of pd
+func (pd *packetData) newParser(first gopacket.LayerType, link *linkLayers) *gopacket.DecodingLayerParser {
+	//we're constraining the set of layer decoders that gopacket will apply
+	//to this traffic. this MASSIVELY speeds up the parsing phase
+	return gopacket.NewDecodingLayerParser(
+		first,
+		append(link.decodingLayers(),
+			pd.IPv4Layer,
+			pd.IPv6Layer,
+			pd.udpLayer,
+			pd.tcpLayer,
+			pd.dns,
+			pd.payload,
+		)...,
+	)
+}
+
 func (pd *packetData) GetSrcIP() net.IP {
 	if pd.HasIPv4Layer() {
 		return pd.IPv4Layer.SrcIP
@@ -116,6 +149,9 @@ func (pd *packetData) GetSrcPort() uint16 {
 	if pd.tcpLayer != nil {
 		return uint16(pd.tcpLayer.SrcPort)
 	}
+	if pd.tcpdata.Transport.EndpointType() == layers.EndpointTCPPort {
+		return binary.BigEndian.Uint16(pd.tcpdata.Transport.Src().Raw())
+	}
 	return uint16(0)
 }
 
@@ -126,6 +162,9 @@ func (pd *packetData) GetDstPort() uint16 {
 	if pd.tcpLayer != nil {
 		return uint16(pd.tcpLayer.DstPort)
 	}
+	if pd.tcpdata.Transport.EndpointType() == layers.EndpointTCPPort {
+		return binary.BigEndian.Uint16(pd.tcpdata.Transport.Dst().Raw())
+	}
 	return uint16(0)
 }
 
@@ -169,6 +208,15 @@ func (pd *packetData) GetTimestamp() *time.Time {
 	if pd.datatype == packetString {
 		return &pd.packet.Metadata().Timestamp
 	}
+	//reassembled TCP queries are timed from the segment they started in, and
+	//responses from the one that completed them, so elapsed covers the answer
+	//arriving in full
+	if pd.datatype == tcpString && pd.dns != nil && pd.dns.QR && !pd.tcpdata.LastSeen.IsZero() {
+		return &pd.tcpdata.LastSeen
+	}
+	if pd.datatype == tcpString && !pd.tcpdata.FirstSeen.IsZero() {
+		return &pd.tcpdata.FirstSeen
+	}
 	return nil
 
 }
@@ -177,9 +225,10 @@ func (pd *packetData) GetSize() *int {
 	if pd.datatype == packetString {
 		return &pd.packet.Metadata().Length
 	}
-	// This needs to be improved. Currently because GetSize only works with UDP
-	// that is because we can't measure the size of the entire re-assembled stream
-	// of TCP right now. Fix pending.
+	// for TCP this is the on-wire length of the segments the message arrived in
+	if pd.datatype == tcpString {
+		return &pd.tcpdata.Size
+	}
 	sz := zeroInt
 	return &sz
 }
@@ -187,3 +236,9 @@ func (pd *packetData) GetSize() *int {
 func (pd *packetData) GetProto() *string {
 	return &pd.datatype
 }
+
+// GetIngress returns where the packet, or the first segment of the TCP
+// stream, was captured
+func (pd *packetData) GetIngress() ingressInfo {
+	return pd.ingress
+}
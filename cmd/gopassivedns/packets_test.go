@@ -27,7 +27,7 @@ func BenchmarkPacketParse(b *testing.B) {
 		for packet := range packetSource.Packets() {
 			parser.DecodeLayers(packet.Data(), &foundLayerTypes)
 			if foundLayerType(layers.LayerTypeIPv4, foundLayerTypes) {
-				pd := newPacketData(packet)
+				pd := newPacketData(packet, layers.LayerTypeEthernet, "")
 				err := pd.Parse()
 				if err != nil {
 					b.Errorf("got err %s on %s", err, packet)
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+const promNamespace string = "gopassivedns"
+
+// promMetrics exports metrics for Prometheus to scrape. Collectors are created
+// the first time a metric name is seen, using the tag names as labels.
+type promMetrics struct {
+	registry   *prometheus.Registry
+	counters   sync.Map // name -> *prometheus.CounterVec
+	gauges     sync.Map // name -> *prometheus.GaugeVec
+	histograms sync.Map // name -> *prometheus.HistogramVec
+	sync.Mutex          // serialises collector creation
+}
+
+func newPromMetrics() *promMetrics {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+
+	return &promMetrics{registry: registry}
+}
+
+// servePromMetrics runs the HTTP server for the /metrics endpoint.
+func servePromMetrics(listen string, prom *promMetrics) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prom.registry, promhttp.HandlerOpts{}))
+
+	log.Printf("gopassivedns: serving Prometheus metrics on %s/metrics", listen)
+	if err := http.ListenAndServe(listen, mux); err != nil {
+		log.Fatalf("Unable to serve Prometheus metrics on %s: %s", listen, err)
+	}
+}
+
+func promLabels(tags []metricTag) ([]string, []string) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	names := make([]string, len(tags))
+	values := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.name
+		values[i] = tag.value
+	}
+	return names, values
+}
+
+func promHelp(stat string) string {
+	return "gopassivedns " + strings.Replace(stat, "_", " ", -1)
+}
+
+// collector returns the collector registered for stat, creating it if needed.
+func (p *promMetrics) collector(collectors *sync.Map, stat string, newCollector func() prometheus.Collector) prometheus.Collector {
+	if c, ok := collectors.Load(stat); ok {
+		return c.(prometheus.Collector)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if c, ok := collectors.Load(stat); ok {
+		return c.(prometheus.Collector)
+	}
+
+	c := newCollector()
+	if err := p.registry.Register(c); err != nil {
+		log.Debugf("unable to register Prometheus metric %s: %s", stat, err)
+	}
+	collectors.Store(stat, c)
+
+	return c
+}
+
+// Incr adds count to the counter <stat>_total.
+func (p *promMetrics) Incr(stat string, count int64, tags ...metricTag) {
+	names, values := promLabels(tags)
+	vec := p.collector(&p.counters, stat, func() prometheus.Collector {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: promNamespace,
+			Name:      stat + "_total",
+			Help:      promHelp(stat),
+		}, names)
+	}).(*prometheus.CounterVec)
+
+	counter, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		log.Debugf("bad labels for Prometheus metric %s: %s", stat, err)
+		return
+	}
+	counter.Add(float64(count))
+}
+
+// Gauge sets the gauge <stat>.
+func (p *promMetrics) Gauge(stat string, value int64, tags ...metricTag) {
+	names, values := promLabels(tags)
+	vec := p.collector(&p.gauges, stat, func() prometheus.Collector {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: promNamespace,
+			Name:      stat,
+			Help:      promHelp(stat),
+		}, names)
+	}).(*prometheus.GaugeVec)
+
+	gauge, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		log.Debugf("bad labels for Prometheus metric %s: %s", stat, err)
+		return
+	}
+	gauge.Set(float64(value))
+}
+
+// Timing observes value in the histogram <stat>_seconds. The buckets run from
+// 100µs to just over 3s, which covers everything from a cached answer to a timeout.
+func (p *promMetrics) Timing(stat string, value time.Duration, tags ...metricTag) {
+	names, values := promLabels(tags)
+	vec := p.collector(&p.histograms, stat, func() prometheus.Collector {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: promNamespace,
+			Name:      stat + "_seconds",
+			Help:      promHelp(stat),
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, names)
+	}).(*prometheus.HistogramVec)
+
+	histogram, err := vec.GetMetricWithLabelValues(values...)
+	if err != nil {
+		log.Debugf("bad labels for Prometheus metric %s: %s", stat, err)
+		return
+	}
+	histogram.Observe(value.Seconds())
+}
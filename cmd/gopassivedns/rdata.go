@@ -0,0 +1,689 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// RR types gopacket doesn't have constants for
+const (
+	dnsTypeNAPTR   layers.DNSType = 35
+	dnsTypeDS      layers.DNSType = 43
+	dnsTypeSSHFP   layers.DNSType = 44
+	dnsTypeRRSIG   layers.DNSType = 46
+	dnsTypeNSEC    layers.DNSType = 47
+	dnsTypeDNSKEY  layers.DNSType = 48
+	dnsTypeNSEC3   layers.DNSType = 50
+	dnsTypeTLSA    layers.DNSType = 52
+	dnsTypeCDS     layers.DNSType = 59
+	dnsTypeCDNSKEY layers.DNSType = 60
+	dnsTypeSVCB    layers.DNSType = 64
+	dnsTypeHTTPS   layers.DNSType = 65
+	dnsTypeCAA     layers.DNSType = 257
+)
+
+var errRDataTooShort = errors.New("rdata too short")
+
+// base32 with the extended hex alphabet, as used for NSEC3 hashes
+var nsec3Encoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// rdata is the decoded RDATA of a resource record.  String returns it in
+// zone file presentation format, and the structs are tagged so they can be
+// logged as the structured rdata object in both the JSON and msgpack output.
+type rdata interface {
+	String() string
+}
+
+// decodeRData decodes the RDATA of rr.  Types gopacket already decodes are
+// taken from the record, the rest are parsed from the raw rr.Data.  Anything
+// we don't know, or which doesn't parse, comes back as unknownRData.
+func decodeRData(rr layers.DNSResourceRecord) rdata {
+	var decoded rdata
+	var err error
+
+	switch rr.Type {
+	case layers.DNSTypeA, layers.DNSTypeAAAA:
+		decoded = addressRData{Address: rr.IP.String()}
+	case layers.DNSTypeNS:
+		decoded = nameRData{Target: presentationName(rr.NS)}
+	case layers.DNSTypeCNAME:
+		decoded = nameRData{Target: presentationName(rr.CNAME)}
+	case layers.DNSTypePTR:
+		decoded = nameRData{Target: presentationName(rr.PTR)}
+	case layers.DNSTypeMX:
+		decoded = mxRData{Preference: rr.MX.Preference, Exchange: presentationName(rr.MX.Name)}
+	case layers.DNSTypeSOA:
+		decoded = soaRData{
+			MName:   presentationName(rr.SOA.MName),
+			RName:   presentationName(rr.SOA.RName),
+			Serial:  rr.SOA.Serial,
+			Refresh: rr.SOA.Refresh,
+			Retry:   rr.SOA.Retry,
+			Expire:  rr.SOA.Expire,
+			Minimum: rr.SOA.Minimum,
+		}
+	case layers.DNSTypeSRV:
+		decoded = srvRData{Priority: rr.SRV.Priority, Weight: rr.SRV.Weight, Port: rr.SRV.Port, Target: presentationName(rr.SRV.Name)}
+	case layers.DNSTypeTXT, layers.DNSTypeHINFO:
+		txt := txtRData{}
+		for _, s := range rr.TXTs {
+			txt.Text = append(txt.Text, string(s))
+		}
+		decoded = txt
+	case layers.DNSTypeURI:
+		decoded = uriRData{Priority: rr.URI.Priority, Weight: rr.URI.Weight, Target: string(rr.URI.Target)}
+	case dnsTypeCAA:
+		decoded, err = decodeCAA(rr.Data)
+	case dnsTypeNAPTR:
+		decoded, err = decodeNAPTR(rr.Data)
+	case dnsTypeDS, dnsTypeCDS:
+		decoded, err = decodeDS(rr.Data)
+	case dnsTypeDNSKEY, dnsTypeCDNSKEY:
+		decoded, err = decodeDNSKEY(rr.Data)
+	case dnsTypeRRSIG:
+		decoded, err = decodeRRSIG(rr.Data)
+	case dnsTypeNSEC:
+		decoded, err = decodeNSEC(rr.Data)
+	case dnsTypeNSEC3:
+		decoded, err = decodeNSEC3(rr.Data)
+	case dnsTypeTLSA:
+		decoded, err = decodeTLSA(rr.Data)
+	case dnsTypeSSHFP:
+		decoded, err = decodeSSHFP(rr.Data)
+	case dnsTypeSVCB, dnsTypeHTTPS:
+		decoded, err = decodeSVCB(rr.Data)
+	}
+
+	if decoded == nil || err != nil {
+		return unknownRData{Length: len(rr.Data), Data: upperHex(rr.Data)}
+	}
+	return decoded
+}
+
+// addressRData is an A or AAAA record
+type addressRData struct {
+	Address string `json:"address" msgpack:"address"`
+}
+
+func (rd addressRData) String() string {
+	return rd.Address
+}
+
+// nameRData is a record holding a single domain name: NS, CNAME or PTR
+type nameRData struct {
+	Target string `json:"target" msgpack:"target"`
+}
+
+func (rd nameRData) String() string {
+	return rd.Target
+}
+
+type mxRData struct {
+	Preference uint16 `json:"preference" msgpack:"preference"`
+	Exchange   string `json:"exchange" msgpack:"exchange"`
+}
+
+func (rd mxRData) String() string {
+	return fmt.Sprintf("%d %s", rd.Preference, rd.Exchange)
+}
+
+type soaRData struct {
+	MName   string `json:"mname" msgpack:"mname"`
+	RName   string `json:"rname" msgpack:"rname"`
+	Serial  uint32 `json:"serial" msgpack:"serial"`
+	Refresh uint32 `json:"refresh" msgpack:"refresh"`
+	Retry   uint32 `json:"retry" msgpack:"retry"`
+	Expire  uint32 `json:"expire" msgpack:"expire"`
+	Minimum uint32 `json:"minimum" msgpack:"minimum"`
+}
+
+func (rd soaRData) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d %d", rd.MName, rd.RName, rd.Serial, rd.Refresh, rd.Retry, rd.Expire, rd.Minimum)
+}
+
+type srvRData struct {
+	Priority uint16 `json:"priority" msgpack:"priority"`
+	Weight   uint16 `json:"weight" msgpack:"weight"`
+	Port     uint16 `json:"port" msgpack:"port"`
+	Target   string `json:"target" msgpack:"target"`
+}
+
+func (rd srvRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.Priority, rd.Weight, rd.Port, rd.Target)
+}
+
+// txtRData holds the character strings of a TXT or HINFO record
+type txtRData struct {
+	Text []string `json:"text" msgpack:"text"`
+}
+
+func (rd txtRData) String() string {
+	quoted := make([]string, len(rd.Text))
+	for i, s := range rd.Text {
+		quoted[i] = quoteCharacterString(s)
+	}
+	return strings.Join(quoted, " ")
+}
+
+type uriRData struct {
+	Priority uint16 `json:"priority" msgpack:"priority"`
+	Weight   uint16 `json:"weight" msgpack:"weight"`
+	Target   string `json:"target" msgpack:"target"`
+}
+
+func (rd uriRData) String() string {
+	return fmt.Sprintf("%d %d %s", rd.Priority, rd.Weight, quoteCharacterString(rd.Target))
+}
+
+type caaRData struct {
+	Flags uint8  `json:"flags" msgpack:"flags"`
+	Tag   string `json:"tag" msgpack:"tag"`
+	Value string `json:"value" msgpack:"value"`
+}
+
+func (rd caaRData) String() string {
+	return fmt.Sprintf("%d %s %s", rd.Flags, rd.Tag, quoteCharacterString(rd.Value))
+}
+
+func decodeCAA(data []byte) (rdata, error) {
+	if len(data) < 2 || len(data) < 2+int(data[1]) {
+		return nil, errRDataTooShort
+	}
+	tagEnd := 2 + int(data[1])
+	return caaRData{Flags: data[0], Tag: string(data[2:tagEnd]), Value: string(data[tagEnd:])}, nil
+}
+
+type naptrRData struct {
+	Order       uint16 `json:"order" msgpack:"order"`
+	Preference  uint16 `json:"preference" msgpack:"preference"`
+	Flags       string `json:"flags" msgpack:"flags"`
+	Services    string `json:"services" msgpack:"services"`
+	Regexp      string `json:"regexp" msgpack:"regexp"`
+	Replacement string `json:"replacement" msgpack:"replacement"`
+}
+
+func (rd naptrRData) String() string {
+	return fmt.Sprintf("%d %d %s %s %s %s", rd.Order, rd.Preference,
+		quoteCharacterString(rd.Flags), quoteCharacterString(rd.Services), quoteCharacterString(rd.Regexp), rd.Replacement)
+}
+
+func decodeNAPTR(data []byte) (rdata, error) {
+	if len(data) < 4 {
+		return nil, errRDataTooShort
+	}
+	rd := naptrRData{
+		Order:      binary.BigEndian.Uint16(data[0:2]),
+		Preference: binary.BigEndian.Uint16(data[2:4]),
+	}
+	offset := 4
+	var err error
+	for _, field := range []*string{&rd.Flags, &rd.Services, &rd.Regexp} {
+		if *field, offset, err = readCharacterString(data, offset); err != nil {
+			return nil, err
+		}
+	}
+	if rd.Replacement, _, err = readName(data, offset); err != nil {
+		return nil, err
+	}
+	return rd, nil
+}
+
+// dsRData is a DS or CDS record
+type dsRData struct {
+	KeyTag     uint16 `json:"key_tag" msgpack:"key_tag"`
+	Algorithm  uint8  `json:"algorithm" msgpack:"algorithm"`
+	DigestType uint8  `json:"digest_type" msgpack:"digest_type"`
+	Digest     string `json:"digest" msgpack:"digest"`
+}
+
+func (rd dsRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.KeyTag, rd.Algorithm, rd.DigestType, rd.Digest)
+}
+
+func decodeDS(data []byte) (rdata, error) {
+	if len(data) < 4 {
+		return nil, errRDataTooShort
+	}
+	return dsRData{
+		KeyTag:     binary.BigEndian.Uint16(data[0:2]),
+		Algorithm:  data[2],
+		DigestType: data[3],
+		Digest:     upperHex(data[4:]),
+	}, nil
+}
+
+// dnskeyRData is a DNSKEY or CDNSKEY record
+type dnskeyRData struct {
+	Flags     uint16 `json:"flags" msgpack:"flags"`
+	Protocol  uint8  `json:"protocol" msgpack:"protocol"`
+	Algorithm uint8  `json:"algorithm" msgpack:"algorithm"`
+	PublicKey string `json:"public_key" msgpack:"public_key"`
+}
+
+func (rd dnskeyRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.Flags, rd.Protocol, rd.Algorithm, rd.PublicKey)
+}
+
+func decodeDNSKEY(data []byte) (rdata, error) {
+	if len(data) < 4 {
+		return nil, errRDataTooShort
+	}
+	return dnskeyRData{
+		Flags:     binary.BigEndian.Uint16(data[0:2]),
+		Protocol:  data[2],
+		Algorithm: data[3],
+		PublicKey: base64.StdEncoding.EncodeToString(data[4:]),
+	}, nil
+}
+
+type rrsigRData struct {
+	TypeCovered string `json:"type_covered" msgpack:"type_covered"`
+	Algorithm   uint8  `json:"algorithm" msgpack:"algorithm"`
+	Labels      uint8  `json:"labels" msgpack:"labels"`
+	OriginalTTL uint32 `json:"original_ttl" msgpack:"original_ttl"`
+	Expiration  uint32 `json:"expiration" msgpack:"expiration"`
+	Inception   uint32 `json:"inception" msgpack:"inception"`
+	KeyTag      uint16 `json:"key_tag" msgpack:"key_tag"`
+	SignerName  string `json:"signer_name" msgpack:"signer_name"`
+	Signature   string `json:"signature" msgpack:"signature"`
+}
+
+func (rd rrsigRData) String() string {
+	return fmt.Sprintf("%s %d %d %d %s %s %d %s %s", rd.TypeCovered, rd.Algorithm, rd.Labels, rd.OriginalTTL,
+		sigTime(rd.Expiration), sigTime(rd.Inception), rd.KeyTag, rd.SignerName, rd.Signature)
+}
+
+func decodeRRSIG(data []byte) (rdata, error) {
+	if len(data) < 18 {
+		return nil, errRDataTooShort
+	}
+	signer, offset, err := readName(data, 18)
+	if err != nil {
+		return nil, err
+	}
+	return rrsigRData{
+		TypeCovered: typeMnemonic(layers.DNSType(binary.BigEndian.Uint16(data[0:2]))),
+		Algorithm:   data[2],
+		Labels:      data[3],
+		OriginalTTL: binary.BigEndian.Uint32(data[4:8]),
+		Expiration:  binary.BigEndian.Uint32(data[8:12]),
+		Inception:   binary.BigEndian.Uint32(data[12:16]),
+		KeyTag:      binary.BigEndian.Uint16(data[16:18]),
+		SignerName:  signer,
+		Signature:   base64.StdEncoding.EncodeToString(data[offset:]),
+	}, nil
+}
+
+type nsecRData struct {
+	NextDomain string   `json:"next_domain" msgpack:"next_domain"`
+	Types      []string `json:"types" msgpack:"types"`
+}
+
+func (rd nsecRData) String() string {
+	return strings.TrimSpace(rd.NextDomain + " " + strings.Join(rd.Types, " "))
+}
+
+func decodeNSEC(data []byte) (rdata, error) {
+	next, offset, err := readName(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	types, err := readTypeBitmap(data[offset:])
+	if err != nil {
+		return nil, err
+	}
+	return nsecRData{NextDomain: next, Types: types}, nil
+}
+
+type nsec3RData struct {
+	HashAlgorithm uint8    `json:"hash_algorithm" msgpack:"hash_algorithm"`
+	Flags         uint8    `json:"flags" msgpack:"flags"`
+	Iterations    uint16   `json:"iterations" msgpack:"iterations"`
+	Salt          string   `json:"salt" msgpack:"salt"`
+	NextHashed    string   `json:"next_hashed" msgpack:"next_hashed"`
+	Types         []string `json:"types" msgpack:"types"`
+}
+
+func (rd nsec3RData) String() string {
+	salt := rd.Salt
+	if salt == "" {
+		salt = "-"
+	}
+	return strings.TrimSpace(fmt.Sprintf("%d %d %d %s %s %s", rd.HashAlgorithm, rd.Flags, rd.Iterations, salt,
+		rd.NextHashed, strings.Join(rd.Types, " ")))
+}
+
+func decodeNSEC3(data []byte) (rdata, error) {
+	if len(data) < 5 || len(data) < 5+int(data[4])+1 {
+		return nil, errRDataTooShort
+	}
+	saltEnd := 5 + int(data[4])
+	hashEnd := saltEnd + 1 + int(data[saltEnd])
+	if len(data) < hashEnd {
+		return nil, errRDataTooShort
+	}
+	types, err := readTypeBitmap(data[hashEnd:])
+	if err != nil {
+		return nil, err
+	}
+	return nsec3RData{
+		HashAlgorithm: data[0],
+		Flags:         data[1],
+		Iterations:    binary.BigEndian.Uint16(data[2:4]),
+		Salt:          upperHex(data[5:saltEnd]),
+		NextHashed:    nsec3Encoding.EncodeToString(data[saltEnd+1 : hashEnd]),
+		Types:         types,
+	}, nil
+}
+
+type tlsaRData struct {
+	Usage        uint8  `json:"usage" msgpack:"usage"`
+	Selector     uint8  `json:"selector" msgpack:"selector"`
+	MatchingType uint8  `json:"matching_type" msgpack:"matching_type"`
+	Certificate  string `json:"certificate" msgpack:"certificate"`
+}
+
+func (rd tlsaRData) String() string {
+	return fmt.Sprintf("%d %d %d %s", rd.Usage, rd.Selector, rd.MatchingType, rd.Certificate)
+}
+
+func decodeTLSA(data []byte) (rdata, error) {
+	if len(data) < 3 {
+		return nil, errRDataTooShort
+	}
+	return tlsaRData{Usage: data[0], Selector: data[1], MatchingType: data[2], Certificate: upperHex(data[3:])}, nil
+}
+
+type sshfpRData struct {
+	Algorithm   uint8  `json:"algorithm" msgpack:"algorithm"`
+	Type        uint8  `json:"type" msgpack:"type"`
+	Fingerprint string `json:"fingerprint" msgpack:"fingerprint"`
+}
+
+func (rd sshfpRData) String() string {
+	return fmt.Sprintf("%d %d %s", rd.Algorithm, rd.Type, rd.Fingerprint)
+}
+
+func decodeSSHFP(data []byte) (rdata, error) {
+	if len(data) < 2 {
+		return nil, errRDataTooShort
+	}
+	return sshfpRData{Algorithm: data[0], Type: data[1], Fingerprint: upperHex(data[2:])}, nil
+}
+
+// svcParam is a single SvcParamKey=SvcParamValue pair, with the value already
+// in presentation format
+type svcParam struct {
+	Key   string `json:"key" msgpack:"key"`
+	Value string `json:"value" msgpack:"value"`
+}
+
+// svcbRData is an SVCB or HTTPS record, RFC 9460
+type svcbRData struct {
+	Priority uint16     `json:"priority" msgpack:"priority"`
+	Target   string     `json:"target" msgpack:"target"`
+	Params   []svcParam `json:"params" msgpack:"params"`
+}
+
+func (rd svcbRData) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s", rd.Priority, rd.Target)
+	for _, param := range rd.Params {
+		b.WriteByte(' ')
+		b.WriteString(param.Key)
+		if param.Value != "" {
+			b.WriteByte('=')
+			b.WriteString(param.Value)
+		}
+	}
+	return b.String()
+}
+
+func decodeSVCB(data []byte) (rdata, error) {
+	if len(data) < 2 {
+		return nil, errRDataTooShort
+	}
+	target, offset, err := readName(data, 2)
+	if err != nil {
+		return nil, err
+	}
+	rd := svcbRData{Priority: binary.BigEndian.Uint16(data[0:2]), Target: target}
+
+	for offset < len(data) {
+		if len(data) < offset+4 {
+			return nil, errRDataTooShort
+		}
+		key := binary.BigEndian.Uint16(data[offset : offset+2])
+		end := offset + 4 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+		if len(data) < end {
+			return nil, errRDataTooShort
+		}
+		value, err := svcParamValue(key, data[offset+4:end])
+		if err != nil {
+			return nil, err
+		}
+		rd.Params = append(rd.Params, svcParam{Key: svcParamKey(key), Value: value})
+		offset = end
+	}
+	return rd, nil
+}
+
+func svcParamKey(key uint16) string {
+	switch key {
+	case 0:
+		return "mandatory"
+	case 1:
+		return "alpn"
+	case 2:
+		return "no-default-alpn"
+	case 3:
+		return "port"
+	case 4:
+		return "ipv4hint"
+	case 5:
+		return "ech"
+	case 6:
+		return "ipv6hint"
+	case 7:
+		return "dohpath"
+	default:
+		return "key" + strconv.Itoa(int(key))
+	}
+}
+
+func svcParamValue(key uint16, value []byte) (string, error) {
+	switch key {
+	case 0:
+		if len(value)%2 != 0 {
+			return "", errRDataTooShort
+		}
+		keys := make([]string, 0, len(value)/2)
+		for i := 0; i < len(value); i += 2 {
+			keys = append(keys, svcParamKey(binary.BigEndian.Uint16(value[i:i+2])))
+		}
+		return strings.Join(keys, ","), nil
+	case 1:
+		var alpns []string
+		for offset := 0; offset < len(value); {
+			alpn, next, err := readCharacterString(value, offset)
+			if err != nil {
+				return "", err
+			}
+			alpns = append(alpns, strings.ReplaceAll(alpn, ",", "\\,"))
+			offset = next
+		}
+		return quoteCharacterString(strings.Join(alpns, ",")), nil
+	case 2:
+		return "", nil
+	case 3:
+		if len(value) != 2 {
+			return "", errRDataTooShort
+		}
+		return strconv.Itoa(int(binary.BigEndian.Uint16(value))), nil
+	case 4, 6:
+		size := net.IPv4len
+		if key == 6 {
+			size = net.IPv6len
+		}
+		if len(value)%size != 0 {
+			return "", errRDataTooShort
+		}
+		hints := make([]string, 0, len(value)/size)
+		for i := 0; i < len(value); i += size {
+			hints = append(hints, net.IP(value[i:i+size]).String())
+		}
+		return strings.Join(hints, ","), nil
+	case 5:
+		return base64.StdEncoding.EncodeToString(value), nil
+	default:
+		return quoteCharacterString(string(value)), nil
+	}
+}
+
+// unknownRData is RDATA we can't decode, shown in the RFC 3597 generic format
+type unknownRData struct {
+	Length int    `json:"length" msgpack:"length"`
+	Data   string `json:"data" msgpack:"data"`
+}
+
+func (rd unknownRData) String() string {
+	if rd.Length == 0 {
+		return "\\# 0"
+	}
+	return fmt.Sprintf("\\# %d %s", rd.Length, rd.Data)
+}
+
+// presentationName returns a name as gopacket decodes it, or "." for the root
+func presentationName(name []byte) string {
+	if len(name) == 0 {
+		return "."
+	}
+	return string(name)
+}
+
+// readName reads an uncompressed domain name starting at offset, which is all
+// RFC 3597 allows in the RDATA of the newer types.  It returns the name and the
+// offset of the byte following it.
+func readName(data []byte, offset int) (string, int, error) {
+	var labels []string
+	for {
+		if offset >= len(data) {
+			return "", 0, errRDataTooShort
+		}
+		length := int(data[offset])
+		if length == 0 {
+			offset++
+			break
+		}
+		if length&0xc0 != 0 {
+			return "", 0, errors.New("compressed name in rdata")
+		}
+		if offset+1+length > len(data) {
+			return "", 0, errRDataTooShort
+		}
+		labels = append(labels, escapeLabel(data[offset+1:offset+1+length]))
+		offset += 1 + length
+	}
+	if len(labels) == 0 {
+		return ".", offset, nil
+	}
+	return strings.Join(labels, "."), offset, nil
+}
+
+// escapeLabel escapes dots, backslashes and unprintable bytes in a label
+func escapeLabel(label []byte) string {
+	var b strings.Builder
+	for _, c := range label {
+		switch {
+		case c == '.' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x21 || c > 0x7e:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// readCharacterString reads a length prefixed <character-string> at offset
+func readCharacterString(data []byte, offset int) (string, int, error) {
+	if offset >= len(data) || offset+1+int(data[offset]) > len(data) {
+		return "", 0, errRDataTooShort
+	}
+	end := offset + 1 + int(data[offset])
+	return string(data[offset+1 : end]), end, nil
+}
+
+// quoteCharacterString quotes s as a zone file <character-string>
+func quoteCharacterString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// readTypeBitmap decodes the type bit maps field of NSEC and NSEC3 records
+func readTypeBitmap(data []byte) ([]string, error) {
+	var types []string
+	for offset := 0; offset < len(data); {
+		if len(data) < offset+2 {
+			return nil, errRDataTooShort
+		}
+		window := int(data[offset])
+		length := int(data[offset+1])
+		if length == 0 || length > 32 || len(data) < offset+2+length {
+			return nil, errors.New("bad type bitmap")
+		}
+		for i, bits := range data[offset+2 : offset+2+length] {
+			for bit := 0; bit < 8; bit++ {
+				if bits&(0x80>>uint(bit)) != 0 {
+					types = append(types, typeMnemonic(layers.DNSType(window*256+i*8+bit)))
+				}
+			}
+		}
+		offset += 2 + length
+	}
+	return types, nil
+}
+
+// typeMnemonic is TypeString with the RFC 3597 TYPEnnn form for unknown types
+func typeMnemonic(dnsType layers.DNSType) string {
+	name := TypeString(dnsType)
+	if name == strconv.Itoa(int(dnsType)) {
+		return "TYPE" + name
+	}
+	return name
+}
+
+// sigTime formats RRSIG inception and expiration times as YYYYMMDDHHmmSS
+func sigTime(t uint32) string {
+	return time.Unix(int64(t), 0).UTC().Format("20060102150405")
+}
+
+func upperHex(data []byte) string {
+	return strings.ToUpper(hex.EncodeToString(data))
+}
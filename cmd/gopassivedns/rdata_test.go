@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestRRString(t *testing.T) {
+	tests := []struct {
+		name string
+		rr   layers.DNSResourceRecord
+		want string
+	}{
+		{
+			name: "A",
+			rr:   layers.DNSResourceRecord{Type: layers.DNSTypeA, IP: net.ParseIP("192.0.2.1")},
+			want: "192.0.2.1",
+		},
+		{
+			name: "MX",
+			rr:   layers.DNSResourceRecord{Type: layers.DNSTypeMX, MX: layers.DNSMX{Preference: 10, Name: []byte("mx.example.com")}},
+			want: "10 mx.example.com",
+		},
+		{
+			name: "null MX",
+			rr:   layers.DNSResourceRecord{Type: layers.DNSTypeMX, MX: layers.DNSMX{Preference: 0, Name: []byte("")}},
+			want: "0 .",
+		},
+		{
+			name: "SOA",
+			rr: layers.DNSResourceRecord{Type: layers.DNSTypeSOA, SOA: layers.DNSSOA{
+				MName: []byte("ns1.example.com"), RName: []byte("hostmaster.example.com"),
+				Serial: 2021010101, Refresh: 7200, Retry: 3600, Expire: 1209600, Minimum: 300,
+			}},
+			want: "ns1.example.com hostmaster.example.com 2021010101 7200 3600 1209600 300",
+		},
+		{
+			name: "SRV",
+			rr:   layers.DNSResourceRecord{Type: layers.DNSTypeSRV, SRV: layers.DNSSRV{Priority: 10, Weight: 5, Port: 5060, Name: []byte("sip.example.com")}},
+			want: "10 5 5060 sip.example.com",
+		},
+		{
+			name: "TXT",
+			rr:   layers.DNSResourceRecord{Type: layers.DNSTypeTXT, TXTs: [][]byte{[]byte("v=spf1 -all"), []byte(`say "hi"`)}},
+			want: `"v=spf1 -all" "say \"hi\""`,
+		},
+		{
+			name: "URI",
+			rr:   layers.DNSResourceRecord{Type: layers.DNSTypeURI, URI: layers.DNSURI{Priority: 10, Weight: 1, Target: []byte("ftp://ftp.example.com/")}},
+			want: `10 1 "ftp://ftp.example.com/"`,
+		},
+		{
+			name: "CAA",
+			rr:   layers.DNSResourceRecord{Type: dnsTypeCAA, Data: append([]byte{0, 5}, []byte("issueletsencrypt.org")...)},
+			want: `0 issue "letsencrypt.org"`,
+		},
+		{
+			name: "NAPTR",
+			rr: layers.DNSResourceRecord{Type: dnsTypeNAPTR, Data: []byte{
+				0, 100, 0, 10,
+				1, 'S',
+				7, 'S', 'I', 'P', '+', 'D', '2', 'U',
+				0,
+				4, '_', 's', 'i', 'p', 4, '_', 'u', 'd', 'p', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+			}},
+			want: `100 10 "S" "SIP+D2U" "" _sip._udp.example.com`,
+		},
+		{
+			name: "DS",
+			rr:   layers.DNSResourceRecord{Type: dnsTypeDS, Data: []byte{0xec, 0x45, 5, 1, 0x2b, 0xb1, 0x83, 0xaf}},
+			want: "60485 5 1 2BB183AF",
+		},
+		{
+			name: "DNSKEY",
+			rr:   layers.DNSResourceRecord{Type: dnsTypeDNSKEY, Data: []byte{1, 1, 3, 8, 1, 2, 3}},
+			want: "257 3 8 AQID",
+		},
+		{
+			name: "RRSIG",
+			rr: layers.DNSResourceRecord{Type: dnsTypeRRSIG, Data: []byte{
+				0, 1, 8, 2,
+				0, 0, 0x0e, 0x10,
+				0x65, 0x53, 0xf1, 0x00,
+				0x64, 0xbb, 0x5a, 0x80,
+				0x30, 0x39,
+				7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				1, 2, 3,
+			}},
+			want: "A 8 2 3600 20231114221320 20230722042640 12345 example.com AQID",
+		},
+		{
+			name: "NSEC",
+			rr: layers.DNSResourceRecord{Type: dnsTypeNSEC, Data: []byte{
+				4, 'h', 'o', 's', 't', 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+				0, 4, 0x40, 0x01, 0x80, 0x08,
+			}},
+			want: "host.example.com A MX TXT AAAA",
+		},
+		{
+			name: "NSEC3",
+			rr: layers.DNSResourceRecord{Type: dnsTypeNSEC3, Data: []byte{
+				1, 1, 0, 12,
+				4, 0xaa, 0xbb, 0xcc, 0xdd,
+				5, 0, 0, 0, 0, 0,
+				0, 1, 0x40,
+			}},
+			want: "1 1 12 AABBCCDD 00000000 A",
+		},
+		{
+			name: "TLSA",
+			rr:   layers.DNSResourceRecord{Type: dnsTypeTLSA, Data: []byte{3, 1, 1, 0xde, 0xad}},
+			want: "3 1 1 DEAD",
+		},
+		{
+			name: "SSHFP",
+			rr:   layers.DNSResourceRecord{Type: dnsTypeSSHFP, Data: []byte{4, 2, 0xbe, 0xef}},
+			want: "4 2 BEEF",
+		},
+		{
+			name: "HTTPS",
+			rr: layers.DNSResourceRecord{Type: dnsTypeHTTPS, Data: []byte{
+				0, 1,
+				0,
+				0, 1, 0, 6, 2, 'h', '2', 2, 'h', '3',
+				0, 3, 0, 2, 0x01, 0xbb,
+				0, 4, 0, 4, 1, 2, 3, 4,
+			}},
+			want: `1 . alpn="h2,h3" port=443 ipv4hint=1.2.3.4`,
+		},
+		{
+			name: "unknown",
+			rr:   layers.DNSResourceRecord{Type: 65280, Data: []byte{1, 2}},
+			want: `\# 2 0102`,
+		},
+		{
+			name: "malformed CAA",
+			rr:   layers.DNSResourceRecord{Type: dnsTypeCAA, Data: []byte{0}},
+			want: `\# 1 00`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RRString(tt.rr); got != tt.want {
+				t.Errorf("RRString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,37 +1,143 @@
 package main
 
 import (
+	"flag"
 	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// If we shut down without doing this stuff, we will lose some of the packet data
-// still in the processing pipeline.
-func gracefulShutdown(channels []chan *packetData, reassembledChan chan TCPDataStruct, logChan chan DNSLogEntry) {
+// reloader re-reads the configuration on SIGHUP and hands the settings which can
+// change at runtime to the goroutines that own them.
+type reloader struct {
+	config  *pdnsConfig
+	stats   *statsClient
+	capture chan *pdnsConfig
+	logs    chan *logOptions
+}
 
-	var waitTime int = 6
-	var numprocs int = len(channels)
+func newReloader(config *pdnsConfig, stats *statsClient) *reloader {
+	current := *config
+	return &reloader{
+		config:  &current,
+		stats:   stats,
+		capture: make(chan *pdnsConfig, 1),
+		logs:    make(chan *logOptions, 1),
+	}
+}
 
-	log.Debug("Draining TCP data...")
+// reload parses the command line and config file again, keeping the running
+// configuration if the new one is invalid.
+func (r *reloader) reload() {
+	newConfig, err := parseConfig(flag.NewFlagSet(os.Args[0], flag.ContinueOnError), os.Args[1:])
+	if err != nil {
+		log.Printf("gopassivedns: keeping the running configuration, reload failed: %s", err)
+		return
+	}
+	r.apply(newConfig)
+}
 
-OUTER:
-	for {
-		select {
-		case reassembledTCP := <-reassembledChan:
-			pd := newTCPData(reassembledTCP)
-			channels[int(reassembledTCP.IPLayer.FastHash())&(numprocs-1)] <- pd
-		case <-time.After(6 * time.Second):
-			break OUTER
-		}
+// apply sends the new BPF filter and GC timings to doCapture, the new sinks to
+// logConn and swaps the statsd target. Changing the capture source or the
+// number of workers needs a restart, so those settings are left as they are.
+func (r *reloader) apply(newConfig *pdnsConfig) {
+	if newConfig.device != r.config.device ||
+		newConfig.pcapFile != r.config.pcapFile ||
+		newConfig.dnstap != r.config.dnstap ||
+		newConfig.numprocs != r.config.numprocs ||
+		newConfig.snapLen != r.config.snapLen ||
+		newConfig.pfring != r.config.pfring ||
+		newConfig.pfringClusterID != r.config.pfringClusterID ||
+		newConfig.pfringClusterType != r.config.pfringClusterType ||
+		newConfig.afpacket != r.config.afpacket ||
+		newConfig.afpacketBlockSize != r.config.afpacketBlockSize ||
+		newConfig.afpacketBlocks != r.config.afpacketBlocks ||
+		newConfig.afpacketSockets != r.config.afpacketSockets ||
+		newConfig.afpacketFanoutID != r.config.afpacketFanoutID ||
+		newConfig.decapsulate != r.config.decapsulate ||
+		newConfig.defragTimeout != r.config.defragTimeout ||
+		newConfig.defragMaxMemory != r.config.defragMaxMemory ||
+		newConfig.logSections != r.config.logSections ||
+		newConfig.logRData != r.config.logRData ||
+		newConfig.timestampFormat != r.config.timestampFormat ||
+		newConfig.logMismatches != r.config.logMismatches ||
+		newConfig.conntableMaxEntries != r.config.conntableMaxEntries ||
+		newConfig.conntableMaxMemory != r.config.conntableMaxMemory ||
+		newConfig.conntableMaxPerClient != r.config.conntableMaxPerClient ||
+		newConfig.prometheusListen != r.config.prometheusListen {
+		log.Println("gopassivedns: dev, pcap, dnstap, numprocs, snaplen, the pfring and afpacket settings, decapsulate, the defrag settings, log_sections, log_rdata, timestamp_format, log_mismatches, the conntable limits and prometheus_listen can't be changed without a restart, ignoring them")
+		newConfig.device = r.config.device
+		newConfig.pcapFile = r.config.pcapFile
+		newConfig.dnstap = r.config.dnstap
+		newConfig.numprocs = r.config.numprocs
+		newConfig.snapLen = r.config.snapLen
+		newConfig.pfring = r.config.pfring
+		newConfig.pfringClusterID = r.config.pfringClusterID
+		newConfig.pfringClusterType = r.config.pfringClusterType
+		newConfig.afpacket = r.config.afpacket
+		newConfig.afpacketBlockSize = r.config.afpacketBlockSize
+		newConfig.afpacketBlocks = r.config.afpacketBlocks
+		newConfig.afpacketSockets = r.config.afpacketSockets
+		newConfig.afpacketFanoutID = r.config.afpacketFanoutID
+		newConfig.decapsulate = r.config.decapsulate
+		newConfig.defragTimeout = r.config.defragTimeout
+		newConfig.defragMaxMemory = r.config.defragMaxMemory
+		newConfig.logSections = r.config.logSections
+		newConfig.logRData = r.config.logRData
+		newConfig.timestampFormat = r.config.timestampFormat
+		newConfig.logMismatches = r.config.logMismatches
+		newConfig.conntableMaxEntries = r.config.conntableMaxEntries
+		newConfig.conntableMaxMemory = r.config.conntableMaxMemory
+		newConfig.conntableMaxPerClient = r.config.conntableMaxPerClient
+		newConfig.prometheusListen = r.config.prometheusListen
+	}
+
+	if newConfig.debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
 	}
 
+	if newConfig.statsdHost != r.config.statsdHost ||
+		newConfig.statsdPrefix != r.config.statsdPrefix ||
+		newConfig.statsdInterval != r.config.statsdInterval ||
+		newConfig.sensorName != r.config.sensorName {
+		log.Printf("gopassivedns: sending stats to '%s'", newConfig.statsdHost)
+		r.stats.Swap(newStatsdClient(newConfig))
+	}
+
+	//logConn and doCapture may have stopped listening, e.g. at the end of a
+	//pcap, so a reload they haven't picked up is replaced rather than waited on
+	select {
+	case <-r.logs:
+	default:
+	}
+	r.logs <- newLogOptions(newConfig)
+	select {
+	case <-r.capture:
+	default:
+	}
+	r.capture <- newConfig
+	r.config = newConfig
+}
+
+// If we shut down without doing this stuff, we will lose some of the packet data
+// still in the processing pipeline.
+func gracefulShutdown(channels []chan *packetData, workers *sync.WaitGroup, logChan chan DNSLogEntry) {
+
+	var waitTime int = 6
+
 	log.Debug("Stopping packet processing...")
-	for i := 0; i < numprocs; i++ {
+	for i := range channels {
 		close(channels[i])
 	}
 
+	//the workers log what is left in their queues, and can't be stopped while they might still send to logChan
+	workers.Wait()
+
 	log.Debug("waiting for log pipeline to flush...")
 	close(logChan)
 
@@ -45,11 +151,19 @@ OUTER:
 	}
 }
 
-// handle a graceful exit so that we do not lose data when we restart the service.
-func watchSignals(sig chan os.Signal, done chan bool) {
+// handle a graceful exit so that we do not lose data when we restart the service,
+// or a configuration reload on SIGHUP.
+func watchSignals(sig chan os.Signal, done chan bool, reload *reloader) {
 	for {
 		select {
-		case <-sig:
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				log.Println("Caught SIGHUP, reloading configuration.")
+				if reload != nil {
+					reload.reload()
+				}
+				continue
+			}
 			log.Println("Caught signal about to cleanly exit.")
 			done <- true
 			// Sleeping 15 seconds while the gracefulshutdown function completes.
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloaderApply(t *testing.T) {
+	config := &pdnsConfig{device: "eth0", bpf: "port 53", numprocs: 8, gcAge: "-1m", gcInterval: "3m", quiet: true}
+	reload := newReloader(config, &statsClient{})
+
+	reload.apply(&pdnsConfig{device: "eth1", bpf: "udp port 53", numprocs: 2, gcAge: "-30s", gcInterval: "1m", logFile: "/tmp/pdns.log"})
+
+	select {
+	case newConfig := <-reload.capture:
+		if newConfig.bpf != "udp port 53" {
+			t.Fatalf("expected the new BPF filter, got %s", newConfig.bpf)
+		}
+		if newConfig.device != "eth0" || newConfig.numprocs != 8 {
+			t.Fatalf("restart-only settings were changed to %s and %d", newConfig.device, newConfig.numprocs)
+		}
+	default:
+		t.Fatal("no config was sent to doCapture")
+	}
+
+	select {
+	case opts := <-reload.logs:
+		if opts.Filename != "/tmp/pdns.log" || !opts.LogToStdout() {
+			t.Fatalf("unexpected log options %+v", opts)
+		}
+	default:
+		t.Fatal("no log options were sent to logConn")
+	}
+}
+
+func TestReloaderApplyUnreceived(t *testing.T) {
+	config := &pdnsConfig{device: "eth0", bpf: "port 53", numprocs: 8, gcAge: "-1m", gcInterval: "3m", quiet: true}
+	reload := newReloader(config, &statsClient{})
+
+	//nothing receives, as when doCapture has finished reading a pcap
+	applied := make(chan struct{})
+	go func() {
+		reload.apply(&pdnsConfig{device: "eth0", bpf: "udp port 53", numprocs: 8, gcAge: "-1m", gcInterval: "3m", quiet: true})
+		reload.apply(&pdnsConfig{device: "eth0", bpf: "tcp port 53", numprocs: 8, gcAge: "-1m", gcInterval: "3m", quiet: true})
+		close(applied)
+	}()
+	select {
+	case <-applied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a second reload blocked with the first not picked up")
+	}
+
+	//only the latest reload is waiting
+	if newConfig := <-reload.capture; newConfig.bpf != "tcp port 53" || len(reload.capture) != 0 || len(reload.logs) != 1 {
+		t.Fatalf("expected only the latest BPF filter, got %s with %d more", newConfig.bpf, len(reload.capture))
+	}
+}
+
+func TestReloadCapture(t *testing.T) {
+	handle := getHandle("a")
+	defer handle.Close()
+
+	config := &pdnsConfig{bpf: "port 53", gcAge: "-1m", gcInterval: "3m", statsdInterval: 3}
+	gcReload := make(chan gcSettings, 1)
+
+	reloadCapture(handle, config, &pdnsConfig{bpf: "asdf", gcAge: "-1m", gcInterval: "3m", statsdInterval: 3}, gcReload)
+	if config.bpf != "port 53" {
+		t.Fatalf("an invalid BPF filter replaced the running one: %s", config.bpf)
+	}
+	if len(gcReload) != 0 {
+		t.Fatal("GC settings were sent when they had not changed")
+	}
+
+	reloadCapture(handle, config, &pdnsConfig{bpf: "udp port 53", gcAge: "-10s", gcInterval: "30s", statsdInterval: 10}, gcReload)
+	if config.bpf != "udp port 53" {
+		t.Fatalf("expected BPF filter 'udp port 53', got %s", config.bpf)
+	}
+
+	settings := <-gcReload
+	if settings.maxAge != -10*time.Second || settings.interval != 30*time.Second {
+		t.Fatalf("unexpected GC settings %+v", settings)
+	}
+
+	if config.statsdInterval != 10 {
+		t.Fatalf("expected statsd interval 10, got %d", config.statsdInterval)
+	}
+}
+
+func TestConntableGCReload(t *testing.T) {
+	var finished = make(chan bool)
+	var reload = make(chan gcSettings)
+
+	conntable := newConnectionTable(conntableShards, conntableLimits{maxEntries: defaultConntableSize})
+	conntable.pair("1->53:1234", DNSMapEntry{inserted: time.Now().Add(-time.Second)})
+
+	go cleanDNSCache(connectionTables{conntable}, gcSettings{maxAge: -time.Hour, interval: time.Hour}, nil, "", logEntryOptions{}, stats, finished, reload)
+
+	reload <- gcSettings{maxAge: -time.Millisecond, interval: 10 * time.Millisecond}
+	time.Sleep(100 * time.Millisecond)
+	finished <- true
+
+	if conntable.len() != 0 {
+		t.Fatal("conntable entry was not collected after the GC settings were reloaded")
+	}
+}
+
+func TestReloadLogSinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopassivedns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &logOptions{quiet: true, Filename: filepath.Join(dir, "pdns.log"), MaxAge: 28, MaxSize: 100, MaxBackups: 3, SyslogPriority: "DEBUG"}
+	logs := startLogSinks(opts, stats)
+	if len(logs) != 1 || logs[0].name != "file" {
+		t.Fatalf("unexpected log sinks %+v", logs)
+	}
+	fileChan := logs[0].c
+
+	//only the syslog priority changed, which the file sink doesn't use
+	logs = reloadLogSinks(logs, &logOptions{quiet: true, Filename: opts.Filename, MaxAge: 28, MaxSize: 100, MaxBackups: 3, SyslogPriority: "INFO"}, stats)
+	if len(logs) != 1 || logs[0].c != fileChan {
+		t.Fatal("the file sink was restarted when its options had not changed")
+	}
+
+	logs = reloadLogSinks(logs, &logOptions{quiet: true, Filename: opts.Filename, MaxAge: 7, MaxSize: 100, MaxBackups: 3}, stats)
+	if len(logs) != 1 || logs[0].c == fileChan || logs[0].opts.MaxAge != 7 {
+		t.Fatal("the file sink was not restarted when its options changed")
+	}
+
+	logs = reloadLogSinks(logs, &logOptions{quiet: true}, stats)
+	if len(logs) != 0 {
+		t.Fatalf("the file sink was not closed when it was disabled, %+v", logs)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/smira/go-statsd"
+)
+
+// statsdCloseDelay is how long a swapped out statsd client stays open, so
+// packet handlers that fetched it before the swap can finish sending to it
+var statsdCloseDelay = 10 * time.Second
+
+// statsClient wraps the statsd client so the target can be swapped on SIGHUP
+// while the packet handling goroutines keep the same pointer. All methods are
+// safe to call on a nil statsClient or one without a statsd target.
+type statsClient struct {
+	client atomic.Value // *statsd.Client
+}
+
+// newStatsClient returns a statsClient sending to the statsd host in config,
+// if there is one.
+func newStatsClient(config *pdnsConfig) *statsClient {
+	stats := &statsClient{}
+	stats.client.Store(newStatsdClient(config))
+	return stats
+}
+
+func newStatsdClient(config *pdnsConfig) *statsd.Client {
+	if config.statsdHost == "" {
+		return nil
+	}
+
+	return statsd.NewClient(
+		config.statsdHost,
+		statsd.TagStyle(statsd.TagFormatDatadog),
+		statsd.MetricPrefix(fmt.Sprintf("%s.%s.", config.statsdPrefix, config.sensorName)),
+		statsd.FlushInterval(time.Duration(config.statsdInterval)*time.Second),
+		statsd.BufPoolCapacity(packetQueue),
+		statsd.SendLoopCount(config.numprocs),
+	)
+}
+
+func (s *statsClient) get() *statsd.Client {
+	if s == nil {
+		return nil
+	}
+	client, _ := s.client.Load().(*statsd.Client)
+	return client
+}
+
+// Swap points the stats at a new statsd client.  The old one is flushed and
+// closed after statsdCloseDelay, as closing it while a packet handler is still
+// sending to it panics.
+func (s *statsClient) Swap(client *statsd.Client) {
+	old := s.get()
+	s.client.Store(client)
+	if old != nil {
+		time.AfterFunc(statsdCloseDelay, func() { old.Close() })
+	}
+}
+
+// statsdName keeps the metric names statsd has always used by prefixing the
+// tag values onto the name, e.g. a worker tag of 3 gives "3.dns_lookups".
+func statsdName(stat string, tags []metricTag) string {
+	for i := len(tags) - 1; i >= 0; i-- {
+		stat = tags[i].value + "." + stat
+	}
+	return stat
+}
+
+// Incr increments a counter.
+func (s *statsClient) Incr(stat string, count int64, tags ...metricTag) {
+	if client := s.get(); client != nil {
+		client.Incr(statsdName(stat, tags), count)
+	}
+}
+
+// Gauge sets a gauge.
+func (s *statsClient) Gauge(stat string, value int64, tags ...metricTag) {
+	if client := s.get(); client != nil {
+		client.Gauge(statsdName(stat, tags), value)
+	}
+}
+
+// Timing records a duration in milliseconds.
+func (s *statsClient) Timing(stat string, value time.Duration, tags ...metricTag) {
+	if client := s.get(); client != nil {
+		client.PrecisionTiming(statsdName(stat, tags), value)
+	}
+}
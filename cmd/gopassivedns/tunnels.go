@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// the tunnel types logged in tunnelInfo
+const (
+	tunnelGRE    string = "gre"
+	tunnelERSPAN string = "erspan"
+	tunnelVXLAN  string = "vxlan"
+	tunnelGeneve string = "geneve"
+)
+
+// the GRE protocol types of ERSPAN, type I and II share one
+const (
+	greProtocolERSPAN   layers.EthernetType = 0x88be
+	greProtocolERSPANv3 layers.EthernetType = 0x22eb
+)
+
+// maxTunnelDepth is how many tunnels inside each other are decapsulated
+const maxTunnelDepth = 4
+
+// tunnelInfo is the outermost tunnel a packet was decapsulated from
+type tunnelInfo struct {
+	Type    string  `json:"type" msgpack:"type"` // gre, erspan, vxlan or geneve
+	Src     string  `json:"src" msgpack:"src"`   // the outer IP addresses
+	Dst     string  `json:"dst" msgpack:"dst"`
+	VNI     *uint32 `json:"vni,omitempty" msgpack:"vni,omitempty"`         // VXLAN and GENEVE
+	Session *uint16 `json:"session,omitempty" msgpack:"session,omitempty"` // ERSPAN type II and III
+}
+
+// decapsulateTunnels decodes the packets carried in GRE, ERSPAN, VXLAN and
+// GENEVE tunnels, replacing the decoded layers with the inner packet's so it
+// is logged like any other.  The outermost tunnel is recorded in the ingress.
+func (pd *packetData) decapsulateTunnels() {
+	for depth := 0; depth < maxTunnelDepth; depth++ {
+		tunnel, first, inner, err := tunnelPayload(pd.foundLayerTypes, pd.IPv4Layer, pd.IPv6Layer, pd.udpLayer)
+		if err != nil {
+			return
+		}
+
+		if pd.ingress.tunnel == nil {
+			tunnel.Src = pd.GetSrcIP().String()
+			tunnel.Dst = pd.GetDstIP().String()
+			pd.ingress.tunnel = tunnel
+		}
+
+		//the inner frame's VLAN tags are the tunnel's business, not ours
+		pd.newParser(first, &linkLayers{}).DecodeLayers(inner, &pd.foundLayerTypes)
+	}
+}
+
+// decapsulateFlow decodes the packet carried in up to maxTunnelDepth tunnels
+// into the given layers, replacing the outer packet's, so dispatchPackets can
+// hash a tunnelled lookup by its own flow.  found is updated to the inner
+// packet's layers.
+func decapsulateFlow(found *[]gopacket.LayerType, IPv4Layer *layers.IPv4, IPv6Layer *layers.IPv6, UDPLayer *layers.UDP, TCPLayer *layers.TCP) {
+	for depth := 0; depth < maxTunnelDepth; depth++ {
+		_, first, inner, err := tunnelPayload(*found, IPv4Layer, IPv6Layer, UDPLayer)
+		if err != nil {
+			return
+		}
+
+		var link linkLayers
+		parser := gopacket.NewDecodingLayerParser(first, append(link.decodingLayers(), IPv4Layer, IPv6Layer, UDPLayer, TCPLayer)...)
+		parser.DecodeLayers(inner, found)
+	}
+}
+
+// tunnelPayload decodes the tunnel header following the last of the found
+// layers, returning the tunnel, the layer the packet inside it starts with
+// and its bytes
+func tunnelPayload(found []gopacket.LayerType, IPv4Layer *layers.IPv4, IPv6Layer *layers.IPv6, UDPLayer *layers.UDP) (*tunnelInfo, gopacket.LayerType, []byte, error) {
+	if len(found) == 0 {
+		return nil, 0, nil, errors.New("no layers decoded")
+	}
+
+	switch found[len(found)-1] {
+	case layers.LayerTypeUDP:
+		//the well known ports are in gopacket's port table
+		switch UDPLayer.NextLayerType() {
+		case layers.LayerTypeVXLAN:
+			return decodeVXLANHeader(UDPLayer.Payload)
+		case layers.LayerTypeGeneve:
+			return decodeGeneveHeader(UDPLayer.Payload)
+		}
+	case layers.LayerTypeIPv4:
+		if IPv4Layer.NextLayerType() == layers.LayerTypeGRE {
+			return decodeGREHeader(IPv4Layer.Payload)
+		}
+	case layers.LayerTypeIPv6:
+		if IPv6Layer.NextLayerType() == layers.LayerTypeGRE {
+			return decodeGREHeader(IPv6Layer.Payload)
+		}
+	}
+	return nil, 0, nil, errors.New("not a tunnel")
+}
+
+// decodeGREHeader decodes a GRE header, RFC 2784 and 2890, and the ERSPAN
+// header following it if there is one
+func decodeGREHeader(data []byte) (*tunnelInfo, gopacket.LayerType, []byte, error) {
+	if len(data) < 4 {
+		return nil, 0, nil, errors.New("GRE header too short")
+	}
+	if data[1]&0x07 != 0 {
+		return nil, 0, nil, errors.New("unsupported GRE version")
+	}
+	if data[0]&0x40 != 0 {
+		return nil, 0, nil, errors.New("GRE source routing isn't supported")
+	}
+
+	checksum, key, sequence := data[0]&0x80 != 0, data[0]&0x20 != 0, data[0]&0x10 != 0
+	length := 4
+	for _, present := range []bool{checksum, key, sequence} {
+		if present {
+			length += 4
+		}
+	}
+	if len(data) < length {
+		return nil, 0, nil, errors.New("GRE header too short")
+	}
+
+	protocol := layers.EthernetType(binary.BigEndian.Uint16(data[2:4]))
+	payload := data[length:]
+	switch protocol {
+	case greProtocolERSPAN:
+		//type I has no ERSPAN header, and no sequence number to tell it by
+		if !sequence {
+			return &tunnelInfo{Type: tunnelERSPAN}, layers.LayerTypeEthernet, payload, nil
+		}
+		return decodeERSPANHeader(payload)
+	case greProtocolERSPANv3:
+		return decodeERSPANHeader(payload)
+	case layers.EthernetTypeTransparentEthernetBridging, layers.EthernetTypeIPv4, layers.EthernetTypeIPv6, layers.EthernetTypeMPLSUnicast:
+		return &tunnelInfo{Type: tunnelGRE}, protocol.LayerType(), payload, nil
+	default:
+		return nil, 0, nil, errors.New("unsupported GRE protocol " + protocol.String())
+	}
+}
+
+// decodeERSPANHeader decodes an ERSPAN type II or III header, which is
+// followed by the mirrored Ethernet frame
+func decodeERSPANHeader(data []byte) (*tunnelInfo, gopacket.LayerType, []byte, error) {
+	if len(data) < 8 {
+		return nil, 0, nil, errors.New("ERSPAN header too short")
+	}
+
+	session := binary.BigEndian.Uint16(data[2:4]) & 0x3ff
+	length := 8
+	switch data[0] >> 4 {
+	case 1:
+		//type II
+	case 2:
+		//type III, with an optional platform specific subheader when the O bit is set
+		length = 12
+		if len(data) >= 12 && data[11]&0x01 != 0 {
+			length += 8
+		}
+	default:
+		return nil, 0, nil, errors.New("unsupported ERSPAN version")
+	}
+	if len(data) < length {
+		return nil, 0, nil, errors.New("ERSPAN header too short")
+	}
+
+	return &tunnelInfo{Type: tunnelERSPAN, Session: &session}, layers.LayerTypeEthernet, data[length:], nil
+}
+
+// decodeVXLANHeader decodes a VXLAN header, RFC 7348
+func decodeVXLANHeader(data []byte) (*tunnelInfo, gopacket.LayerType, []byte, error) {
+	if len(data) < 8 {
+		return nil, 0, nil, errors.New("VXLAN header too short")
+	}
+
+	vni := binary.BigEndian.Uint32(data[4:8]) >> 8
+	return &tunnelInfo{Type: tunnelVXLAN, VNI: &vni}, layers.LayerTypeEthernet, data[8:], nil
+}
+
+// decodeGeneveHeader decodes a GENEVE header and skips its options, RFC 8926
+func decodeGeneveHeader(data []byte) (*tunnelInfo, gopacket.LayerType, []byte, error) {
+	if len(data) < 8 {
+		return nil, 0, nil, errors.New("GENEVE header too short")
+	}
+	if data[0]>>6 != 0 {
+		return nil, 0, nil, errors.New("unsupported GENEVE version")
+	}
+
+	length := 8 + int(data[0]&0x3f)*4
+	if len(data) < length {
+		return nil, 0, nil, errors.New("GENEVE header too short")
+	}
+
+	//Ethernet frames are carried as transparent Ethernet bridging
+	protocol := layers.EthernetType(binary.BigEndian.Uint16(data[2:4]))
+	vni := binary.BigEndian.Uint32(data[4:8]) >> 8
+	return &tunnelInfo{Type: tunnelGeneve, VNI: &vni}, protocol.LayerType(), data[length:], nil
+}
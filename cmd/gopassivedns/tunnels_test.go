@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+func TestDecodeTunnelHeaders(t *testing.T) {
+	//GRE with a key and sequence number, carrying IPv4
+	tunnel, first, inner, err := decodeGREHeader([]byte{0x30, 0, 0x08, 0, 0, 0, 0, 1, 0, 0, 0, 2, 0x45})
+	if err != nil || tunnel.Type != tunnelGRE || first != layers.LayerTypeIPv4 || len(inner) != 1 {
+		t.Fatalf("Bad GRE decode %+v, %s, %v (%v), expecting IPv4 after 12 bytes", tunnel, first, inner, err)
+	}
+
+	//ERSPAN type I is GRE without a sequence number or ERSPAN header
+	tunnel, first, inner, err = decodeGREHeader([]byte{0, 0, 0x88, 0xbe, 0xff})
+	if err != nil || tunnel.Type != tunnelERSPAN || tunnel.Session != nil || first != layers.LayerTypeEthernet || len(inner) != 1 {
+		t.Fatalf("Bad ERSPAN type I decode %+v, %s, %v (%v)", tunnel, first, inner, err)
+	}
+
+	//a GENEVE header with 8 bytes of options
+	tunnel, first, inner, err = decodeGeneveHeader([]byte{0x02, 0, 0x86, 0xdd, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x60})
+	if err != nil || *tunnel.VNI != 1 || first != layers.LayerTypeIPv6 || len(inner) != 1 {
+		t.Fatalf("Bad GENEVE decode %+v, %s, %v (%v)", tunnel, first, inner, err)
+	}
+
+	for name, header := range map[string][]byte{
+		"short GRE":               {0, 0, 0x65},
+		"GRE missing its key":     {0x20, 0, 0x65, 0x58, 0},
+		"PPTP GRE":                {0x30, 0x01, 0x88, 0x0b},
+		"GRE with source routing": {0x40, 0, 0x08, 0},
+		"GRE carrying ARP":        {0, 0, 0x08, 0x06},
+		"short ERSPAN type II":    {0x10, 0, 0x88, 0xbe, 0, 0, 0, 1, 0x10, 0},
+		"short ERSPAN type III":   {0x10, 0, 0x22, 0xeb, 0, 0, 0, 1, 0x20, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0, 1},
+		"unknown ERSPAN version":  {0x10, 0, 0x88, 0xbe, 0, 0, 0, 1, 0x30, 0, 0, 7, 0, 0, 0, 0},
+	} {
+		if _, _, _, err := decodeGREHeader(header); err == nil {
+			t.Fatalf("decodeGREHeader did not fail on %s", name)
+		}
+	}
+
+	if _, _, _, err := decodeVXLANHeader([]byte{0x08, 0, 0, 0, 0, 0, 42}); err == nil {
+		t.Fatal("decodeVXLANHeader did not fail on a short header")
+	}
+
+	if _, _, _, err := decodeGeneveHeader([]byte{0x01, 0, 0x65, 0x58, 0, 0, 42, 0}); err == nil {
+		t.Fatal("decodeGeneveHeader did not fail on missing options")
+	}
+}
@@ -1,52 +1,212 @@
 package main
 
 import (
+	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
+// dnsTypeNames is the IANA DNS RR TYPE registry, indexed by type.  ANY is
+// registered as "*" but has always been logged as ANY.
+var dnsTypeNames = [...]string{
+	1:   "A",
+	2:   "NS",
+	3:   "MD",
+	4:   "MF",
+	5:   "CNAME",
+	6:   "SOA",
+	7:   "MB",
+	8:   "MG",
+	9:   "MR",
+	10:  "NULL",
+	11:  "WKS",
+	12:  "PTR",
+	13:  "HINFO",
+	14:  "MINFO",
+	15:  "MX",
+	16:  "TXT",
+	17:  "RP",
+	18:  "AFSDB",
+	19:  "X25",
+	20:  "ISDN",
+	21:  "RT",
+	22:  "NSAP",
+	23:  "NSAP-PTR",
+	24:  "SIG",
+	25:  "KEY",
+	26:  "PX",
+	27:  "GPOS",
+	28:  "AAAA",
+	29:  "LOC",
+	30:  "NXT",
+	31:  "EID",
+	32:  "NIMLOC",
+	33:  "SRV",
+	34:  "ATMA",
+	35:  "NAPTR",
+	36:  "KX",
+	37:  "CERT",
+	38:  "A6",
+	39:  "DNAME",
+	40:  "SINK",
+	41:  "OPT",
+	42:  "APL",
+	43:  "DS",
+	44:  "SSHFP",
+	45:  "IPSECKEY",
+	46:  "RRSIG",
+	47:  "NSEC",
+	48:  "DNSKEY",
+	49:  "DHCID",
+	50:  "NSEC3",
+	51:  "NSEC3PARAM",
+	52:  "TLSA",
+	53:  "SMIMEA",
+	55:  "HIP",
+	56:  "NINFO",
+	57:  "RKEY",
+	58:  "TALINK",
+	59:  "CDS",
+	60:  "CDNSKEY",
+	61:  "OPENPGPKEY",
+	62:  "CSYNC",
+	63:  "ZONEMD",
+	64:  "SVCB",
+	65:  "HTTPS",
+	66:  "DSYNC",
+	99:  "SPF",
+	100: "UINFO",
+	101: "UID",
+	102: "GID",
+	103: "UNSPEC",
+	104: "NID",
+	105: "L32",
+	106: "L64",
+	107: "LP",
+	108: "EUI48",
+	109: "EUI64",
+	128: "NXNAME",
+	249: "TKEY",
+	250: "TSIG",
+	251: "IXFR",
+	252: "AXFR",
+	253: "MAILB",
+	254: "MAILA",
+	255: "ANY", //per http://tools.ietf.org/html/rfc1035#page-12
+	256: "URI",
+	257: "CAA",
+	258: "AVC",
+	259: "DOA",
+	260: "AMTRELAY",
+	261: "RESINFO",
+	262: "WALLET",
+	263: "CLA",
+	264: "IPN",
+}
+
+// the registered types beyond the end of dnsTypeNames
+const (
+	dnsTypeTA  layers.DNSType = 32768
+	dnsTypeDLV layers.DNSType = 32769
+)
+
+// dnsClassNames is the IANA DNS CLASS registry
+var dnsClassNames = map[layers.DNSClass]string{
+	1:   "IN",
+	3:   "CH",
+	4:   "HS",
+	254: "NONE",
+	255: "ANY",
+}
+
+// dnsTypeValues and dnsClassValues map the names back for ParseType and ParseClass
+var dnsTypeValues = make(map[string]layers.DNSType)
+var dnsClassValues = make(map[string]layers.DNSClass)
+
+func init() {
+	for dnsType, name := range dnsTypeNames {
+		if name != "" {
+			dnsTypeValues[name] = layers.DNSType(dnsType)
+		}
+	}
+	dnsTypeValues["*"] = 255
+	dnsTypeValues["TA"] = dnsTypeTA
+	dnsTypeValues["DLV"] = dnsTypeDLV
+
+	for dnsClass, name := range dnsClassNames {
+		dnsClassValues[name] = dnsClass
+	}
+	dnsClassValues["*"] = 255
+}
+
 // TypeString returns the string for the layer returned type.
 // The gopacket DNS layer doesn't have a lot of good String()
 // conversion methods, so we have to do a lot of that ourselves
-// here.  Much of this should move back into gopacket.  Also a
-// little worried about the perf impact of doing string conversions
-// in this thread...
+// here.  This is on the hot path, so the common case is a
+// single array lookup.
 func TypeString(dnsType layers.DNSType) string {
+	if int(dnsType) < len(dnsTypeNames) {
+		if name := dnsTypeNames[dnsType]; name != "" {
+			return name
+		}
+	}
 	switch dnsType {
-	case layers.DNSTypeA:
-		return "A"
-	case layers.DNSTypeAAAA:
-		return "AAAA"
-	case layers.DNSTypeCNAME:
-		return "CNAME"
-	case layers.DNSTypeMX:
-		return "MX"
-	case layers.DNSTypeNS:
-		return "NS"
-	case layers.DNSTypePTR:
-		return "PTR"
-	case layers.DNSTypeTXT:
-		return "TXT"
-	case layers.DNSTypeSOA:
-		return "SOA"
-	case layers.DNSTypeSRV:
-		return "SRV"
-	case 255: //ANY query per http://tools.ietf.org/html/rfc1035#page-12
-		return "ANY"
+	case dnsTypeTA:
+		return "TA"
+	case dnsTypeDLV:
+		return "DLV"
 	default:
 		//take a blind stab...at least this shouldn't *lose* data
 		return strconv.Itoa(int(dnsType))
 	}
 }
 
-// RRString returns the string for the encoded type.
-// The gopacket DNS layer doesn't have a lot of good String()
-// conversion methods, so we have to do a lot of that ourselves
-// here.  Much of this should move back into gopacket.  Also a
-// little worried about the perf impact of doing string conversions
-// in this thread...
+// ParseType is the reverse of TypeString, for use in filters.  It accepts
+// mnemonics in any case, "*" for ANY and the RFC 3597 TYPEnnn form.
+func ParseType(name string) (layers.DNSType, error) {
+	name = strings.ToUpper(name)
+	if dnsType, ok := dnsTypeValues[name]; ok {
+		return dnsType, nil
+	}
+	if strings.HasPrefix(name, "TYPE") {
+		if value, err := strconv.ParseUint(name[4:], 10, 16); err == nil {
+			return layers.DNSType(value), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid DNS type: %s", name)
+}
+
+// ClassString returns the mnemonic for a DNS class, or the RFC 3597 CLASSnnn
+// form for unassigned classes.
+func ClassString(dnsClass layers.DNSClass) string {
+	if name, ok := dnsClassNames[dnsClass]; ok {
+		return name
+	}
+	return "CLASS" + strconv.Itoa(int(dnsClass))
+}
+
+// ParseClass is the reverse of ClassString.
+func ParseClass(name string) (layers.DNSClass, error) {
+	name = strings.ToUpper(name)
+	if dnsClass, ok := dnsClassValues[name]; ok {
+		return dnsClass, nil
+	}
+	if strings.HasPrefix(name, "CLASS") {
+		if value, err := strconv.ParseUint(name[5:], 10, 16); err == nil {
+			return layers.DNSClass(value), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid DNS class: %s", name)
+}
+
+// RRString returns the RDATA of rr in zone file presentation format,
+// e.g. "10 mx.example.com" for an MX record.  The common single value
+// types are converted here directly, everything else goes through
+// decodeRData.  Anything we can't decode is written in the RFC 3597
+// generic format (\# length hex) rather than dumping the raw bytes.
 func RRString(rr layers.DNSResourceRecord) string {
 	switch rr.Type {
 	case layers.DNSTypeA:
@@ -54,25 +214,13 @@ func RRString(rr layers.DNSResourceRecord) string {
 	case layers.DNSTypeAAAA:
 		return rr.IP.String()
 	case layers.DNSTypeCNAME:
-		return string(rr.CNAME)
-	case layers.DNSTypeMX:
-		//TODO: add the priority
-		return string(rr.MX.Name)
+		return presentationName(rr.CNAME)
 	case layers.DNSTypeNS:
-		return string(rr.NS)
+		return presentationName(rr.NS)
 	case layers.DNSTypePTR:
-		return string(rr.PTR)
-	case layers.DNSTypeTXT:
-		return string(rr.TXT)
-	case layers.DNSTypeSOA:
-		//TODO: rebuild the full SOA string
-		return string(rr.SOA.RName)
-	case layers.DNSTypeSRV:
-		//TODO: rebuild the full SRV string
-		return string(rr.SRV.Name)
+		return presentationName(rr.PTR)
 	default:
-		//take a blind stab...at least this shouldn't *lose* data
-		return string(rr.Data)
+		return decodeRData(rr).String()
 	}
 }
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strconv"
 	"testing"
 
 	"github.com/google/gopacket/layers"
@@ -129,3 +130,186 @@ func TestTypeString(t *testing.T) {
 		})
 	}
 }
+
+// ianaTypes is the IANA "Resource Record (RR) TYPEs" registry
+var ianaTypes = []struct {
+	value layers.DNSType
+	name  string
+}{
+	{1, "A"},
+	{2, "NS"},
+	{3, "MD"},
+	{4, "MF"},
+	{5, "CNAME"},
+	{6, "SOA"},
+	{7, "MB"},
+	{8, "MG"},
+	{9, "MR"},
+	{10, "NULL"},
+	{11, "WKS"},
+	{12, "PTR"},
+	{13, "HINFO"},
+	{14, "MINFO"},
+	{15, "MX"},
+	{16, "TXT"},
+	{17, "RP"},
+	{18, "AFSDB"},
+	{19, "X25"},
+	{20, "ISDN"},
+	{21, "RT"},
+	{22, "NSAP"},
+	{23, "NSAP-PTR"},
+	{24, "SIG"},
+	{25, "KEY"},
+	{26, "PX"},
+	{27, "GPOS"},
+	{28, "AAAA"},
+	{29, "LOC"},
+	{30, "NXT"},
+	{31, "EID"},
+	{32, "NIMLOC"},
+	{33, "SRV"},
+	{34, "ATMA"},
+	{35, "NAPTR"},
+	{36, "KX"},
+	{37, "CERT"},
+	{38, "A6"},
+	{39, "DNAME"},
+	{40, "SINK"},
+	{41, "OPT"},
+	{42, "APL"},
+	{43, "DS"},
+	{44, "SSHFP"},
+	{45, "IPSECKEY"},
+	{46, "RRSIG"},
+	{47, "NSEC"},
+	{48, "DNSKEY"},
+	{49, "DHCID"},
+	{50, "NSEC3"},
+	{51, "NSEC3PARAM"},
+	{52, "TLSA"},
+	{53, "SMIMEA"},
+	{55, "HIP"},
+	{56, "NINFO"},
+	{57, "RKEY"},
+	{58, "TALINK"},
+	{59, "CDS"},
+	{60, "CDNSKEY"},
+	{61, "OPENPGPKEY"},
+	{62, "CSYNC"},
+	{63, "ZONEMD"},
+	{64, "SVCB"},
+	{65, "HTTPS"},
+	{66, "DSYNC"},
+	{99, "SPF"},
+	{100, "UINFO"},
+	{101, "UID"},
+	{102, "GID"},
+	{103, "UNSPEC"},
+	{104, "NID"},
+	{105, "L32"},
+	{106, "L64"},
+	{107, "LP"},
+	{108, "EUI48"},
+	{109, "EUI64"},
+	{128, "NXNAME"},
+	{249, "TKEY"},
+	{250, "TSIG"},
+	{251, "IXFR"},
+	{252, "AXFR"},
+	{253, "MAILB"},
+	{254, "MAILA"},
+	{255, "ANY"},
+	{256, "URI"},
+	{257, "CAA"},
+	{258, "AVC"},
+	{259, "DOA"},
+	{260, "AMTRELAY"},
+	{261, "RESINFO"},
+	{262, "WALLET"},
+	{263, "CLA"},
+	{264, "IPN"},
+	{32768, "TA"},
+	{32769, "DLV"},
+}
+
+func TestTypeStringIANA(t *testing.T) {
+	for _, tt := range ianaTypes {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TypeString(tt.value); got != tt.name {
+				t.Errorf("TypeString(%d) = %v, want %v", tt.value, got, tt.name)
+			}
+			if got, err := ParseType(tt.name); got != tt.value || err != nil {
+				t.Errorf("ParseType(%s) = %v, %v, want %v", tt.name, got, err, tt.value)
+			}
+		})
+	}
+
+	//unassigned types keep the bare number
+	for _, unassigned := range []layers.DNSType{0, 54, 67, 110, 265, 32770, 65535} {
+		if got := TypeString(unassigned); got != strconv.Itoa(int(unassigned)) {
+			t.Errorf("TypeString(%d) = %v, want %d", unassigned, got, unassigned)
+		}
+	}
+}
+
+func TestParseType(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    layers.DNSType
+		wantErr bool
+	}{
+		{name: "https", want: 65},
+		{name: "Nsec3Param", want: 51},
+		{name: "*", want: 255},
+		{name: "TYPE65534", want: 65534},
+		{name: "type1", want: 1},
+		{name: "TYPE65536", wantErr: true},
+		{name: "TYPE", wantErr: true},
+		{name: "NOTATYPE", wantErr: true},
+		{name: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseType(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseType() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClassString(t *testing.T) {
+	tests := []struct {
+		value layers.DNSClass
+		name  string
+	}{
+		{1, "IN"},
+		{3, "CH"},
+		{4, "HS"},
+		{254, "NONE"},
+		{255, "ANY"},
+		{2, "CLASS2"},
+		{65280, "CLASS65280"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassString(tt.value); got != tt.name {
+				t.Errorf("ClassString(%d) = %v, want %v", tt.value, got, tt.name)
+			}
+			if got, err := ParseClass(tt.name); got != tt.value || err != nil {
+				t.Errorf("ParseClass(%s) = %v, %v, want %v", tt.name, got, err, tt.value)
+			}
+		})
+	}
+
+	if got, err := ParseClass("*"); got != 255 || err != nil {
+		t.Errorf("ParseClass(*) = %v, %v, want 255", got, err)
+	}
+	if _, err := ParseClass("CHAOSNET"); err == nil {
+		t.Error("ParseClass(CHAOSNET) did not return an error")
+	}
+}
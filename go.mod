@@ -3,10 +3,15 @@ module github.com/jimmystewpot/gopassivedns
 go 1.14
 
 require (
+	github.com/Shopify/sarama v1.29.0
+	github.com/dnstap/golang-dnstap v0.4.0
 	github.com/google/gopacket v1.1.19
 	github.com/pquerna/ffjson v0.0.0-20190930134022-aa0246cd15f7
+	github.com/prometheus/client_golang v1.12.2
 	github.com/sirupsen/logrus v1.9.3
 	github.com/smira/go-statsd v1.3.4
 	github.com/vmihailenco/msgpack/v5 v5.4.1
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
+	gopkg.in/yaml.v3 v3.0.1
 )